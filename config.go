@@ -1,32 +1,60 @@
 package main
 
 import (
-	"github.com/cyberfined/sechan/proto"
 	"encoding/json"
 	"errors"
+	"github.com/cyberfined/sechan/proto"
 	"io/ioutil"
 	"net"
+	"os"
 	"strings"
 	"time"
 )
 
 const (
-	configFile = "config"
-	stateFile  = "state"
-	peersFile  = "peers"
+	configFile    = "config"
+	managerSocket = "manager.sock"
+	stateFile     = "state"
+	identityFile  = "identity"
+	peersFile     = "peers"
+	pinsFile      = "pins"
+	historyFile   = "history"
+	groupsFile    = "groups"
+	outboxFile    = "outbox"
 )
 
 type Config struct {
 	UserConfig
 	DHStateConfig
-	Peers map[string]*proto.Peer
+	Identity *proto.Identity
+	Peers    *proto.PeerRegistry
+	Pins     *proto.PinStore
+	Groups   *proto.GroupStore
+	Outbox   *proto.Outbox
+	Vault    *proto.Vault
+	Savers   []*proto.Saver
 }
 
 type UserConfig struct {
-	Login     string
-	Interface string
-	Addr      string
-	Port      string
+	Login        string
+	Interface    string
+	Addr         string
+	Port         string
+	Transport    string
+	Manager      string
+	ManagerToken string
+	Legacy       bool
+	Suites       []string
+	Rekey        *proto.RekeyPolicy
+	Encrypt      bool
+	History      bool
+	ReplayWindow uint32
+	MaxPacket    uint32
+	Outbox       *proto.OutboxLimits
+	Relay        bool
+	RelayHops    uint8
+	Downloads    string
+	Files        *proto.FileLimits
 }
 
 type DHStateConfig struct {
@@ -51,10 +79,46 @@ func LoadUserConfig() (*UserConfig, error) {
 		return nil, err
 	}
 
+	if uc.Manager == "" {
+		uc.Manager = managerSocket
+	}
+
+	if uc.Rekey == nil {
+		uc.Rekey = &proto.DefaultRekeyPolicy
+	}
+
+	if uc.Outbox == nil {
+		uc.Outbox = &proto.DefaultOutboxLimits
+	}
+
+	if uc.MaxPacket == 0 {
+		uc.MaxPacket = proto.DefaultMaxPacket
+	}
+
+	if uc.Files == nil {
+		uc.Files = &proto.DefaultFileLimits
+	}
+
+	if len(uc.Suites) == 0 {
+		uc.Suites = []string{"double-ratchet", "aes-256-gcm", "chacha20-poly1305"}
+	}
+
 	return uc, nil
 }
 
-func LoadDHStateConfig() (*DHStateConfig, error) {
+func (uc *UserConfig) CipherSuites() ([]uint8, error) {
+	suites := make([]uint8, len(uc.Suites))
+	for i, name := range uc.Suites {
+		suite, err := proto.ParseSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		suites[i] = suite
+	}
+	return suites, nil
+}
+
+func LoadDHStateConfig(vault *proto.Vault) (*DHStateConfig, error) {
 	var (
 		dh         *DHStateConfig
 		difference time.Duration
@@ -62,7 +126,7 @@ func LoadDHStateConfig() (*DHStateConfig, error) {
 
 	dh = &DHStateConfig{}
 
-	buf, err := ioutil.ReadFile(stateFile)
+	buf, err := vault.ReadFile(stateFile)
 	if err != nil {
 		goto Gen
 	}
@@ -86,28 +150,106 @@ Gen:
 	dh.Created = time.Now()
 
 	buf, _ = json.Marshal(dh)
-	ioutil.WriteFile(stateFile, buf, 0644)
+	vault.WriteFile(stateFile, buf, 0600)
 	return dh, nil
 }
 
-func LoadPeers() map[string]*proto.Peer {
-	buf, err := ioutil.ReadFile(peersFile)
+func LoadIdentity(vault *proto.Vault) (*proto.Identity, error) {
+	buf, err := vault.ReadFile(identityFile)
+	if err == nil {
+		id := &proto.Identity{}
+		err = json.Unmarshal(buf, id)
+		if err != nil {
+			return nil, err
+		}
+		return id, id.CheckIdentity()
+	}
+
+	// Don't replace identity which can't be read
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	id, err := proto.InitIdentity()
 	if err != nil {
-		return make(map[string]*proto.Peer)
+		return nil, err
 	}
 
-	peers := make(map[string]*proto.Peer)
-	err = json.Unmarshal(buf, &peers)
+	buf, _ = json.Marshal(id)
+	err = vault.WriteFile(identityFile, buf, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// loadStore reads store name of vault into v. Missing store leaves v empty,
+// broken one isn't replaced with an empty one.
+func loadStore(vault *proto.Vault, name string, v any) error {
+	buf, err := vault.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		return make(map[string]*proto.Peer)
+		return err
 	}
+	return json.Unmarshal(buf, v)
+}
 
-	return peers
+func LoadPeers(vault *proto.Vault) (*proto.PeerRegistry, error) {
+	peers := proto.CreatePeerRegistry(nil)
+	err := loadStore(vault, peersFile, peers)
+	if err != nil {
+		return nil, err
+	}
+	return peers, nil
 }
 
-func SavePeers(peers map[string]*proto.Peer) {
+func SavePeers(vault *proto.Vault, peers *proto.PeerRegistry) error {
 	buf, _ := json.Marshal(peers)
-	ioutil.WriteFile(peersFile, buf, 0644)
+	return vault.WriteFile(peersFile, buf, 0600)
+}
+
+func LoadPins(vault *proto.Vault) (*proto.PinStore, error) {
+	pins := proto.CreatePinStore(nil)
+	err := loadStore(vault, pinsFile, pins)
+	if err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+func LoadGroups(vault *proto.Vault) (*proto.GroupStore, error) {
+	groups := proto.CreateGroupStore(nil)
+	err := loadStore(vault, groupsFile, groups)
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func SaveGroups(vault *proto.Vault, groups *proto.GroupStore) error {
+	buf, _ := json.Marshal(groups)
+	return vault.WriteFile(groupsFile, buf, 0600)
+}
+
+func LoadOutbox(vault *proto.Vault, limits proto.OutboxLimits) (*proto.Outbox, error) {
+	outbox := proto.CreateOutbox(nil, limits)
+	err := loadStore(vault, outboxFile, outbox)
+	if err != nil {
+		return nil, err
+	}
+	return outbox, nil
+}
+
+func SaveOutbox(vault *proto.Vault, outbox *proto.Outbox) error {
+	buf, _ := json.Marshal(outbox)
+	return vault.WriteFile(outboxFile, buf, 0600)
+}
+
+func SavePins(vault *proto.Vault, pins *proto.PinStore) error {
+	buf, _ := json.Marshal(pins)
+	return vault.WriteFile(pinsFile, buf, 0600)
 }
 
 func addrByInterface(name string) (string, error) {
@@ -135,16 +277,62 @@ func LoadConfig() (*Config, error) {
 		return nil, err
 	}
 
-	dh, err := LoadDHStateConfig()
+	vault, err := LoadVault(uc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Finite field parameters are needed only by legacy handshake
+	dh := &DHStateConfig{}
+	if uc.Legacy {
+		dh, err = LoadDHStateConfig(vault)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := LoadIdentity(vault)
+	if err != nil {
+		return nil, err
+	}
+
+	peers, err := LoadPeers(vault)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := LoadPins(vault)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := LoadGroups(vault)
+	if err != nil {
+		return nil, err
+	}
+	outbox, err := LoadOutbox(vault, *uc.Outbox)
 	if err != nil {
 		return nil, err
 	}
 
-	peers := LoadPeers()
+	// Every file has a single writer, changes made during a save are saved
+	// with the next one
+	peersSaver := proto.CreateSaver(func() error { return SavePeers(vault, peers) })
+	peers.OnChange = func(string) { peersSaver.Changed() }
+	pinsSaver := proto.CreateSaver(func() error { return SavePins(vault, pins) })
+	pins.OnChange = pinsSaver.Changed
+	groupsSaver := proto.CreateSaver(func() error { return SaveGroups(vault, groups) })
+	groups.OnChange = groupsSaver.Changed
+	outboxSaver := proto.CreateSaver(func() error { return SaveOutbox(vault, outbox) })
+	outbox.OnChange = outboxSaver.Changed
 
 	return &Config{
 		UserConfig:    *uc,
 		DHStateConfig: *dh,
+		Identity:      id,
 		Peers:         peers,
+		Pins:          pins,
+		Groups:        groups,
+		Outbox:        outbox,
+		Vault:         vault,
+		Savers:        []*proto.Saver{peersSaver, pinsSaver, groupsSaver, outboxSaver},
 	}, nil
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"github.com/cyberfined/sechan/proto"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const (
+	keystoreFile  = "keystore"
+	passphraseEnv = "SECHAN_PASSPHRASE"
+)
+
+var (
+	passphraseFd = flag.Int("passphrase-fd", -1, "read keystore passphrase from file descriptor")
+	migrate      = flag.Bool("migrate", false, "encrypt local files written before encryption was enabled")
+)
+
+// LoadVault unlocks keystore. Keystore is created on the first start with
+// enabled encryption, without keystore local files are stored in plain text.
+// Plain files left from that time are encrypted only with -migrate.
+func LoadVault(uc *UserConfig) (*proto.Vault, error) {
+	vault, err := unlockVault()
+	if err != nil {
+		return nil, err
+	}
+	if vault == nil && uc.Encrypt {
+		vault, err = createVault()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if vault == nil || !*migrate {
+		return vault, nil
+	}
+
+	for _, name := range []string{stateFile, identityFile, peersFile, pinsFile, groupsFile, outboxFile} {
+		err = vault.Migrate(name, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vault, vault.Migrate(historyFile, true)
+}
+
+// ExportFile writes decrypted history or received file to output, standard
+// output is used without it.
+func ExportFile(name, output string) error {
+	if name == "" {
+		return errors.New("usage: sechan export <file> [<output>]")
+	}
+
+	vault, err := unlockVault()
+	if err != nil {
+		return err
+	}
+	if vault == nil {
+		return errors.New("keystore isn't found, files aren't encrypted")
+	}
+	if output == "" {
+		return vault.Export(name, os.Stdout)
+	}
+
+	fd, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = vault.Export(name, fd)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+	}
+	return err
+}
+
+// unlockVault unlocks existing keystore, nil Vault is returned without it.
+func unlockVault() (*proto.Vault, error) {
+	buf, err := ioutil.ReadFile(keystoreFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &proto.Keystore{}
+	err = json.Unmarshal(buf, ks)
+	if err != nil {
+		return nil, err
+	}
+
+	pass, err := readPassphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	return ks.Unlock(pass)
+}
+
+func createVault() (*proto.Vault, error) {
+	pass, err := readPassphrase(true)
+	if err != nil {
+		return nil, err
+	}
+
+	ks, vault, err := proto.CreateKeystore(pass)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, _ := json.Marshal(ks)
+	err = ioutil.WriteFile(keystoreFile, buf, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return vault, nil
+}
+
+// readPassphrase reads passphrase from environment variable, file descriptor
+// or terminal in that order. Headless nodes use the first two.
+func readPassphrase(confirm bool) ([]byte, error) {
+	pass, ok := os.LookupEnv(passphraseEnv)
+	if ok {
+		os.Unsetenv(passphraseEnv)
+		return []byte(pass), nil
+	}
+
+	if *passphraseFd >= 0 {
+		fd := os.NewFile(uintptr(*passphraseFd), "passphrase")
+		defer fd.Close()
+
+		line, err := bufio.NewReader(fd).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		return nil, errors.New("passphrase is required: set " + passphraseEnv + " or use -passphrase-fd")
+	}
+
+	fmt.Fprint(os.Stderr, "passphrase: ")
+	buf, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil || !confirm {
+		return buf, err
+	}
+
+	fmt.Fprint(os.Stderr, "repeat passphrase: ")
+	again, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(buf) != string(again) {
+		return nil, errors.New("passphrases don't match")
+	}
+	return buf, nil
+}
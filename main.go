@@ -1,51 +1,106 @@
 package main
 
 import (
+	"flag"
 	"github.com/cyberfined/sechan/proto"
 	"log"
+	"net"
 	"os"
 	"os/signal"
-	"strings"
 )
 
 func main() {
+	flag.Parse()
+
+	if flag.Arg(0) == "export" {
+		err := ExportFile(flag.Arg(1), flag.Arg(2))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	config, err := LoadConfig()
+	if err == proto.ErrPlainFile {
+		log.Fatalln(err, "- run once with -migrate to encrypt local files")
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
 	log.Println("config is loaded")
 
+	suites, err := config.CipherSuites()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("identity fingerprint: %s\n", proto.Fingerprint(config.Identity.Public))
+
+	transport, err := proto.TransportByName(config.Transport)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	host := &proto.Host{
-		Login:    config.Login,
-		Addr:     config.Addr + ":" + config.Port,
-		DifHel:   config.DifHel,
-		Peers:    config.Peers,
-		Commands: proto.PeerCommands,
-		Msg:      make(chan string),
-		Quit:     make(chan bool),
+		Login:        config.Login,
+		Addr:         net.JoinHostPort(config.Addr, config.Port),
+		DifHel:       config.DifHel,
+		Identity:     config.Identity,
+		Peers:        config.Peers,
+		Pins:         config.Pins,
+		Groups:       config.Groups,
+		Outbox:       config.Outbox,
+		Legacy:       config.Legacy,
+		Suites:       suites,
+		Rekey:        *config.Rekey,
+		Vault:        config.Vault,
+		History:      historyPath(config),
+		ReplayWindow: config.ReplayWindow,
+		MaxPacket:    config.MaxPacket,
+		Relay:        config.Relay,
+		RelayHops:    config.RelayHops,
+		Downloads:    config.Downloads,
+		Files:        *config.Files,
+		Transport:    transport,
+		ManagerToken: config.ManagerToken,
+		Commands:     proto.PeerCommands,
+		Events:       proto.CreateEventBus(proto.DefaultEventQueue, proto.DefaultOfflineEvents),
+		Quit:         make(chan bool),
 	}
 
-	sigchan := make(chan os.Signal)
+	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, os.Interrupt)
 	go func() {
 		select {
 		case <-sigchan:
-			Exit(host)
+			Exit(host, config.Savers)
 		case <-host.Quit:
-			Exit(host)
+			Exit(host, config.Savers)
 		}
 	}()
 
 	go SendInfo(host, "239.0.0.0:12337")
 	go ReceiveInfo(host, "239.0.0.0:12337")
 
-	ln, err := proto.Listen("tcp", ":"+config.Port)
+	ln, err := transport.Listen(":" + config.Port)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	log.Printf("server is started: %s\n", host.Addr)
 
+	// Managers are served only on the Unix socket
+	mln, err := proto.ListenManager(config.Manager)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("manager socket: %s\n", config.Manager)
+	go Serve(mln, func(conn *proto.Conn) { ManagerHandler(host, conn) })
+
+	Serve(ln, func(conn *proto.Conn) { PeerHandler(host, conn) })
+}
+
+func Serve(ln *proto.Listener, handle func(*proto.Conn)) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -55,38 +110,51 @@ func main() {
 
 		log.Printf("%s is connected\n", conn.RemoteAddr().String())
 
-		go Distribute(host, conn)
+		go handle(conn)
 	}
 }
 
-func Distribute(host *proto.Host, conn *proto.Conn) {
-	// If local connection, it's manager, else it's another peer
-	if strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1") {
-		ManagerHandler(host, conn)
-	} else {
-		PeerHandler(host, conn)
+func ManagerHandler(host *proto.Host, conn *proto.Conn) {
+	err := host.CheckManager(conn)
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
 	}
-}
 
-func ManagerHandler(host *proto.Host, conn *proto.Conn) {
 	manager := &proto.Manager{
 		Conn:     conn,
 		Commands: proto.ManagerCommands,
 	}
-	go SendToManager(host, manager)
+	sub := host.Events.Subscribe()
+	go SendToManager(sub, manager)
 
 	manager.Commands.CommandLoop(manager.Conn, func(handler interface{}, arg []byte) error {
 		h := handler.(proto.ManagerHandler)
 		return h(host, manager, arg)
 	})
+	sub.Close()
+	conn.Close()
 }
 
-func SendToManager(host *proto.Host, manager *proto.Manager) {
+func SendToManager(sub *proto.Subscription, manager *proto.Manager) {
 	for {
-		msg := <-host.Msg
-		err := manager.SendMessage([]byte(msg))
+		var err error
+		select {
+		case msg, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			err = manager.SendMessage([]byte(msg))
+		case progress, ok := <-sub.Progress:
+			if !ok {
+				return
+			}
+			err = manager.SendProgress(progress)
+		}
 		if err != nil {
 			log.Println(err)
+			sub.Close()
 			return
 		}
 	}
@@ -96,18 +164,27 @@ func PeerHandler(host *proto.Host, conn *proto.Conn) {
 	peer, err := host.AcceptPeer(conn)
 	if err != nil {
 		log.Println(err)
+		conn.Close()
 		return
 	}
 
-	host.Commands.CommandLoop(peer, func(handler interface{}, arg []byte) error {
-		h := handler.(proto.PeerHandler)
-		return h(host, peer, arg)
-	})
+	host.RunSession(peer)
 }
 
-func Exit(host *proto.Host) {
+func historyPath(config *Config) string {
+	if !config.History {
+		return ""
+	}
+	return historyFile
+}
+
+func Exit(host *proto.Host, savers []*proto.Saver) {
 	host.Disconnect()
-	SavePeers(host.Peers)
+	for _, saver := range savers {
+		if err := saver.Flush(); err != nil {
+			log.Println(err)
+		}
+	}
 	log.Println("Exit")
 	os.Exit(0)
 }
@@ -0,0 +1,210 @@
+package proto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+
+AEAD record format:
+
+version (1 byte) | suite (1 byte) | counter (4 bytes, LE) | command (4 bytes) | ciphertext | tag
+
+nonce is counter xored with per direction iv, header is associated data.
+Command header of the package is sent in header, so it's authenticated
+together with the record version, suite and counter, the rest of the package
+is encrypted.
+
+*/
+
+const (
+	RecordVersion    = 2
+	recordHeaderSize = 6 + CommandLength
+)
+
+const (
+	SuiteCTRHMAC uint8 = iota
+	SuiteAESGCM
+	SuiteChaCha20Poly1305
+	SuiteRatchet
+)
+
+var DefaultSuites = []uint8{SuiteRatchet, SuiteAESGCM, SuiteChaCha20Poly1305}
+
+var (
+	ErrRecordVersion = errors.New("wrong record version")
+	ErrRecordSuite   = errors.New("wrong record cipher suite")
+	ErrUnknownSuite  = errors.New("unknown cipher suite")
+)
+
+type AEADState struct {
+	Suite      uint8
+	SendAEAD   cipher.AEAD
+	RecAEAD    cipher.AEAD
+	SendIV     []byte
+	RecIV      []byte
+	MsgSendCtr uint32
+	MsgRecCtr  uint32
+	Window     *ReplayWindow
+}
+
+var suiteNames = map[string]uint8{
+	"aes-256-hmac":      SuiteCTRHMAC,
+	"aes-256-gcm":       SuiteAESGCM,
+	"chacha20-poly1305": SuiteChaCha20Poly1305,
+	"double-ratchet":    SuiteRatchet,
+}
+
+func ParseSuite(name string) (uint8, error) {
+	suite, ok := suiteNames[name]
+	if !ok {
+		return 0, errors.New("unknown cipher suite " + name)
+	}
+	return suite, nil
+}
+
+// DeriveAEADState derives session keys from secret with HKDF-SHA256 using
+// the handshake transcript as salt.
+func DeriveAEADState(secret, transcript []byte, suite uint8, isUserA bool) (*AEADState, error) {
+	prk := hkdf.Extract(sha256.New, secret, transcript)
+	KeySend := hkdfExpand(prk, "Key from A to B")
+	KeyRec := hkdfExpand(prk, "Key from B to A")
+	IVSend := hkdfExpand(prk, "IV from A to B")
+	IVRec := hkdfExpand(prk, "IV from B to A")
+
+	if !isUserA {
+		KeySend, KeyRec = KeyRec, KeySend
+		IVSend, IVRec = IVRec, IVSend
+	}
+
+	return newAEADState(suite, KeySend, KeyRec, IVSend, IVRec)
+}
+
+func newAEADState(suite uint8, KeySend, KeyRec, IVSend, IVRec []byte) (*AEADState, error) {
+	var err error
+	cs := &AEADState{Suite: suite}
+
+	cs.SendAEAD, err = newAEAD(suite, KeySend)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.RecAEAD, err = newAEAD(suite, KeyRec)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.SendIV = IVSend[:cs.SendAEAD.NonceSize()]
+	cs.RecIV = IVRec[:cs.RecAEAD.NonceSize()]
+	return cs, nil
+}
+
+func (cs *AEADState) AuthAndEncrypt(data []byte) ([]byte, error) {
+	if cs.MsgSendCtr == MaxMessagesCount {
+		return nil, ErrCounterOverflow
+	}
+	if len(data) < CommandLength {
+		return nil, ErrShortCommand
+	}
+	cs.MsgSendCtr++
+
+	header := cs.recordHeader(cs.MsgSendCtr, data[:CommandLength])
+	nonce := recordNonce(cs.SendIV, cs.MsgSendCtr)
+	return cs.SendAEAD.Seal(header, nonce, data[CommandLength:], header), nil
+}
+
+func (cs *AEADState) DecryptAndAuth(data []byte) ([]byte, error) {
+	if cs.MsgRecCtr == MaxMessagesCount {
+		return nil, ErrCounterOverflow
+	}
+
+	if len(data) < recordHeaderSize+cs.RecAEAD.Overhead() {
+		return nil, ErrShortMessage
+	}
+
+	header := data[:recordHeaderSize]
+	if header[0] != RecordVersion {
+		return nil, ErrRecordVersion
+	}
+	if header[1] != cs.Suite {
+		return nil, ErrRecordSuite
+	}
+
+	counter := binary.LittleEndian.Uint32(header[2:])
+	if cs.Window != nil {
+		err := cs.Window.Check(counter)
+		if err != nil {
+			return nil, err
+		}
+	} else if counter <= cs.MsgRecCtr {
+		return nil, ErrLowCounter
+	}
+
+	nonce := recordNonce(cs.RecIV, counter)
+	plainText, err := cs.RecAEAD.Open(append([]byte{}, header[6:]...), nonce, data[recordHeaderSize:], header)
+	if err != nil {
+		return nil, ErrAuth
+	}
+
+	if cs.Window != nil {
+		cs.Window.Update(counter)
+	}
+	if counter > cs.MsgRecCtr {
+		cs.MsgRecCtr = counter
+	}
+
+	return plainText, nil
+}
+
+// SetReplayWindow allows reordered messages within the window of size
+// counters, which is needed over lossy transports. Zero size restores strictly
+// increasing counters.
+func (cs *AEADState) SetReplayWindow(size uint32) {
+	if size == 0 {
+		cs.Window = nil
+		return
+	}
+	cs.Window = CreateReplayWindow(size)
+}
+
+func (cs *AEADState) recordHeader(counter uint32, cmd []byte) []byte {
+	header := make([]byte, recordHeaderSize, recordHeaderSize+cs.SendAEAD.Overhead())
+	header[0] = RecordVersion
+	header[1] = cs.Suite
+	binary.LittleEndian.PutUint32(header[2:], counter)
+	copy(header[6:], cmd)
+	return header
+}
+
+func recordNonce(iv []byte, counter uint32) []byte {
+	nonce := make([]byte, len(iv))
+	copy(nonce, iv)
+
+	ctr := make([]byte, 4)
+	binary.BigEndian.PutUint32(ctr, counter)
+	for i := range ctr {
+		nonce[len(nonce)-4+i] ^= ctr[i]
+	}
+	return nonce
+}
+
+func newAEAD(suite uint8, key []byte) (cipher.AEAD, error) {
+	switch suite {
+	case SuiteAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case SuiteChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, ErrUnknownSuite
+}
@@ -0,0 +1,77 @@
+package proto
+
+import (
+	"testing"
+)
+
+func TestCryptoStateCrossSuite(t *testing.T) {
+	gcm, _ := DeriveAEADState(testSecret, testTranscript, SuiteAESGCM, true)
+	chacha, _ := DeriveAEADState(testSecret, testTranscript, SuiteChaCha20Poly1305, false)
+	ctrA := DeriveCryptoState(testSecret, testTranscript, true)
+	ctrB := DeriveCryptoState(testSecret, testTranscript, false)
+
+	enc, _ := gcm.AuthAndEncrypt([]byte("SENDhello"))
+	if _, err := chacha.DecryptAndAuth(enc); err != ErrRecordSuite {
+		t.Fatalf("expected %v, got %v", ErrRecordSuite, err)
+	}
+	if _, err := ctrB.DecryptAndAuth(enc); err == nil {
+		t.Fatal("aes-256-hmac accepted aes-256-gcm record")
+	}
+
+	// Legacy record isn't taken for AEAD one
+	gcmB, _ := DeriveAEADState(testSecret, testTranscript, SuiteAESGCM, false)
+	enc, _ = ctrA.AuthAndEncrypt([]byte("SENDhello"))
+	if _, err := gcmB.DecryptAndAuth(enc); err == nil {
+		t.Fatal("aes-256-gcm accepted aes-256-hmac record")
+	}
+}
+
+func TestAEADCommandHeader(t *testing.T) {
+	for _, suite := range []uint8{SuiteAESGCM, SuiteChaCha20Poly1305} {
+		a, _ := DeriveAEADState(testSecret, testTranscript, suite, true)
+		b, _ := DeriveAEADState(testSecret, testTranscript, suite, false)
+
+		enc, err := a.AuthAndEncrypt(packCommand(send, []byte("hello")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(enc[recordHeaderSize-CommandLength:recordHeaderSize]) != "SEND" {
+			t.Fatalf("command isn't in record header: %x", enc[:recordHeaderSize])
+		}
+
+		// Command header is authenticated
+		forged := append([]byte{}, enc...)
+		copy(forged[recordHeaderSize-CommandLength:], "DISC")
+		if _, err := b.DecryptAndAuth(forged); err != ErrAuth {
+			t.Fatalf("expected %v, got %v", ErrAuth, err)
+		}
+		plain, err := b.DecryptAndAuth(enc)
+		if err != nil || string(plain) != "SENDhello" {
+			t.Fatalf("wrong package %q: %v", plain, err)
+		}
+
+		if _, err := a.AuthAndEncrypt([]byte("abc")); err != ErrShortCommand {
+			t.Fatalf("expected %v, got %v", ErrShortCommand, err)
+		}
+	}
+}
+
+func TestChooseSuite(t *testing.T) {
+	tests := []struct {
+		own, offered []uint8
+		expected     uint8
+		err          error
+	}{
+		{DefaultSuites, DefaultSuites, SuiteRatchet, nil},
+		{[]uint8{SuiteChaCha20Poly1305, SuiteAESGCM}, DefaultSuites, SuiteAESGCM, nil},
+		{DefaultSuites, []uint8{SuiteChaCha20Poly1305, SuiteRatchet}, SuiteChaCha20Poly1305, nil},
+		{[]uint8{SuiteCTRHMAC}, DefaultSuites, 0, ErrSuite},
+	}
+	for _, test := range tests {
+		suite, err := chooseSuite(test.own, test.offered)
+		if suite != test.expected || err != test.err {
+			t.Fatalf("own %v, offered %v: expected %d %v, got %d %v",
+				test.own, test.offered, test.expected, test.err, suite, err)
+		}
+	}
+}
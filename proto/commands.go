@@ -27,6 +27,52 @@ var (
 	disc = Command{'D', 'I', 'S', 'C'}
 	reer = Command{'R', 'E', 'E', 'R'}
 	quit = Command{'Q', 'U', 'I', 'T'}
+	keys = Command{'K', 'E', 'Y', 'S'}
+	kver = Command{'K', 'V', 'E', 'R'}
+	kpin = Command{'K', 'P', 'I', 'N'}
+	reke = Command{'R', 'E', 'K', 'E'}
+	vrfy = Command{'V', 'R', 'F', 'Y'}
+	revr = Command{'R', 'E', 'V', 'R'}
+	rkey = Command{'R', 'K', 'E', 'Y'}
+	rerk = Command{'R', 'E', 'R', 'K'}
+	rkok = Command{'R', 'K', 'O', 'K'}
+	auth = Command{'A', 'U', 'T', 'H'}
+	reau = Command{'R', 'E', 'A', 'U'}
+	sess = Command{'S', 'E', 'S', 'S'}
+	ress = Command{'R', 'E', 'S', 'S'}
+	gnew = Command{'G', 'N', 'E', 'W'}
+	ginv = Command{'G', 'I', 'N', 'V'}
+	glea = Command{'G', 'L', 'E', 'A'}
+	gmsg = Command{'G', 'M', 'S', 'G'}
+	gsnd = Command{'G', 'S', 'N', 'D'}
+	grps = Command{'G', 'R', 'P', 'S'}
+	gacc = Command{'G', 'A', 'C', 'C'}
+	grej = Command{'G', 'R', 'E', 'J'}
+	regr = Command{'R', 'E', 'G', 'R'}
+	mesg = Command{'M', 'E', 'S', 'G'}
+	ackn = Command{'A', 'C', 'K', 'N'}
+	read = Command{'R', 'E', 'A', 'D'}
+	resd = Command{'R', 'E', 'S', 'D'}
+	outb = Command{'O', 'U', 'T', 'B'}
+	ocan = Command{'O', 'C', 'A', 'N'}
+	reob = Command{'R', 'E', 'O', 'B'}
+	rlay = Command{'R', 'L', 'A', 'Y'}
+	rsnd = Command{'R', 'S', 'N', 'D'}
+	fofr = Command{'F', 'O', 'F', 'R'}
+	fchk = Command{'F', 'C', 'H', 'K'}
+	fdat = Command{'F', 'D', 'A', 'T'}
+	fack = Command{'F', 'A', 'C', 'K'}
+	fend = Command{'F', 'E', 'N', 'D'}
+	facc = Command{'F', 'A', 'C', 'C'}
+	frej = Command{'F', 'R', 'E', 'J'}
+	fcan = Command{'F', 'C', 'A', 'N'}
+	retr = Command{'R', 'E', 'T', 'R'}
+	prog = Command{'P', 'R', 'O', 'G'}
+	trns = Command{'T', 'R', 'N', 'S'}
+	tpau = Command{'T', 'P', 'A', 'U'}
+	trsm = Command{'T', 'R', 'S', 'M'}
+	tcan = Command{'T', 'C', 'A', 'N'}
+	strm = Command{'S', 'T', 'R', 'M'}
 
 	ErrShortCommand = errors.New("command is too short")
 )
@@ -79,6 +125,9 @@ func (parser *CommandParser) CommandLoop(rw PackageReadWriter, execute func(inte
 		}
 
 		err = execute(handler, arg)
+		if err == ErrPeerClosed {
+			return
+		}
 		if err != nil {
 			log.Println(err)
 			sendCommand(rw, reer, []byte(err.Error()))
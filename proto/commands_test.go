@@ -0,0 +1,67 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGetHandler(t *testing.T) {
+	handler, arg, err := PeerCommands.GetHandler([]byte("SENDhello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := handler.(PeerHandler); !ok {
+		t.Fatalf("expected PeerHandler, got %T", handler)
+	}
+	if string(arg) != "hello" {
+		t.Fatalf("expected hello, got %q", arg)
+	}
+
+	if _, _, err := PeerCommands.GetHandler([]byte("SEN")); err != ErrShortCommand {
+		t.Fatalf("expected %v, got %v", ErrShortCommand, err)
+	}
+	if _, _, err := PeerCommands.GetHandler([]byte("NONE")); err == nil {
+		t.Fatal("unknown command accepted")
+	}
+}
+
+func TestAddCommandWrongType(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	peerCommands().AddCommand(quit, ManagerHandler(managerQuitHandler))
+}
+
+func FuzzGetHandler(f *testing.F) {
+	for _, cmd := range []Command{info, list, send, file, seek, refo, reli, rese, conn, disc, quit, keys, vrfy, rkey} {
+		f.Add(packCommand(cmd, []byte("data")))
+	}
+	f.Add([]byte{})
+	f.Add([]byte("SEN"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, parser := range []*CommandParser{PeerCommands, ManagerCommands} {
+			handler, arg, err := parser.GetHandler(data)
+			if len(data) < CommandLength {
+				if err != ErrShortCommand {
+					t.Fatalf("expected %v, got %v", ErrShortCommand, err)
+				}
+				continue
+			}
+			if err != nil {
+				if handler != nil {
+					t.Fatal("handler returned with error")
+				}
+				continue
+			}
+			if !parser.typeChecker(handler) {
+				t.Fatalf("wrong handler type %T", handler)
+			}
+			if !bytes.Equal(arg, data[CommandLength:]) {
+				t.Fatal("wrong command argument")
+			}
+		}
+	})
+}
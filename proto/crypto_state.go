@@ -9,11 +9,15 @@ import (
 	"encoding/binary"
 	"errors"
 	"hash"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 const (
-	ProtocolVersion  = 1
-	MaxMessagesCount = 0xffffffff
+	ProtocolVersion       = 2
+	LegacyProtocolVersion = 1
+	MaxMessagesCount      = 0xffffffff
 )
 
 var (
@@ -24,7 +28,14 @@ var (
 	ErrIVGen           = errors.New("failed to generate initialization vector")
 )
 
-type CryptoState struct {
+type CryptoState interface {
+	AuthAndEncrypt([]byte) ([]byte, error)
+	DecryptAndAuth([]byte) ([]byte, error)
+}
+
+// CTRState is the legacy record format: MAC-then-encrypt with HMAC-SHA256 and
+// AES-CTR.
+type CTRState struct {
 	SendEnc    cipher.Block
 	RecEnc     cipher.Block
 	SendAuth   hash.Hash
@@ -33,9 +44,7 @@ type CryptoState struct {
 	MsgRecCtr  uint32
 }
 
-func InitCryptoState(key []byte, isUserA bool) *CryptoState {
-	cs := &CryptoState{}
-
+func InitCryptoState(key []byte, isUserA bool) *CTRState {
 	KeySendEnc := sha256d(append(key, []byte("Enc from A to B")...))
 	KeyRecEnc := sha256d(append(key, []byte("Enc from B to A")...))
 	KeySendAuth := sha256d(append(key, []byte("Auth from A to B")...))
@@ -46,6 +55,28 @@ func InitCryptoState(key []byte, isUserA bool) *CryptoState {
 		KeySendAuth, KeyRecAuth = KeyRecAuth, KeySendAuth
 	}
 
+	return newCryptoState(KeySendEnc, KeyRecEnc, KeySendAuth, KeyRecAuth)
+}
+
+// DeriveCryptoState derives session keys from secret with HKDF-SHA256 using
+// the handshake transcript as salt.
+func DeriveCryptoState(secret, transcript []byte, isUserA bool) *CTRState {
+	prk := hkdf.Extract(sha256.New, secret, transcript)
+	KeySendEnc := hkdfExpand(prk, "Enc from A to B")
+	KeyRecEnc := hkdfExpand(prk, "Enc from B to A")
+	KeySendAuth := hkdfExpand(prk, "Auth from A to B")
+	KeyRecAuth := hkdfExpand(prk, "Auth from B to A")
+
+	if !isUserA {
+		KeySendEnc, KeyRecEnc = KeyRecEnc, KeySendEnc
+		KeySendAuth, KeyRecAuth = KeyRecAuth, KeySendAuth
+	}
+
+	return newCryptoState(KeySendEnc, KeyRecEnc, KeySendAuth, KeyRecAuth)
+}
+
+func newCryptoState(KeySendEnc, KeyRecEnc, KeySendAuth, KeyRecAuth []byte) *CTRState {
+	cs := &CTRState{}
 	cs.SendEnc, _ = aes.NewCipher(KeySendEnc)
 	cs.RecEnc, _ = aes.NewCipher(KeyRecEnc)
 	cs.SendAuth = hmac.New(sha256.New, KeySendAuth)
@@ -56,7 +87,7 @@ func InitCryptoState(key []byte, isUserA bool) *CryptoState {
 	return cs
 }
 
-func (cs *CryptoState) AuthAndEncrypt(data []byte) ([]byte, error) {
+func (cs *CTRState) AuthAndEncrypt(data []byte) ([]byte, error) {
 	if cs.MsgSendCtr == MaxMessagesCount {
 		return nil, ErrCounterOverflow
 	}
@@ -77,7 +108,7 @@ func (cs *CryptoState) AuthAndEncrypt(data []byte) ([]byte, error) {
 	return cipherText, nil
 }
 
-func (cs *CryptoState) DecryptAndAuth(data []byte) ([]byte, error) {
+func (cs *CTRState) DecryptAndAuth(data []byte) ([]byte, error) {
 	if cs.MsgRecCtr == MaxMessagesCount {
 		return nil, ErrCounterOverflow
 	}
@@ -96,7 +127,8 @@ func (cs *CryptoState) DecryptAndAuth(data []byte) ([]byte, error) {
 	decr := make([]byte, len(data))
 	ctr.XORKeyStream(decr, data)
 
-	plainText := decr[:len(decr)-hashSize]
+	// Capacity is limited, so Sum can't overwrite received MAC
+	plainText := decr[: len(decr)-hashSize : len(decr)-hashSize]
 	hash := cs.RecAuthMessage(plainText)
 	if !hmac.Equal(hash, decr) {
 		return nil, ErrAuth
@@ -110,14 +142,14 @@ func (cs *CryptoState) DecryptAndAuth(data []byte) ([]byte, error) {
 	return plainText, nil
 }
 
-func (cs *CryptoState) SendAuthMessage(data []byte) []byte {
+func (cs *CTRState) SendAuthMessage(data []byte) []byte {
 	metadata := getMetadata()
 	cs.SendAuth.Write(metadata)
 	cs.SendAuth.Write(data)
 	return cs.SendAuth.Sum(data)
 }
 
-func (cs *CryptoState) RecAuthMessage(data []byte) []byte {
+func (cs *CTRState) RecAuthMessage(data []byte) []byte {
 	metadata := getMetadata()
 	cs.RecAuth.Write(metadata)
 	cs.RecAuth.Write(data)
@@ -126,10 +158,16 @@ func (cs *CryptoState) RecAuthMessage(data []byte) []byte {
 
 func getMetadata() []byte {
 	metadata := make([]byte, 4)
-	binary.LittleEndian.PutUint32(metadata, ProtocolVersion)
+	binary.LittleEndian.PutUint32(metadata, LegacyProtocolVersion)
 	return metadata
 }
 
+func hkdfExpand(prk []byte, label string) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(label)), key)
+	return key
+}
+
 func sha256d(data []byte) []byte {
 	result := sha256.Sum256(data)
 	result = sha256.Sum256(result[:])
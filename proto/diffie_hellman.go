@@ -1,16 +1,34 @@
 package proto
 
 import (
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"math/big"
 )
 
+const (
+	activeRole  = "sechan active halfkey"
+	passiveRole = "sechan passive halfkey"
+)
+
 type DHState struct {
 	G, Q, P *big.Int
 }
 
+type Exchange struct {
+	Version    uint32
+	Suite      uint8
+	Key        []byte
+	PeerKey    ed25519.PublicKey
+	Transcript []byte
+
+	ephemeral     *ecdh.PrivateKey
+	peerEphemeral []byte
+}
+
 var (
 	ErrParseDHState = errors.New("failed to parse second user's diffie-hellman state")
 	ErrParseHalfKey = errors.New("failed to parse second user's halfkey")
@@ -44,7 +62,7 @@ func InitDHState() (*DHState, error) {
 	}, nil
 }
 
-func (dh *DHState) ActiveDHExchange(conn *Conn) ([]byte, error) {
+func (dh *DHState) ActiveDHExchange(conn *Conn, id *Identity) (*Exchange, error) {
 	// Send dhstate
 	buf, _ := json.Marshal(dh)
 	_, err := conn.WritePackage(buf)
@@ -52,10 +70,27 @@ func (dh *DHState) ActiveDHExchange(conn *Conn) ([]byte, error) {
 		return nil, errExchangeIO(err)
 	}
 
+	X, transcript, err := dh.sendHalfkey(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Recieve halfkeyY
+	buf, err = conn.ReadPackage()
+	if err != nil {
+		return nil, errExchangeIO(err)
+	}
+
+	return dh.finishActiveDHExchange(conn, id, X, transcript, buf)
+}
+
+// sendHalfkey generates X and sends halfkeyX = g^X (modp). Returns X and the
+// transcript extended with halfkeyX.
+func (dh *DHState) sendHalfkey(conn *Conn, transcript []byte) (*big.Int, []byte, error) {
 	// Generate X. halfkeyX = g^X (modp)
 	X, err := rand.Int(rand.Reader, dh.Q)
 	if err != nil {
-		return nil, errExchangeIO(err)
+		return nil, nil, errExchangeIO(err)
 	}
 
 	halfkeyX := big.NewInt(0)
@@ -63,44 +98,65 @@ func (dh *DHState) ActiveDHExchange(conn *Conn) ([]byte, error) {
 	halfkeyX.Exp(dh.G, X, dh.P)
 
 	// Send halfkeyX
-	buf, _ = halfkeyX.MarshalText()
+	buf, _ := halfkeyX.MarshalText()
 	_, err = conn.WritePackage(buf)
 	if err != nil {
-		return nil, errExchangeIO(err)
+		return nil, nil, errExchangeIO(err)
 	}
+	return X, append(transcript, buf...), nil
+}
 
-	// Recieve halfkeyY
-	buf, err = conn.ReadPackage()
-	if err != nil {
-		return nil, errExchangeIO(err)
-	}
+func (dh *DHState) finishActiveDHExchange(conn *Conn, id *Identity, X *big.Int, transcript, buf []byte) (*Exchange, error) {
 	halfkeyY := big.NewInt(0)
-	err = halfkeyY.UnmarshalText(buf)
+	err := halfkeyY.UnmarshalText(buf)
 	if err != nil {
 		return nil, ErrParseHalfKey
 	}
+	transcript = append(transcript, buf...)
 
 	// Check halfkeyY
 	if !dh.CheckHalfkey(halfkeyY) {
 		return nil, ErrWeakHalfkey
 	}
 
+	// Recieve and check signature of second user
+	peerKey, err := recvHalfkeyAuth(conn, passiveRole, transcript)
+	if err != nil {
+		return nil, err
+	}
+
+	// Send own signature
+	err = sendHalfkeyAuth(conn, id, activeRole, transcript)
+	if err != nil {
+		return nil, err
+	}
+
 	// Calculate key. key = g^XY (modp)
 	halfkeyY.Exp(halfkeyY, X, dh.P)
-	return halfkeyY.Bytes(), nil
+	return &Exchange{
+		Version:    LegacyProtocolVersion,
+		Key:        halfkeyY.Bytes(),
+		PeerKey:    peerKey,
+		Transcript: transcript,
+	}, nil
 }
 
-func (dh *DHState) PassiveDHExchange(conn *Conn) ([]byte, error) {
+func (dh *DHState) PassiveDHExchange(conn *Conn, id *Identity) (*Exchange, error) {
 	// Recieve DHState
 	buf, err := conn.ReadPackage()
 	if err != nil {
 		return nil, errExchangeIO(err)
 	}
 
-	err = json.Unmarshal(buf, dh)
+	return dh.passiveDHExchange(conn, id, buf)
+}
+
+func (dh *DHState) passiveDHExchange(conn *Conn, id *Identity, buf []byte) (*Exchange, error) {
+	err := json.Unmarshal(buf, dh)
 	if err != nil {
 		return nil, ErrParseDHState
 	}
+	transcript := buf
 
 	// Check DHState
 	err = dh.CheckDHState()
@@ -118,6 +174,7 @@ func (dh *DHState) PassiveDHExchange(conn *Conn) ([]byte, error) {
 	if err != nil {
 		return nil, ErrParseHalfKey
 	}
+	transcript = append(transcript, buf...)
 
 	// Check halfkeyX
 	if !dh.CheckHalfkey(halfkeyX) {
@@ -139,13 +196,35 @@ func (dh *DHState) PassiveDHExchange(conn *Conn) ([]byte, error) {
 	if err != nil {
 		return nil, errExchangeIO(err)
 	}
+	transcript = append(transcript, buf...)
+
+	// Send own signature
+	err = sendHalfkeyAuth(conn, id, passiveRole, transcript)
+	if err != nil {
+		return nil, err
+	}
+
+	// Recieve and check signature of second user
+	peerKey, err := recvHalfkeyAuth(conn, activeRole, transcript)
+	if err != nil {
+		return nil, err
+	}
 
 	// Generate key. key = g^XY (modp)
 	halfkeyX.Exp(halfkeyX, Y, dh.P)
-	return halfkeyX.Bytes(), nil
+	return &Exchange{
+		Version:    LegacyProtocolVersion,
+		Key:        halfkeyX.Bytes(),
+		PeerKey:    peerKey,
+		Transcript: transcript,
+	}, nil
 }
 
 func (dh *DHState) CheckDHState() error {
+	if dh.G == nil || dh.Q == nil || dh.P == nil {
+		return ErrParseDHState
+	}
+
 	if dh.Q.BitLen() < 256 {
 		return ErrShortQ
 	}
@@ -170,6 +249,33 @@ func (dh *DHState) CheckHalfkey(halfkey *big.Int) bool {
 	return (test.Cmp(big.NewInt(1)) == 0)
 }
 
+func sendHalfkeyAuth(conn *Conn, id *Identity, role string, transcript []byte) error {
+	buf, _ := json.Marshal(id.SignHalfkey(role, transcript))
+	_, err := conn.WritePackage(buf)
+	if err != nil {
+		return errExchangeIO(err)
+	}
+	return nil
+}
+
+func recvHalfkeyAuth(conn *Conn, role string, transcript []byte) (ed25519.PublicKey, error) {
+	buf, err := conn.ReadPackage()
+	if err != nil {
+		return nil, errExchangeIO(err)
+	}
+
+	auth := &HalfkeyAuth{}
+	err = json.Unmarshal(buf, auth)
+	if err != nil {
+		return nil, ErrParseAuth
+	}
+
+	if !auth.Verify(role, transcript) {
+		return nil, ErrAuthHalfkey
+	}
+	return auth.Key, nil
+}
+
 func genNP(q *big.Int) (*big.Int, *big.Int, error) {
 	var N, p *big.Int
 	var err error
@@ -183,6 +289,10 @@ func genNP(q *big.Int) (*big.Int, *big.Int, error) {
 
 		p.Mul(N, q)
 		p.Add(p, big.NewInt(1))
+		// Product of 1792 and 256 bits numbers may be 2047 bits long
+		if p.BitLen() < 2048 {
+			continue
+		}
 		if p.ProbablyPrime(64) {
 			return N, p, nil
 		}
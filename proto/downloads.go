@@ -0,0 +1,290 @@
+package proto
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Names are shorter than 255 bytes limit of file systems to leave room for
+// collision suffixes
+const maxNameLength = 240
+
+// FileLimits bounds files received from peers. Zero quota disables limit.
+type FileLimits struct {
+	PeerQuota   int64
+	GlobalQuota int64
+	// Fingerprints of peers whose files are accepted without asking
+	AutoAccept []string
+}
+
+var DefaultFileLimits = FileLimits{
+	PeerQuota:   1 << 30,
+	GlobalQuota: 4 << 30,
+}
+
+var (
+	ErrFileRejected = errors.New("file is rejected")
+	ErrFileQuota    = errors.New("file exceeds download quota")
+	ErrUnsafePath   = errors.New("path leaves download directory")
+)
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// AcceptFile starts receiving of file id offered in session if it fits in
+// quotas.
+func (host *Host) AcceptFile(session, id string) error {
+	key := transferKey(session, id)
+	in, ok := host.transfers.pending(key)
+	if !ok {
+		return ErrUnknownTransfer
+	}
+
+	dir := filepath.Dir(in.part)
+	peerUsed, globalUsed := dirSize(dir), downloadsSize(host.downloads())
+
+	host.transfers.mutex.Lock()
+	if in.accepted || host.transfers.incoming[key] != in {
+		host.transfers.mutex.Unlock()
+		return ErrUnknownTransfer
+	}
+	for _, other := range host.transfers.incoming {
+		if !other.accepted {
+			continue
+		}
+		left := other.offer.Size - other.offset
+		globalUsed += left
+		if filepath.Dir(other.part) == dir {
+			peerUsed += left
+		}
+	}
+	left := in.offer.Size - in.offset
+	err := checkQuota(peerUsed+left, host.Files.PeerQuota)
+	if err == nil {
+		err = checkQuota(globalUsed+left, host.Files.GlobalQuota)
+	}
+	if err == nil {
+		in.accepted = true
+	} else {
+		delete(host.transfers.incoming, key)
+	}
+	status := fileStatus{Id: id, Offset: in.offset}
+	host.transfers.mutex.Unlock()
+
+	if err != nil {
+		status.Error = err.Error()
+	}
+	js, _ := json.Marshal(status)
+	sendErr := sendCommand(in.peer, fack, js)
+	if err != nil {
+		return err
+	}
+	// Chunks change offset since FACK is sent
+	if sendErr != nil || status.Offset < in.offer.Size {
+		return sendErr
+	}
+	return host.receivedFile(in)
+}
+
+// RejectFile refuses file id offered in session or stops receiving it.
+func (host *Host) RejectFile(session, id string) error {
+	key := transferKey(session, id)
+
+	host.transfers.mutex.Lock()
+	in, ok := host.transfers.incoming[key]
+	delete(host.transfers.incoming, key)
+	status := fileStatus{Id: id, Error: ErrFileRejected.Error()}
+	if ok {
+		status.Offset = in.offset
+	}
+	host.transfers.mutex.Unlock()
+	if !ok {
+		return ErrUnknownTransfer
+	}
+
+	cmd := fack
+	if in.accepted {
+		cmd = fend
+		host.removePart(in)
+	}
+	js, _ := json.Marshal(status)
+	return sendCommand(in.peer, cmd, js)
+}
+
+// offerReceived accepts file from peers in allowlist and files resumed by
+// the same identity, the other offers are passed to managers.
+func (host *Host) offerReceived(in *incomingFile) error {
+	if in.offset > 0 || host.autoAccept(in.session) {
+		return host.AcceptFile(in.session, in.offer.Id)
+	}
+
+	js, _ := json.Marshal(in.offer)
+	msg, _ := json.Marshal(host.fileEvent("FileOffer", in, string(js)))
+	host.Events.Publish(string(msg))
+	return nil
+}
+
+func (host *Host) autoAccept(session string) bool {
+	known, ok := host.Peers.Get(session)
+	if !ok || known.Key == nil {
+		return false
+	}
+
+	fingerprint := Fingerprint(known.Key)
+	for _, allowed := range host.Files.AutoAccept {
+		if normalizeFingerprint(allowed) == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLegacyFile checks that FILE chunk of size from peer may be written to
+// dir. Legacy peers can't make offers, so only peers in allowlist are served.
+func (host *Host) checkLegacyFile(session, dir string, size int64) error {
+	if !host.autoAccept(session) {
+		return ErrFileRejected
+	}
+	err := checkQuota(dirSize(dir)+size, host.Files.PeerQuota)
+	if err != nil {
+		return err
+	}
+	return checkQuota(downloadsSize(host.downloads())+size, host.Files.GlobalQuota)
+}
+
+// peerDir opens directory for files of peer with identity key. Logins are
+// self-reported, so directories are named by fingerprints and peers can't
+// take partial files and quota of each other.
+func (host *Host) peerDir(key ed25519.PublicKey) (*downloadDir, error) {
+	if key == nil {
+		return nil, ErrFileRejected
+	}
+	return host.openDownloadDir(Fingerprint(key))
+}
+
+// removePart removes partial file of in.
+func (host *Host) removePart(in *incomingFile) {
+	dir, err := host.peerDir(in.peer.Key)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	dir.remove(filepath.Base(in.part))
+}
+
+func (host *Host) downloads() string {
+	if host.Downloads == "" {
+		return "."
+	}
+	return host.Downloads
+}
+
+func (t *transfers) pending(key string) (*incomingFile, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	in, ok := t.incoming[key]
+	return in, ok && !in.accepted
+}
+
+func checkQuota(size, quota int64) error {
+	if quota > 0 && size > quota {
+		return ErrFileQuota
+	}
+	return nil
+}
+
+// downloadsSize returns size of peer directories in download directory.
+func downloadsSize(root string) int64 {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+	for _, entry := range entries {
+		if entry.IsDir() {
+			size += dirSize(filepath.Join(root, entry.Name()))
+		}
+	}
+	return size
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// safeName returns the last element of name without control characters,
+// characters reserved by file systems and leading dots, so it can't leave
+// its directory, hide or clash with partial files. Unusable names are
+// replaced with fallback.
+func safeName(name, fallback string) string {
+	elems := strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' })
+	if len(elems) == 0 {
+		return fallback
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError || strings.ContainsRune(`:*?"<>|`, r) {
+			return -1
+		}
+		return r
+	}, elems[len(elems)-1])
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	name = truncateName(strings.TrimRight(name, ". "), maxNameLength)
+	if name == "" {
+		return fallback
+	}
+	if reservedNames[strings.ToUpper(strings.SplitN(name, ".", 2)[0])] {
+		name = truncateName("_"+name, maxNameLength)
+	}
+	return name
+}
+
+func truncateName(name string, length int) string {
+	for len(name) > length {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// linkUnique moves file src of dir to name. The name gets numeric suffix if
+// such file exists, existing files are never replaced.
+func linkUnique(dir *downloadDir, src, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 1; ; i++ {
+		err := dir.link(src, candidate)
+		if err == nil {
+			return filepath.Join(dir.path, candidate), dir.remove(src)
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
@@ -0,0 +1,52 @@
+//go:build !unix
+
+package proto
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// downloadDir is directory of peer in download directory. Without openat
+// paths are checked for symlinks right before they're used.
+type downloadDir struct {
+	path string
+}
+
+func (host *Host) openDownloadDir(name string) (*downloadDir, error) {
+	path := filepath.Join(host.downloads(), name)
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsDir() {
+		return nil, ErrUnsafePath
+	}
+	return &downloadDir{path: path}, nil
+}
+
+func (dir *downloadDir) open(name string, flag int, perm os.FileMode) (*os.File, error) {
+	path := filepath.Join(dir.path, name)
+	info, err := os.Lstat(path)
+	if err == nil && !info.Mode().IsRegular() {
+		return nil, ErrUnsafePath
+	}
+	return os.OpenFile(path, flag, perm)
+}
+
+func (dir *downloadDir) link(src, name string) error {
+	return os.Link(filepath.Join(dir.path, src), filepath.Join(dir.path, name))
+}
+
+func (dir *downloadDir) remove(name string) error {
+	return os.Remove(filepath.Join(dir.path, name))
+}
+
+func (dir *downloadDir) Close() error {
+	return nil
+}
@@ -0,0 +1,253 @@
+package proto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileOffers(t *testing.T) {
+	network := CreateMemoryNetwork()
+	a, b := testHost(t, "a", network.Transport("10.0.0.1")), testHost(t, "b", network.Transport("10.0.0.2"))
+	a.Downloads = t.TempDir()
+	subA := a.Events.Subscribe()
+	pa, pb := connectHosts(t, a, b, "10.0.0.1:7000")
+	defer pa.Close()
+	defer pb.Close()
+	waitFeature(t, pb, featureTransfer)
+
+	manager, _ := testManager(t)
+	run := func(cmd Command, data string) error {
+		handler, arg, err := manager.Commands.GetHandler(packCommand(cmd, []byte(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler.(ManagerHandler)(a, manager, arg)
+	}
+
+	src := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(src, []byte("offered data"), 0600)
+	send := func() <-chan error {
+		result := make(chan error, 1)
+		go func() { result <- b.SendFile(pb, src) }()
+		return result
+	}
+	wait := func(result <-chan error, expected error) {
+		t.Helper()
+		select {
+		case err := <-result:
+			if err != expected {
+				t.Fatalf("expected %v, got %v", expected, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("file transfer isn't finished")
+		}
+	}
+	expectOffer := func() *fileOffer {
+		t.Helper()
+		msg := expectEvent(t, subA, "FileOffer")
+		offer := &fileOffer{}
+		if err := json.Unmarshal([]byte(msg.Data), offer); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Peer != "10.0.0.2" || msg.Login != "b" || offer.Name != "file" || offer.Size != 12 {
+			t.Fatalf("wrong offer %+v %+v", msg, offer)
+		}
+		return offer
+	}
+
+	result := send()
+	offer := expectOffer()
+	if err := run(frej, "10.0.0.2 "+offer.Id); err != nil {
+		t.Fatal(err)
+	}
+	wait(result, ErrFileRejected)
+	if err := run(facc, "10.0.0.2 "+offer.Id); err != ErrUnknownTransfer {
+		t.Fatalf("expected %v, got %v", ErrUnknownTransfer, err)
+	}
+
+	result = send()
+	offer = expectOffer()
+	if err := run(facc, "10.0.0.2 "+offer.Id); err != nil {
+		t.Fatal(err)
+	}
+	wait(result, nil)
+	dir := filepath.Join(a.Downloads, Fingerprint(b.Identity.Public))
+	if got, _ := os.ReadFile(filepath.Join(dir, "file")); string(got) != "offered data" {
+		t.Fatalf("wrong file %q", got)
+	}
+
+	// Accepted file is counted in quota
+	a.Files.GlobalQuota = 20
+	result = send()
+	offer = expectOffer()
+	if err := run(facc, "10.0.0.2 "+offer.Id); err != ErrFileQuota {
+		t.Fatalf("expected %v, got %v", ErrFileQuota, err)
+	}
+	wait(result, ErrFileQuota)
+
+	// Legacy peers can send files only if they're allowed
+	js, _ := json.Marshal(File{Name: "legacy", Data: []byte("data")})
+	if err := peerFileHandler(a, pa, js); err != ErrFileRejected {
+		t.Fatalf("expected %v, got %v", ErrFileRejected, err)
+	}
+	a.Files.AutoAccept = []string{Fingerprint(b.Identity.Public)}
+	a.Files.GlobalQuota = 0
+	if err := peerFileHandler(a, pa, js); err != nil {
+		t.Fatal(err)
+	}
+	a.Files.PeerQuota = 18
+	if err := peerFileHandler(a, pa, js); err != ErrFileQuota {
+		t.Fatalf("expected %v, got %v", ErrFileQuota, err)
+	}
+}
+
+func TestSafeName(t *testing.T) {
+	long := strings.Repeat("ж", 200)
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{"/etc/shadow", "shadow"},
+		{`..\..\Windows\win.ini`, "win.ini"},
+		{"dir/", "dir"},
+		{"..", "file"},
+		{".", "file"},
+		{"", "file"},
+		{"/", "file"},
+		{"../", "file"},
+		{".bashrc", "bashrc"},
+		{"...", "file"},
+		{"name\x00.txt", "name.txt"},
+		{"new\nline", "newline"},
+		{"C:evil", "Cevil"},
+		{"a<b>|c?*\"", "abc"},
+		{"trailing. . ", "trailing"},
+		{"CON", "_CON"},
+		{"nul.txt", "_nul.txt"},
+		{"\xff\xfe.txt", "txt"},
+		{long, long[:maxNameLength]},
+	}
+	for _, test := range tests {
+		got := safeName(test.name, "file")
+		if got != test.expected {
+			t.Fatalf("%q: expected %q, got %q", test.name, test.expected, got)
+		}
+		if len(got) > maxNameLength || strings.ContainsAny(got, "/\\") {
+			t.Fatalf("%q: unsafe name %q", test.name, got)
+		}
+	}
+}
+
+func TestDownloadConfinement(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	host, peer := testPeer(t)
+	defer peer.Close()
+	host.Downloads = root
+	empty := sha256.Sum256(nil)
+
+	// Directories are named by identities, not by self-reported logins
+	peer.Key = testIdentity(t).Public
+	peer.Login = "../.."
+	peerDir := filepath.Join(root, Fingerprint(peer.Key))
+	dir, err := host.peerDir(peer.Key)
+	if err != nil || dir.path != peerDir {
+		t.Fatalf("wrong directory: %v", err)
+	}
+	dir.Close()
+	if _, err := host.peerDir(nil); err != ErrFileRejected {
+		t.Fatalf("expected %v, got %v", ErrFileRejected, err)
+	}
+
+	// Offered names stay in directory of peer
+	for _, name := range []string{"../../evil", "/etc/evil", `..\evil`, ".."} {
+		offer := &fileOffer{Id: strings.Repeat("ab", 32), Name: name, Hash: hex.EncodeToString(empty[:])}
+		in, err := host.offerFile(peer, offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved, err := host.finishFile(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(saved) != peerDir {
+			t.Fatalf("%q is saved to %q", name, saved)
+		}
+	}
+
+	// Symlinks planted in download directory aren't followed
+	linked := testIdentity(t).Public
+	os.Symlink(outside, filepath.Join(root, Fingerprint(linked)))
+	if _, err := host.peerDir(linked); err != ErrUnsafePath {
+		t.Fatalf("expected %v, got %v", ErrUnsafePath, err)
+	}
+	id := strings.Repeat("cd", 32)
+	os.Symlink(filepath.Join(outside, "target"), filepath.Join(peerDir, "."+id+transferPartSuffix))
+	if _, err := host.offerFile(peer, &fileOffer{Id: id, Name: "file", Size: 1}); err != ErrUnsafePath {
+		t.Fatalf("expected %v, got %v", ErrUnsafePath, err)
+	}
+	// Only regular files are taken for partial files
+	id = strings.Repeat("ef", 32)
+	os.Mkdir(filepath.Join(peerDir, "."+id+transferPartSuffix), 0700)
+	if _, err := host.offerFile(peer, &fileOffer{Id: id, Name: "file", Size: 1}); err != ErrUnsafePath {
+		t.Fatalf("expected %v, got %v", ErrUnsafePath, err)
+	}
+
+	os.Symlink(filepath.Join(outside, "legacy"), filepath.Join(peerDir, "legacy"))
+	host.Peers.Put(sessionID(peer), &Peer{Login: "peer", Key: peer.Key})
+	host.Files.AutoAccept = []string{Fingerprint(peer.Key)}
+	js, _ := json.Marshal(File{Name: "../legacy", Data: []byte("data")})
+	if err := peerFileHandler(host, peer, js); err != ErrUnsafePath {
+		t.Fatalf("expected %v, got %v", ErrUnsafePath, err)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Fatalf("files are written outside of download directory: %v", entries)
+	}
+}
+
+func TestPendingOffers(t *testing.T) {
+	host, peer := testPeer(t)
+	defer peer.Close()
+	host.Downloads = t.TempDir()
+	peer.Key = testIdentity(t).Public
+	sub := host.Events.Subscribe()
+
+	offer := func(i int) error {
+		_, err := host.offerFile(peer, &fileOffer{Id: strings.Repeat(fmt.Sprintf("%02x", i), 32), Name: "file", Size: 1})
+		return err
+	}
+	for i := 0; i < MaxPendingOffers; i++ {
+		if err := offer(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := offer(MaxPendingOffers); err != ErrTooManyOffers {
+		t.Fatalf("expected %v, got %v", ErrTooManyOffers, err)
+	}
+	// Repeated offer replaces the pending one
+	if err := offer(0); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := OfferTimeout
+	OfferTimeout = 10 * time.Millisecond
+	defer func() { OfferTimeout = timeout }()
+	host.transfers.mutex.Lock()
+	host.transfers.incoming = nil
+	host.transfers.mutex.Unlock()
+	if err := offer(0); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, sub, "FileCanceled")
+	if err := host.AcceptFile(sessionID(peer), strings.Repeat("00", 32)); err != ErrUnknownTransfer {
+		t.Fatalf("expected %v, got %v", ErrUnknownTransfer, err)
+	}
+}
@@ -0,0 +1,84 @@
+//go:build unix
+
+package proto
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// downloadDir is directory of peer opened relative to download directory.
+// Files are opened relative to it without following symlinks, so planted
+// links can't redirect them between check and use.
+type downloadDir struct {
+	fd   int
+	path string
+}
+
+func (host *Host) openDownloadDir(name string) (*downloadDir, error) {
+	err := os.MkdirAll(host.downloads(), 0700)
+	if err != nil {
+		return nil, err
+	}
+	root, err := unix.Open(host.downloads(), unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(root)
+
+	err = unix.Mkdirat(root, name, 0700)
+	if err != nil && err != unix.EEXIST {
+		return nil, err
+	}
+	fd, err := unix.Openat(root, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, unsafePathError(err)
+	}
+	return &downloadDir{fd: fd, path: filepath.Join(host.downloads(), name)}, nil
+}
+
+// open opens regular file name of directory. Special files are opened
+// without blocking to be refused.
+func (dir *downloadDir) open(name string, flag int, perm os.FileMode) (*os.File, error) {
+	flag |= unix.O_NOFOLLOW | unix.O_NONBLOCK | unix.O_CLOEXEC
+	fd, err := unix.Openat(dir.fd, name, flag, uint32(perm.Perm()))
+	if err != nil {
+		return nil, unsafePathError(err)
+	}
+
+	file := os.NewFile(uintptr(fd), filepath.Join(dir.path, name))
+	stat, err := file.Stat()
+	if err == nil && !stat.Mode().IsRegular() {
+		err = ErrUnsafePath
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (dir *downloadDir) link(src, name string) error {
+	err := unix.Linkat(dir.fd, src, dir.fd, name, 0)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: src, New: name, Err: err}
+	}
+	return nil
+}
+
+func (dir *downloadDir) remove(name string) error {
+	return unix.Unlinkat(dir.fd, name, 0)
+}
+
+func (dir *downloadDir) Close() error {
+	return unix.Close(dir.fd)
+}
+
+func unsafePathError(err error) error {
+	if err == unix.ELOOP || err == unix.EMLINK || err == unix.ENOTDIR {
+		return ErrUnsafePath
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package proto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	EnvelopeVersion    = 1
+	DefaultContentType = "text/plain"
+
+	// Peers which announce envelope feature in REFO get MESG instead of SEND
+	featureEnvelope = "envelope"
+
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// Envelope is the body of MESG command.
+type Envelope struct {
+	Version     uint8
+	Id          string
+	Time        time.Time
+	ContentType string `json:",omitempty"`
+	ReplyTo     string `json:",omitempty"`
+	Data        string
+}
+
+// Receipt is the body of ACKN command, it's sent back for every envelope.
+type Receipt struct {
+	Id     string
+	Status string
+	Time   time.Time
+}
+
+// peerInfo is the body of REFO command.
+type peerInfo struct {
+	Login     string
+	Addr      string
+	Features  []string `json:",omitempty"`
+	MaxPacket uint32   `json:",omitempty"`
+}
+
+var (
+	ErrEnvelopeVersion = errors.New("unsupported envelope version")
+	ErrEnvelopeId      = errors.New("envelope without id")
+	ErrNoFeatures      = errors.New("peer didn't announce its features")
+)
+
+// FeatureTimeout bounds waiting for REFO of peer before sending to it
+var FeatureTimeout = 10 * time.Second
+
+func CreateEnvelope(data, contentType, replyTo string) (*Envelope, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType == "" {
+		contentType = DefaultContentType
+	}
+	return &Envelope{
+		Version:     EnvelopeVersion,
+		Id:          hex.EncodeToString(buf),
+		Time:        time.Now().UTC(),
+		ContentType: contentType,
+		ReplyTo:     replyTo,
+		Data:        data,
+	}, nil
+}
+
+func (env *Envelope) check() error {
+	if env.Version == 0 || env.Version > EnvelopeVersion {
+		return ErrEnvelopeVersion
+	}
+	if env.Id == "" {
+		return ErrEnvelopeId
+	}
+	return nil
+}
+
+// message returns event for envelope.
+func (env *Envelope) message(kind string) Message {
+	sent := env.Time
+	return Message{
+		Type:        kind,
+		Id:          env.Id,
+		Sent:        &sent,
+		ContentType: env.ContentType,
+		ReplyTo:     env.ReplyTo,
+		Data:        env.Data,
+	}
+}
+
+// SendEnvelope sends envelope to peer, peers without envelope support get
+// its data with SEND. Features of peer are awaited up to FeatureTimeout.
+func (host *Host) SendEnvelope(peer *Peer, env *Envelope) error {
+	if !peer.waitFeatures(FeatureTimeout) {
+		return ErrNoFeatures
+	}
+	if !peer.HasFeature(featureEnvelope) {
+		return sendCommand(peer, send, []byte(env.Data))
+	}
+
+	js, _ := json.Marshal(env)
+	return sendCommand(peer, mesg, js)
+}
+
+// recordSent records envelope sent to peer id in history and returns its
+// event.
+func (host *Host) recordSent(id string, env *Envelope) Message {
+	sent := env.message("Sent")
+	sent.Peer = id
+	if known, ok := host.Peers.Get(id); ok {
+		sent.Login = known.Login
+		sent.Addr = known.Addr
+	}
+	host.Record(&sent)
+	return sent
+}
+
+func sendReceipt(peer *Peer, id, status string) error {
+	js, _ := json.Marshal(Receipt{
+		Id:     id,
+		Status: status,
+		Time:   time.Now().UTC(),
+	})
+	return sendCommand(peer, ackn, js)
+}
+
+func (p *Peer) HasFeature(feature string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return contains(p.features, feature)
+}
+
+func (p *Peer) setFeatures(features []string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.features = features
+	if p.negotiated == nil {
+		p.negotiated = make(chan struct{})
+	}
+	select {
+	case <-p.negotiated:
+	default:
+		close(p.negotiated)
+	}
+}
+
+// waitFeatures waits for REFO of peer and reports whether it arrived.
+func (p *Peer) waitFeatures(timeout time.Duration) bool {
+	p.mutex.Lock()
+	if p.negotiated == nil {
+		p.negotiated = make(chan struct{})
+	}
+	negotiated := p.negotiated
+	p.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-negotiated:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,114 @@
+package proto
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// waitFeature waits for REFO with feature from peer.
+func waitFeature(t *testing.T, peer *Peer, feature string) {
+	t.Helper()
+	for i := 0; !peer.HasFeature(feature); i++ {
+		if i == 100 {
+			t.Fatalf("peer doesn't announce %s", feature)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEnvelopeCheck(t *testing.T) {
+	env, err := CreateEnvelope("text", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.ContentType != DefaultContentType || len(env.Id) != 32 || env.check() != nil {
+		t.Fatalf("wrong envelope %+v", env)
+	}
+	if other, _ := CreateEnvelope("text", "", ""); other.Id == env.Id {
+		t.Fatal("envelope ids repeat")
+	}
+
+	tests := []struct {
+		name string
+		env  Envelope
+		err  error
+	}{
+		{"legacy", Envelope{Id: "id"}, ErrEnvelopeVersion},
+		{"future", Envelope{Version: EnvelopeVersion + 1, Id: "id"}, ErrEnvelopeVersion},
+		{"without id", Envelope{Version: EnvelopeVersion}, ErrEnvelopeId},
+	}
+	for _, test := range tests {
+		if err := test.env.check(); err != test.err {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestEnvelopes(t *testing.T) {
+	network := CreateMemoryNetwork()
+	a, b := testHost(t, "a", network.Transport("10.0.0.1")), testHost(t, "b", network.Transport("10.0.0.2"))
+	subA, subB := a.Events.Subscribe(), b.Events.Subscribe()
+	pa, pb := connectHosts(t, a, b, "10.0.0.1:7000")
+	defer pa.Close()
+	defer pb.Close()
+
+	// Envelope waits for REFO instead of going as SEND
+	env, _ := CreateEnvelope(`{"text":"hi"}`, "application/json", "previous")
+	if err := b.SendEnvelope(pb, env); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := expectEvent(t, subA, "Message")
+	if msg.Id != env.Id || msg.ContentType != "application/json" || msg.ReplyTo != "previous" ||
+		msg.Data != env.Data || msg.Sent == nil || !msg.Sent.Equal(env.Time) || msg.Login != "b" {
+		t.Fatalf("wrong message %+v", msg)
+	}
+	receipt := expectEvent(t, subB, "Receipt")
+	if receipt.Id != env.Id || receipt.Data != ReceiptDelivered || receipt.Peer != "10.0.0.1" {
+		t.Fatalf("wrong receipt %+v", receipt)
+	}
+
+	if err := sendReceipt(pa, env.Id, ReceiptRead); err != nil {
+		t.Fatal(err)
+	}
+	if receipt := expectEvent(t, subB, "Receipt"); receipt.Data != ReceiptRead {
+		t.Fatalf("wrong receipt %+v", receipt)
+	}
+
+	// Peers without envelope support get plain SEND
+	pb.setFeatures(nil)
+	env, _ = CreateEnvelope("plain", "", "")
+	if err := b.SendEnvelope(pb, env); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectEvent(t, subA, "Message"); msg.Id != "" || msg.Data != "plain" {
+		t.Fatalf("wrong message %+v", msg)
+	}
+
+	// Broken envelopes are refused and not acknowledged
+	js, _ := json.Marshal(Envelope{Id: "legacy", Data: "data"})
+	if err := peerMesgHandler(a, pa, js); err != ErrEnvelopeVersion {
+		t.Fatalf("expected %v, got %v", ErrEnvelopeVersion, err)
+	}
+}
+
+func TestSendEnvelopeWithoutFeatures(t *testing.T) {
+	timeout := FeatureTimeout
+	FeatureTimeout = 10 * time.Millisecond
+	defer func() { FeatureTimeout = timeout }()
+
+	host, peer := testPeer(t)
+	defer peer.Close()
+	env, _ := CreateEnvelope("text", "", "")
+	if err := host.SendEnvelope(peer, env); err != ErrNoFeatures {
+		t.Fatalf("expected %v, got %v", ErrNoFeatures, err)
+	}
+
+	// REFO may come again
+	peer.setFeatures(nil)
+	peer.setFeatures([]string{featureEnvelope})
+	if !peer.waitFeatures(time.Second) {
+		t.Fatal("features aren't negotiated")
+	}
+}
@@ -0,0 +1,129 @@
+package proto
+
+import (
+	"sync"
+)
+
+const (
+	DefaultEventQueue    = 256
+	DefaultOfflineEvents = 1024
+)
+
+// EventBus delivers every event to every subscribed manager. Subscriber which
+// doesn't keep up loses the oldest events of its queue, publisher never
+// blocks. Events published without subscribers wait for the first one.
+type EventBus struct {
+	mutex       sync.Mutex
+	subs        map[*Subscription]struct{}
+	offline     []string
+	queueSize   int
+	offlineSize int
+}
+
+type Subscription struct {
+	Events   chan string
+	Progress chan string
+
+	bus     *EventBus
+	dropped uint64
+}
+
+func CreateEventBus(queueSize, offlineSize int) *EventBus {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	return &EventBus{
+		subs:        make(map[*Subscription]struct{}),
+		queueSize:   queueSize,
+		offlineSize: offlineSize,
+	}
+}
+
+func (bus *EventBus) Publish(event string) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	if len(bus.subs) == 0 {
+		if bus.offlineSize == 0 {
+			return
+		}
+		if len(bus.offline) == bus.offlineSize {
+			bus.offline = bus.offline[1:]
+		}
+		bus.offline = append(bus.offline, event)
+		return
+	}
+
+	for sub := range bus.subs {
+		sub.push(sub.Events, event)
+	}
+}
+
+// PublishProgress delivers progress of transfer job to current subscribers
+// only, it isn't worth keeping for managers connected later. Progress has its
+// own channel, so it's told from events without parsing them.
+func (bus *EventBus) PublishProgress(progress string) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	for sub := range bus.subs {
+		sub.push(sub.Progress, progress)
+	}
+}
+
+// Subscribe returns subscription, which gets events queued while nobody was
+// subscribed first.
+func (bus *EventBus) Subscribe() *Subscription {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	sub := &Subscription{
+		Events:   make(chan string, bus.queueSize),
+		Progress: make(chan string, bus.queueSize),
+		bus:      bus,
+	}
+	for _, event := range bus.offline {
+		sub.push(sub.Events, event)
+	}
+	bus.offline = nil
+	bus.subs[sub] = struct{}{}
+	return sub
+}
+
+// Close unsubscribes and closes Events and Progress channels.
+func (sub *Subscription) Close() {
+	sub.bus.mutex.Lock()
+	defer sub.bus.mutex.Unlock()
+
+	if _, ok := sub.bus.subs[sub]; !ok {
+		return
+	}
+	delete(sub.bus.subs, sub)
+	close(sub.Events)
+	close(sub.Progress)
+}
+
+// Dropped returns the number of events lost by slow subscriber.
+func (sub *Subscription) Dropped() uint64 {
+	sub.bus.mutex.Lock()
+	defer sub.bus.mutex.Unlock()
+	return sub.dropped
+}
+
+// push is called under bus mutex, so it's the only writer to channels of
+// subscription.
+func (sub *Subscription) push(ch chan string, event string) {
+	for {
+		select {
+		case ch <- event:
+			return
+		default:
+		}
+
+		select {
+		case <-ch:
+			sub.dropped++
+		default:
+		}
+	}
+}
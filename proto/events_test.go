@@ -0,0 +1,95 @@
+package proto
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func expectEvent(t *testing.T, sub *Subscription, kind string) Message {
+	t.Helper()
+	for {
+		select {
+		case js := <-sub.Events:
+			msg := Message{}
+			json.Unmarshal([]byte(js), &msg)
+			if msg.Type == kind {
+				return msg
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s event is lost", kind)
+		}
+	}
+}
+
+func receiveEvents(t *testing.T, sub *Subscription, expected ...string) {
+	t.Helper()
+	for _, event := range expected {
+		select {
+		case got := <-sub.Events:
+			if got != event {
+				t.Fatalf("expected %q, got %q", event, got)
+			}
+		default:
+			t.Fatalf("event %q is lost", event)
+		}
+	}
+	select {
+	case got := <-sub.Events:
+		t.Fatalf("unexpected event %q", got)
+	default:
+	}
+}
+
+func TestEventBusFanOut(t *testing.T) {
+	bus := CreateEventBus(8, 8)
+	first, second := bus.Subscribe(), bus.Subscribe()
+
+	bus.Publish("a")
+	bus.Publish("b")
+	receiveEvents(t, first, "a", "b")
+	receiveEvents(t, second, "a", "b")
+
+	second.Close()
+	second.Close()
+	bus.Publish("c")
+	receiveEvents(t, first, "c")
+
+	if _, ok := <-second.Events; ok {
+		t.Fatal("events channel of closed subscription is open")
+	}
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	bus := CreateEventBus(3, 8)
+	sub := bus.Subscribe()
+
+	for i := 0; i < 10; i++ {
+		bus.Publish(strconv.Itoa(i))
+	}
+	receiveEvents(t, sub, "7", "8", "9")
+	if sub.Dropped() != 7 {
+		t.Fatalf("expected 7 dropped events, got %d", sub.Dropped())
+	}
+}
+
+func TestEventBusOffline(t *testing.T) {
+	bus := CreateEventBus(8, 3)
+
+	// Publisher doesn't block without subscribers
+	for i := 0; i < 5; i++ {
+		bus.Publish(strconv.Itoa(i))
+	}
+
+	first := bus.Subscribe()
+	receiveEvents(t, first, "2", "3", "4")
+
+	second := bus.Subscribe()
+	receiveEvents(t, second)
+
+	first.Close()
+	second.Close()
+	bus.Publish("5")
+	receiveEvents(t, bus.Subscribe(), "5")
+}
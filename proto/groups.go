@@ -0,0 +1,392 @@
+package proto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MaxGroupInvites limits invitations waiting for the user.
+const MaxGroupInvites = 32
+
+// Group is a named conversation. Messages are sent to every member over its
+// pairwise session, members are session ids of peers. Only the owner, which
+// created the group, changes its members, groups created by the host have no
+// owner.
+type Group struct {
+	Id      string
+	Name    string
+	Owner   string `json:",omitempty"`
+	Members []string
+}
+
+// GroupStore keeps groups of the host keyed by group id. Invitations aren't
+// joined until the user accepts them, they aren't saved.
+type GroupStore struct {
+	mutex    sync.Mutex
+	groups   map[string]*Group
+	invites  map[string]*Group
+	OnChange func()
+}
+
+// groupInvite is the body of peer GINV command. Members don't include sender
+// and receiver of the invite.
+type groupInvite struct {
+	Id      string
+	Name    string
+	Members []string
+}
+
+// groupMessage is the body of GMSG and GLEA commands.
+type groupMessage struct {
+	Id       string
+	Envelope *Envelope `json:",omitempty"`
+}
+
+var (
+	ErrUnknownGroup   = errors.New("unknown group")
+	ErrNotMember      = errors.New("peer isn't a member of group")
+	ErrNotOwner       = errors.New("only owner of group changes its members")
+	ErrUnknownInvite  = errors.New("unknown group invitation")
+	ErrTooManyInvites = errors.New("too many group invitations")
+)
+
+func CreateGroupStore(groups map[string]*Group) *GroupStore {
+	if groups == nil {
+		groups = make(map[string]*Group)
+	}
+	return &GroupStore{groups: groups, invites: make(map[string]*Group)}
+}
+
+func (gs *GroupStore) Create(name string) (*Group, error) {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	group := &Group{Id: hex.EncodeToString(buf), Name: name}
+	gs.groups[group.Id] = group
+	gs.changed()
+	return group.copy(), nil
+}
+
+func (gs *GroupStore) Get(id string) (*Group, bool) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	group, ok := gs.groups[id]
+	if !ok {
+		return nil, false
+	}
+	return group.copy(), true
+}
+
+func (gs *GroupStore) All() []*Group {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	groups := make([]*Group, 0, len(gs.groups))
+	for _, group := range gs.groups {
+		groups = append(groups, group.copy())
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Id < groups[j].Id })
+	return groups
+}
+
+func (gs *GroupStore) AddMember(id, member string) (*Group, error) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	group, ok := gs.groups[id]
+	if !ok {
+		return nil, ErrUnknownGroup
+	}
+	if group.Owner != "" {
+		return nil, ErrNotOwner
+	}
+	if !group.HasMember(member) {
+		group.Members = append(group.Members, member)
+		gs.changed()
+	}
+	return group.copy(), nil
+}
+
+func (gs *GroupStore) RemoveMember(id, member string) (*Group, error) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	group, ok := gs.groups[id]
+	if !ok {
+		return nil, ErrUnknownGroup
+	}
+	if !group.HasMember(member) {
+		return nil, ErrNotMember
+	}
+	group.Members = withoutMember(group.Members, member)
+	gs.changed()
+	return group.copy(), nil
+}
+
+// Invite applies invite sent by peer sender. Members of known group are
+// replaced only if sender owns it. Unknown group becomes an invitation, which
+// is joined with AcceptInvite. It reports whether invite is an invitation.
+func (gs *GroupStore) Invite(sender, self string, invite *groupInvite) (*Group, bool, error) {
+	members := []string{sender}
+	for _, member := range invite.Members {
+		if member != sender && member != self && !contains(members, member) {
+			members = append(members, member)
+		}
+	}
+
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	group, ok := gs.groups[invite.Id]
+	if ok {
+		if group.Owner != sender {
+			return nil, false, ErrNotOwner
+		}
+		group.Members = members
+		gs.changed()
+		return group.copy(), false, nil
+	}
+
+	group, ok = gs.invites[invite.Id]
+	switch {
+	case ok && group.Owner != sender:
+		return nil, false, ErrNotOwner
+	case !ok && len(gs.invites) >= MaxGroupInvites:
+		return nil, false, ErrTooManyInvites
+	case !ok:
+		group = &Group{Id: invite.Id, Name: invite.Name, Owner: sender}
+		gs.invites[invite.Id] = group
+	}
+	group.Members = members
+	return group.copy(), true, nil
+}
+
+// AcceptInvite joins group the host is invited to.
+func (gs *GroupStore) AcceptInvite(id string) (*Group, error) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	group, ok := gs.invites[id]
+	if !ok {
+		return nil, ErrUnknownInvite
+	}
+	delete(gs.invites, id)
+	gs.groups[id] = group
+	gs.changed()
+	return group.copy(), nil
+}
+
+// DeclineInvite forgets invitation and returns it.
+func (gs *GroupStore) DeclineInvite(id string) (*Group, error) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	group, ok := gs.invites[id]
+	if !ok {
+		return nil, ErrUnknownInvite
+	}
+	delete(gs.invites, id)
+	return group, nil
+}
+
+func (gs *GroupStore) Remove(id string) error {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	if _, ok := gs.groups[id]; !ok {
+		return ErrUnknownGroup
+	}
+	delete(gs.groups, id)
+	gs.changed()
+	return nil
+}
+
+func (gs *GroupStore) MarshalJSON() ([]byte, error) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	return json.Marshal(gs.groups)
+}
+
+func (gs *GroupStore) UnmarshalJSON(data []byte) error {
+	groups := make(map[string]*Group)
+	err := json.Unmarshal(data, &groups)
+	if err != nil {
+		return err
+	}
+	for id, group := range groups {
+		if group == nil {
+			delete(groups, id)
+		}
+	}
+
+	gs.mutex.Lock()
+	gs.groups = groups
+	if gs.invites == nil {
+		gs.invites = make(map[string]*Group)
+	}
+	gs.mutex.Unlock()
+	return nil
+}
+
+func (gs *GroupStore) changed() {
+	if gs.OnChange != nil {
+		go gs.OnChange()
+	}
+}
+
+func (group *Group) HasMember(member string) bool {
+	return contains(group.Members, member)
+}
+
+func (group *Group) copy() *Group {
+	cpy := *group
+	cpy.Members = append([]string(nil), group.Members...)
+	return &cpy
+}
+
+// SendGroup sends envelope to every member of group with active session and
+// returns ids of members it couldn't reach.
+func (host *Host) SendGroup(id string, env *Envelope) ([]string, error) {
+	group, ok := host.Groups.Get(id)
+	if !ok {
+		return nil, ErrUnknownGroup
+	}
+
+	js, _ := json.Marshal(groupMessage{Id: id, Envelope: env})
+	var unreachable []string
+	for _, member := range group.Members {
+		peer, err := host.Session(member)
+		if err == nil {
+			err = sendCommand(peer, gmsg, js)
+		}
+		if err != nil {
+			unreachable = append(unreachable, member)
+		}
+	}
+
+	sent := env.message("Sent")
+	sent.Group = id
+	host.Record(&sent)
+	return unreachable, nil
+}
+
+// InviteToGroup adds peer of session sid to group owned by host and sends the
+// new member list to every member with active session.
+func (host *Host) InviteToGroup(id, sid string) error {
+	if !host.hasSession(sid) {
+		return ErrNoSession
+	}
+
+	group, err := host.Groups.AddMember(id, sid)
+	if err != nil {
+		return err
+	}
+	host.publishGroup("GroupMembers", group)
+	host.sendMembers(group)
+	return nil
+}
+
+// sendMembers sends member list of group to every member with active session.
+func (host *Host) sendMembers(group *Group) {
+	for _, member := range group.Members {
+		peer, err := host.Session(member)
+		if err != nil {
+			continue
+		}
+		js, _ := json.Marshal(groupInvite{
+			Id:      group.Id,
+			Name:    group.Name,
+			Members: withoutMember(group.Members, member),
+		})
+		sendCommand(peer, ginv, js)
+	}
+}
+
+// LeaveGroup notifies members with active sessions and forgets group.
+func (host *Host) LeaveGroup(id string) error {
+	group, ok := host.Groups.Get(id)
+	if !ok {
+		return ErrUnknownGroup
+	}
+
+	js, _ := json.Marshal(groupMessage{Id: id})
+	for _, member := range group.Members {
+		if peer, err := host.Session(member); err == nil {
+			sendCommand(peer, glea, js)
+		}
+	}
+	return host.Groups.Remove(id)
+}
+
+// AcceptGroup joins group the host is invited to.
+func (host *Host) AcceptGroup(id string) (*Group, error) {
+	group, err := host.Groups.AcceptInvite(id)
+	if err != nil {
+		return nil, err
+	}
+	host.publishGroup("GroupMembers", group)
+	return group, nil
+}
+
+// DeclineGroup forgets invitation, owner of the group is notified, so it
+// drops the host from members.
+func (host *Host) DeclineGroup(id string) error {
+	group, err := host.Groups.DeclineInvite(id)
+	if err != nil {
+		return err
+	}
+
+	if peer, err := host.Session(group.Owner); err == nil {
+		js, _ := json.Marshal(groupMessage{Id: id})
+		sendCommand(peer, glea, js)
+	}
+	return nil
+}
+
+func (host *Host) publishGroup(event string, group *Group) {
+	js, _ := json.Marshal(group)
+	msg, _ := json.Marshal(Message{
+		Type:  event,
+		Group: group.Id,
+		Data:  string(js),
+	})
+	host.Events.Publish(string(msg))
+}
+
+func withoutMember(members []string, member string) []string {
+	result := make([]string, 0, len(members))
+	for _, m := range members {
+		if m != member {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func unreachableError(unreachable []string) error {
+	if len(unreachable) == 0 {
+		return nil
+	}
+	return errors.New("members aren't reachable: " + strings.Join(unreachable, ", "))
+}
@@ -0,0 +1,227 @@
+package proto
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func eventGroup(t *testing.T, msg Message) *Group {
+	t.Helper()
+	group := &Group{}
+	err := json.Unmarshal([]byte(msg.Data), group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return group
+}
+
+func TestGroupStore(t *testing.T) {
+	gs := CreateGroupStore(nil)
+	group, err := gs.Create("friends")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gs.AddMember(group.Id, "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gs.AddMember("unknown", "10.0.0.2"); err != ErrUnknownGroup {
+		t.Fatalf("expected %v, got %v", ErrUnknownGroup, err)
+	}
+	group, _ = gs.AddMember(group.Id, "10.0.0.2")
+	if !reflect.DeepEqual(group.Members, []string{"10.0.0.2"}) {
+		t.Fatalf("wrong members %v", group.Members)
+	}
+
+	// Members of own group aren't changed by peers
+	invite := &groupInvite{Id: group.Id, Members: []string{"10.0.0.3"}}
+	if _, _, err := gs.Invite("10.0.0.2", "10.0.0.1", invite); err != ErrNotOwner {
+		t.Fatalf("expected %v, got %v", ErrNotOwner, err)
+	}
+
+	// Unknown group is joined only when invitation is accepted
+	invite = &groupInvite{Id: "other", Name: "other"}
+	group, pending, err := gs.Invite("10.0.0.4", "10.0.0.1", invite)
+	if err != nil || !pending || group.Owner != "10.0.0.4" {
+		t.Fatalf("invitation isn't pending: %v %v", pending, err)
+	}
+	if _, ok := gs.Get("other"); ok {
+		t.Fatal("group is joined without consent")
+	}
+	if _, _, err := gs.Invite("10.0.0.2", "10.0.0.1", invite); err != ErrNotOwner {
+		t.Fatalf("expected %v, got %v", ErrNotOwner, err)
+	}
+	if _, err := gs.AcceptInvite("other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gs.AcceptInvite("other"); err != ErrUnknownInvite {
+		t.Fatalf("expected %v, got %v", ErrUnknownInvite, err)
+	}
+
+	// Owner replaces member list, owner is always a member, self never is
+	invite = &groupInvite{Id: "other", Members: []string{"10.0.0.2", "10.0.0.1", "10.0.0.2"}}
+	group, pending, err = gs.Invite("10.0.0.4", "10.0.0.1", invite)
+	if err != nil || pending {
+		t.Fatalf("unexpected result: %v %v", pending, err)
+	}
+	if !reflect.DeepEqual(group.Members, []string{"10.0.0.4", "10.0.0.2"}) {
+		t.Fatalf("wrong members %v", group.Members)
+	}
+	if _, _, err := gs.Invite("10.0.0.2", "10.0.0.1", invite); err != ErrNotOwner {
+		t.Fatalf("expected %v, got %v", ErrNotOwner, err)
+	}
+	if _, err := gs.AddMember("other", "10.0.0.3"); err != ErrNotOwner {
+		t.Fatalf("expected %v, got %v", ErrNotOwner, err)
+	}
+	if group, _ = gs.RemoveMember("other", "10.0.0.2"); !reflect.DeepEqual(group.Members, []string{"10.0.0.4"}) {
+		t.Fatalf("member isn't removed %v", group.Members)
+	}
+
+	for i := 0; i <= MaxGroupInvites; i++ {
+		_, _, err = gs.Invite("10.0.0.4", "10.0.0.1", &groupInvite{Id: strconv.Itoa(i)})
+	}
+	if err != ErrTooManyInvites {
+		t.Fatalf("expected %v, got %v", ErrTooManyInvites, err)
+	}
+	if _, err := gs.DeclineInvite("0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gs.RemoveMember("other", "10.0.0.2"); err != ErrNotMember {
+		t.Fatalf("expected %v, got %v", ErrNotMember, err)
+	}
+
+	js, _ := json.Marshal(gs)
+	loaded := CreateGroupStore(nil)
+	err = json.Unmarshal(js, loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.All(), gs.All()) {
+		t.Fatal("groups aren't restored")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	network := CreateMemoryNetwork()
+	a := testHost(t, "a", network.Transport("10.0.0.1"))
+	b := testHost(t, "b", network.Transport("10.0.0.2"))
+	c := testHost(t, "c", network.Transport("10.0.0.3"))
+	serveHost(t, b, "10.0.0.2:7000")
+	serveHost(t, c, "10.0.0.3:7000")
+	subA, subB, subC := a.Events.Subscribe(), b.Events.Subscribe(), c.Events.Subscribe()
+	defer a.Disconnect()
+
+	manager, _ := testManager(t)
+	for _, addr := range []string{"10.0.0.2:7000", "10.0.0.3:7000"} {
+		if err := managerConnHandler(a, manager, []byte(addr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	group, err := a.Groups.Create("friends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.InviteToGroup(group.Id, "10.0.0.4"); err != ErrNoSession {
+		t.Fatalf("expected %v, got %v", ErrNoSession, err)
+	}
+	if err := a.InviteToGroup(group.Id, "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	invite := eventGroup(t, expectEvent(t, subB, "GroupInvite"))
+	if invite.Id != group.Id || invite.Name != "friends" || !reflect.DeepEqual(invite.Members, []string{"10.0.0.1"}) {
+		t.Fatalf("wrong invite %+v", invite)
+	}
+	if _, ok := b.Groups.Get(group.Id); ok {
+		t.Fatal("group is joined without consent")
+	}
+	if _, err := b.AcceptGroup(group.Id); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, subB, "GroupMembers")
+
+	if err := a.InviteToGroup(group.Id, "10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	members := eventGroup(t, expectEvent(t, subB, "GroupMembers"))
+	if !reflect.DeepEqual(members.Members, []string{"10.0.0.1", "10.0.0.3"}) {
+		t.Fatalf("wrong members %v", members.Members)
+	}
+	invite = eventGroup(t, expectEvent(t, subC, "GroupInvite"))
+	if !reflect.DeepEqual(invite.Members, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatalf("wrong members %v", invite.Members)
+	}
+	cManager, responses := testManager(t)
+	if err := managerGaccHandler(c, cManager, []byte(group.Id)); err != nil {
+		t.Fatal(err)
+	}
+	var joined []*Group
+	json.Unmarshal(expectResponse(t, responses, regr), &joined)
+	if len(joined) != 1 || joined[0].Owner != "10.0.0.1" {
+		t.Fatalf("wrong joined group %+v", joined)
+	}
+
+	// Only the owner invites
+	if err := c.InviteToGroup(group.Id, "10.0.0.1"); err != ErrNotOwner {
+		t.Fatalf("expected %v, got %v", ErrNotOwner, err)
+	}
+
+	env, _ := CreateEnvelope("hello", "", "")
+	unreachable, err := a.SendGroup(group.Id, env)
+	if err != nil || len(unreachable) != 0 {
+		t.Fatalf("unexpected result: %v %v", unreachable, err)
+	}
+	for _, sub := range []*Subscription{subB, subC} {
+		msg := expectEvent(t, sub, "GroupMessage")
+		if msg.Group != group.Id || msg.Peer != "10.0.0.1" || msg.Id != env.Id || msg.Data != "hello" {
+			t.Fatalf("wrong message %+v", msg)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if receipt := expectEvent(t, subA, "Receipt"); receipt.Id != env.Id {
+			t.Fatalf("wrong receipt %+v", receipt)
+		}
+	}
+
+	// c has session only with a
+	env, _ = CreateEnvelope("from c", "", "")
+	unreachable, err = c.SendGroup(group.Id, env)
+	if err != nil || !reflect.DeepEqual(unreachable, []string{"10.0.0.2"}) {
+		t.Fatalf("unexpected result: %v %v", unreachable, err)
+	}
+	if msg := expectEvent(t, subA, "GroupMessage"); msg.Data != "from c" {
+		t.Fatalf("wrong message %+v", msg)
+	}
+
+	if err := c.LeaveGroup(group.Id); err != nil {
+		t.Fatal(err)
+	}
+	members = eventGroup(t, expectEvent(t, subA, "GroupMembers"))
+	for members.HasMember("10.0.0.3") {
+		members = eventGroup(t, expectEvent(t, subA, "GroupMembers"))
+	}
+	if _, ok := c.Groups.Get(group.Id); ok {
+		t.Fatal("left group is kept")
+	}
+
+	// Declined invitation drops the member at owner
+	other, _ := a.Groups.Create("other")
+	a.InviteToGroup(other.Id, "10.0.0.2")
+	expectEvent(t, subB, "GroupInvite")
+	if err := b.DeclineGroup(other.Id); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if group, _ := a.Groups.Get(other.Id); len(group.Members) == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("declined member is kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,274 @@
+package proto
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+const (
+	activeRoleV2  = "sechan v2 active"
+	passiveRoleV2 = "sechan v2 passive"
+)
+
+// Hello opens handshake. DHState is sent only when legacy handshake is
+// allowed, so nodes speaking only legacy protocol can parse hello as dhstate.
+type Hello struct {
+	*DHState
+	Versions  []uint32 `json:",omitempty"`
+	Ephemeral []byte   `json:",omitempty"`
+	Suites    []uint8  `json:",omitempty"`
+}
+
+type HelloReply struct {
+	Version   uint32
+	Ephemeral []byte
+	Suite     uint8
+	Auth      *HalfkeyAuth
+}
+
+var (
+	ErrParseHello = errors.New("failed to parse second user's hello")
+	ErrVersion    = errors.New("no common protocol version with second user")
+	ErrSuite      = errors.New("no common cipher suite with second user")
+)
+
+// ActiveExchange runs handshake on the accepting side. Non nil dh allows
+// legacy finite field handshake with nodes which don't support X25519.
+// suites are offered in order of preference.
+func ActiveExchange(conn *Conn, id *Identity, dh *DHState, suites []uint8) (*Exchange, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errExchangeIO(err)
+	}
+
+	hello := &Hello{
+		Versions:  []uint32{ProtocolVersion},
+		Ephemeral: eph.PublicKey().Bytes(),
+		Suites:    suites,
+	}
+	if dh != nil {
+		hello.DHState = dh
+		hello.Versions = append(hello.Versions, LegacyProtocolVersion)
+	}
+
+	// Send hello
+	buf, _ := json.Marshal(hello)
+	_, err = conn.WritePackage(buf)
+	if err != nil {
+		return nil, errExchangeIO(err)
+	}
+	transcript := buf
+
+	// Legacy node waits for halfkeyX right after dhstate
+	var (
+		X                *big.Int
+		legacyTranscript []byte
+	)
+	if dh != nil {
+		X, legacyTranscript, err = dh.sendHalfkey(conn, append([]byte{}, transcript...))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Recieve reply or halfkeyY from legacy node
+	buf, err = conn.ReadPackage()
+	if err != nil {
+		return nil, errExchangeIO(err)
+	}
+
+	if !isHelloReply(buf) {
+		if dh == nil {
+			return nil, ErrVersion
+		}
+		return dh.finishActiveDHExchange(conn, id, X, legacyTranscript, buf)
+	}
+
+	reply := &HelloReply{}
+	err = json.Unmarshal(buf, reply)
+	if err != nil {
+		return nil, ErrParseHello
+	}
+
+	if reply.Version != ProtocolVersion {
+		return nil, ErrVersion
+	}
+
+	if !hasSuite(suites, reply.Suite) {
+		return nil, ErrSuite
+	}
+
+	// Check signature of second user
+	transcript = append(transcript, reply.Ephemeral...)
+	transcript = append(transcript, reply.Suite)
+	if reply.Auth == nil || !reply.Auth.Verify(passiveRoleV2, transcript) {
+		return nil, ErrAuthHalfkey
+	}
+
+	secret, err := x25519(eph, reply.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	// Send own signature
+	err = sendHalfkeyAuth(conn, id, activeRoleV2, transcript)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Exchange{
+		Version:    ProtocolVersion,
+		Suite:      reply.Suite,
+		Key:        secret,
+		PeerKey:    reply.Auth.Key,
+		Transcript: transcript,
+
+		ephemeral:     eph,
+		peerEphemeral: reply.Ephemeral,
+	}, nil
+}
+
+// PassiveExchange runs handshake on the dialing side. Non nil dh allows
+// legacy finite field handshake and receives its parameters. The first suite
+// from suites offered by second user is chosen.
+func PassiveExchange(conn *Conn, id *Identity, dh *DHState, suites []uint8) (*Exchange, error) {
+	// Recieve hello
+	buf, err := conn.ReadPackage()
+	if err != nil {
+		return nil, errExchangeIO(err)
+	}
+
+	hello := &Hello{}
+	err = json.Unmarshal(buf, hello)
+	if err != nil {
+		return nil, ErrParseHello
+	}
+
+	if !hello.Supports(ProtocolVersion) {
+		if dh == nil {
+			return nil, ErrVersion
+		}
+		return dh.passiveDHExchange(conn, id, buf)
+	}
+	transcript := buf
+
+	suite, err := chooseSuite(suites, hello.Suites)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip halfkeyX sent for legacy nodes
+	if hello.DHState != nil {
+		_, err = conn.ReadPackage()
+		if err != nil {
+			return nil, errExchangeIO(err)
+		}
+	}
+
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errExchangeIO(err)
+	}
+	ephPub := eph.PublicKey().Bytes()
+	transcript = append(transcript, ephPub...)
+	transcript = append(transcript, suite)
+
+	secret, err := x25519(eph, hello.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	// Send reply
+	buf, _ = json.Marshal(&HelloReply{
+		Version:   ProtocolVersion,
+		Ephemeral: ephPub,
+		Suite:     suite,
+		Auth:      id.SignHalfkey(passiveRoleV2, transcript),
+	})
+	_, err = conn.WritePackage(buf)
+	if err != nil {
+		return nil, errExchangeIO(err)
+	}
+
+	// Recieve and check signature of second user
+	peerKey, err := recvHalfkeyAuth(conn, activeRoleV2, transcript)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Exchange{
+		Version:    ProtocolVersion,
+		Suite:      suite,
+		Key:        secret,
+		PeerKey:    peerKey,
+		Transcript: transcript,
+
+		ephemeral:     eph,
+		peerEphemeral: hello.Ephemeral,
+	}, nil
+}
+
+func (hello *Hello) Supports(version uint32) bool {
+	for _, v := range hello.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (exch *Exchange) InitCryptoState(isUserA bool) (CryptoState, error) {
+	if exch.Version == LegacyProtocolVersion {
+		return InitCryptoState(exch.Key, isUserA), nil
+	}
+
+	switch exch.Suite {
+	case SuiteCTRHMAC:
+		return DeriveCryptoState(exch.Key, exch.Transcript, isUserA), nil
+	case SuiteRatchet:
+		return InitRatchetState(exch.Key, exch.Transcript, exch.ephemeral, exch.peerEphemeral, isUserA)
+	}
+	return DeriveAEADState(exch.Key, exch.Transcript, exch.Suite, isUserA)
+}
+
+// chooseSuite picks the first suite offered by second user which is
+// supported by own suites, offered suites are in order of preference.
+func chooseSuite(own, offered []uint8) (uint8, error) {
+	for _, suite := range offered {
+		if hasSuite(own, suite) {
+			return suite, nil
+		}
+	}
+	return 0, ErrSuite
+}
+
+func hasSuite(suites []uint8, suite uint8) bool {
+	for _, s := range suites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}
+
+func x25519(priv *ecdh.PrivateKey, peerPub []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, ErrParseHalfKey
+	}
+
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, ErrWeakHalfkey
+	}
+	return secret, nil
+}
+
+// isHelloReply distinguishes reply from legacy halfkey, which is a decimal
+// number.
+func isHelloReply(buf []byte) bool {
+	return len(buf) > 0 && buf[0] == '{'
+}
@@ -0,0 +1,279 @@
+package proto
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type exchangeFunc func(*Conn, *Identity) (*Exchange, error)
+
+var (
+	testDH     *DHState
+	testDHOnce sync.Once
+)
+
+// testDHState generates finite field parameters once, it takes a while.
+func testDHState(t testing.TB) *DHState {
+	testDHOnce.Do(func() {
+		dh, err := InitDHState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testDH = dh
+	})
+	if testDH == nil {
+		t.Fatal("failed to generate diffie-hellman state")
+	}
+	return testDH
+}
+
+func testIdentity(t testing.TB) *Identity {
+	id, err := InitIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// exchange runs active and passive sides of handshake over net.Pipe.
+func exchange(t *testing.T, active, passive exchangeFunc) (*Exchange, *Exchange, error, error) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ida, idb := testIdentity(t), testIdentity(t)
+
+	type result struct {
+		exch *Exchange
+		err  error
+	}
+	res := make(chan result)
+	go func() {
+		exch, err := active(CreateConn(a), ida)
+		if err != nil {
+			// Unblock the second user waiting for data
+			a.Close()
+		}
+		res <- result{exch, err}
+	}()
+
+	exchB, errB := passive(CreateConn(b), idb)
+	if errB != nil {
+		b.Close()
+	}
+	r := <-res
+	if r.err != nil || errB != nil {
+		return r.exch, exchB, r.err, errB
+	}
+
+	if !bytes.Equal(r.exch.Key, exchB.Key) {
+		t.Fatal("users derived different keys")
+	}
+	if !bytes.Equal(r.exch.Transcript, exchB.Transcript) {
+		t.Fatal("users have different transcripts")
+	}
+	if !bytes.Equal(r.exch.PeerKey, idb.Public) || !bytes.Equal(exchB.PeerKey, ida.Public) {
+		t.Fatal("wrong identity key of second user")
+	}
+	if r.exch.Version != exchB.Version || r.exch.Suite != exchB.Suite {
+		t.Fatal("users negotiated different parameters")
+	}
+	return r.exch, exchB, nil, nil
+}
+
+// checkCryptoStates checks that crypto states of both users derived from the
+// exchange talk to each other in both directions.
+func checkCryptoStates(t *testing.T, active, passive *Exchange) {
+	csB, err := active.InitCryptoState(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csA, err := passive.InitCryptoState(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pair := range [][2]CryptoState{{csB, csA}, {csA, csB}, {csB, csA}} {
+		enc, err := pair[0].AuthAndEncrypt([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := pair[1].DecryptAndAuth(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plain) != "hello" {
+			t.Fatalf("expected hello, got %q", plain)
+		}
+	}
+}
+
+func TestInitDHState(t *testing.T) {
+	dh := testDHState(t)
+	err := dh.CheckDHState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Product of N and q may be one bit shorter than p must be
+	if dh.P.BitLen() != 2048 {
+		t.Fatalf("p is %d bits long", dh.P.BitLen())
+	}
+}
+
+func TestLegacyDHExchange(t *testing.T) {
+	dh := testDHState(t)
+
+	active := func(c *Conn, id *Identity) (*Exchange, error) { return dh.ActiveDHExchange(c, id) }
+	passive := func(c *Conn, id *Identity) (*Exchange, error) { return (&DHState{}).PassiveDHExchange(c, id) }
+
+	exchA, exchB, errA, errB := exchange(t, active, passive)
+	if errA != nil || errB != nil {
+		t.Fatal(errA, errB)
+	}
+	if exchA.Version != LegacyProtocolVersion {
+		t.Fatalf("expected version %d, got %d", LegacyProtocolVersion, exchA.Version)
+	}
+	checkCryptoStates(t, exchA, exchB)
+}
+
+func TestLegacyDHExchangeWeakState(t *testing.T) {
+	dh := testDHState(t)
+	weak := &DHState{G: dh.G, Q: dh.Q, P: dh.Q}
+
+	active := func(c *Conn, id *Identity) (*Exchange, error) { return weak.ActiveDHExchange(c, id) }
+	passive := func(c *Conn, id *Identity) (*Exchange, error) { return (&DHState{}).PassiveDHExchange(c, id) }
+
+	_, _, _, errB := exchange(t, active, passive)
+	if errB != ErrShortP {
+		t.Fatalf("expected %v, got %v", ErrShortP, errB)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	dh := testDHState(t)
+
+	active := func(dh *DHState, suites []uint8) exchangeFunc {
+		return func(c *Conn, id *Identity) (*Exchange, error) { return ActiveExchange(c, id, dh, suites) }
+	}
+	// Passive side gets finite field parameters from the first user
+	passive := func(legacy bool, suites []uint8) exchangeFunc {
+		return func(c *Conn, id *Identity) (*Exchange, error) {
+			var dh *DHState
+			if legacy {
+				dh = &DHState{}
+			}
+			return PassiveExchange(c, id, dh, suites)
+		}
+	}
+
+	v2Active, v2Passive := active(nil, DefaultSuites), passive(false, DefaultSuites)
+	compatActive, compatPassive := active(dh, DefaultSuites), passive(true, DefaultSuites)
+	chachaPassive := passive(false, []uint8{SuiteChaCha20Poly1305, SuiteAESGCM})
+	ctrPassive := passive(false, []uint8{SuiteCTRHMAC})
+	oldActive := func(c *Conn, id *Identity) (*Exchange, error) { return dh.ActiveDHExchange(c, id) }
+	oldPassive := func(c *Conn, id *Identity) (*Exchange, error) { return (&DHState{}).PassiveDHExchange(c, id) }
+
+	tests := []struct {
+		name    string
+		active  exchangeFunc
+		passive exchangeFunc
+		version uint32
+		suite   uint8
+	}{
+		{"v2", v2Active, v2Passive, ProtocolVersion, SuiteRatchet},
+		{"active suite preference", v2Active, chachaPassive, ProtocolVersion, SuiteAESGCM},
+		{"compatible active", compatActive, v2Passive, ProtocolVersion, SuiteRatchet},
+		{"compatible both", compatActive, compatPassive, ProtocolVersion, SuiteRatchet},
+		{"compatible active, old passive", compatActive, oldPassive, LegacyProtocolVersion, SuiteCTRHMAC},
+		{"old active, compatible passive", oldActive, compatPassive, LegacyProtocolVersion, SuiteCTRHMAC},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exchA, exchB, errA, errB := exchange(t, test.active, test.passive)
+			if errA != nil || errB != nil {
+				t.Fatal(errA, errB)
+			}
+			if exchA.Version != test.version {
+				t.Fatalf("expected version %d, got %d", test.version, exchA.Version)
+			}
+			if exchA.Suite != test.suite {
+				t.Fatalf("expected suite %d, got %d", test.suite, exchA.Suite)
+			}
+			checkCryptoStates(t, exchA, exchB)
+		})
+	}
+
+	failures := []struct {
+		name    string
+		active  exchangeFunc
+		passive exchangeFunc
+	}{
+		{"no common suite", v2Active, ctrPassive},
+		{"v2 active, old passive", v2Active, oldPassive},
+		{"old active, v2 passive", oldActive, v2Passive},
+	}
+
+	for _, test := range failures {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, errA, errB := exchange(t, test.active, test.passive)
+			if errA == nil && errB == nil {
+				t.Fatal("expected exchange to fail")
+			}
+		})
+	}
+}
+
+func TestExchangeForgedSignature(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go func() {
+		ActiveExchange(CreateConn(a), testIdentity(t), nil, DefaultSuites)
+		a.Close()
+	}()
+
+	// Second user signs handshake with a key, which is not sent in Auth
+	id, forger := testIdentity(t), testIdentity(t)
+	id.Private = forger.Private
+
+	_, err := PassiveExchange(CreateConn(b), id, nil, DefaultSuites)
+	if err == nil {
+		t.Fatal("expected exchange to fail")
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	a, b := testIdentity(t).Public, testIdentity(t).Public
+	number := SafetyNumber(a, b, testTranscript)
+
+	if SafetyNumber(b, a, testTranscript) != number {
+		t.Fatal("sides get different safety numbers")
+	}
+	if digits := strings.ReplaceAll(number, " ", ""); len(digits) != 60 {
+		t.Fatalf("wrong safety number %q", number)
+	}
+
+	tests := []struct {
+		name  string
+		other string
+		equal bool
+	}{
+		{"same", number, true},
+		{"without spaces", strings.ReplaceAll(number, " ", ""), true},
+		{"other transcript", SafetyNumber(a, b, []byte("other transcript")), false},
+		{"other key", SafetyNumber(a, testIdentity(t).Public, testTranscript), false},
+		{"truncated", number[:len(number)-1], false},
+		{"empty", "", false},
+	}
+	for _, test := range tests {
+		if CompareSafetyNumbers(number, test.other) != test.equal ||
+			CompareSafetyNumbers(test.other, number) != test.equal {
+			t.Fatalf("%s: expected %v", test.name, test.equal)
+		}
+	}
+}
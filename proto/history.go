@@ -0,0 +1,35 @@
+package proto
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+type HistoryEntry struct {
+	Time time.Time
+	Message
+}
+
+var historyMutex sync.Mutex
+
+// Record appends message to the history file, which is encrypted with host's
+// vault if it's unlocked. Empty History disables history.
+func (host *Host) Record(msg *Message) {
+	if host.History == "" {
+		return
+	}
+
+	js, _ := json.Marshal(HistoryEntry{
+		Time:    time.Now(),
+		Message: *msg,
+	})
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	err := host.Vault.AppendFile(host.History, append(js, '\n'), 0600)
+	if err != nil {
+		log.Println(err)
+	}
+}
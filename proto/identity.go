@@ -0,0 +1,115 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	safetyNumberGroups = 12
+	safetyNumberLabel  = "sechan safety number"
+)
+
+type Identity struct {
+	Public  ed25519.PublicKey
+	Private ed25519.PrivateKey
+}
+
+type HalfkeyAuth struct {
+	Key ed25519.PublicKey
+	Sig []byte
+}
+
+var (
+	ErrParseAuth      = errors.New("failed to parse second user's halfkey signature")
+	ErrAuthHalfkey    = errors.New("second user's halfkey signature is invalid")
+	ErrSafetyNumber   = errors.New("safety number doesn't match")
+	ErrSessionRenewed = errors.New("session is renewed, compare safety number again")
+)
+
+func InitIdentity() (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Public:  pub,
+		Private: priv,
+	}, nil
+}
+
+func (id *Identity) CheckIdentity() error {
+	if len(id.Public) != ed25519.PublicKeySize || len(id.Private) != ed25519.PrivateKeySize {
+		return errors.New("wrong identity key size")
+	}
+	return nil
+}
+
+func (id *Identity) SignHalfkey(role string, transcript []byte) *HalfkeyAuth {
+	return &HalfkeyAuth{
+		Key: id.Public,
+		Sig: ed25519.Sign(id.Private, halfkeySigData(role, transcript)),
+	}
+}
+
+func (auth *HalfkeyAuth) Verify(role string, transcript []byte) bool {
+	if len(auth.Key) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(auth.Key, halfkeySigData(role, transcript), auth.Sig)
+}
+
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// SafetyNumber returns 60 decimal digits derived from identity keys of both
+// users and the handshake transcript. Both sides get the same number, so it
+// can be compared out of band.
+func SafetyNumber(a, b ed25519.PublicKey, transcript []byte) string {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+
+	h := sha512.New()
+	h.Write([]byte(safetyNumberLabel))
+	h.Write(a)
+	h.Write(b)
+	h.Write(transcript)
+	sum := h.Sum(nil)
+
+	groups := make([]string, safetyNumberGroups)
+	chunk := make([]byte, 8)
+	for i := range groups {
+		copy(chunk[3:], sum[i*5:i*5+5])
+		groups[i] = fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk)%100000)
+	}
+	return strings.Join(groups, " ")
+}
+
+func CompareSafetyNumbers(a, b string) bool {
+	digits := func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}
+	return strings.Map(digits, a) == strings.Map(digits, b)
+}
+
+func halfkeySigData(role string, transcript []byte) []byte {
+	data := make([]byte, 0, len(role)+len(transcript)+1)
+	data = append(data, role...)
+	data = append(data, 0)
+	return append(data, transcript...)
+}
@@ -0,0 +1,256 @@
+package proto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	JobRunning  = "running"
+	JobPaused   = "paused"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+// ProgressInterval bounds how often progress of a job is published
+var ProgressInterval = 500 * time.Millisecond
+
+// TransferJob is file being sent to peer of session Peer. It's the body of
+// RETR and PROG commands.
+type TransferJob struct {
+	Id    string
+	Peer  string
+	Path  string
+	Size  int64
+	Sent  int64
+	State string
+	Error string `json:",omitempty"`
+}
+
+type transferJob struct {
+	TransferJob
+	resume    chan struct{}
+	cancel    chan struct{}
+	published time.Time
+}
+
+var (
+	ErrUnknownJob       = errors.New("unknown transfer job")
+	ErrTransferCanceled = errors.New("file transfer is canceled")
+)
+
+// StartTransfer sends file to peer in background and returns the job doing
+// it.
+func (host *Host) StartTransfer(peer *Peer, name string) (*TransferJob, error) {
+	job, err := host.createJob(peer, name)
+	if err != nil {
+		return nil, err
+	}
+	info := host.transfers.job(job)
+
+	go func() {
+		if err := host.runJob(peer, job); err != nil {
+			log.Println(err)
+		}
+	}()
+	return &info, nil
+}
+
+// SendFile sends file to peer and waits for peer to verify it. The transfer
+// is listed, paused and canceled as the ones started in background.
+func (host *Host) SendFile(peer *Peer, name string) error {
+	job, err := host.createJob(peer, name)
+	if err != nil {
+		return err
+	}
+	return host.runJob(peer, job)
+}
+
+// Transfers returns active transfer jobs.
+func (host *Host) Transfers() []TransferJob {
+	host.transfers.mutex.Lock()
+	defer host.transfers.mutex.Unlock()
+
+	jobs := make([]TransferJob, 0, len(host.transfers.jobs))
+	for _, job := range host.transfers.jobs {
+		jobs = append(jobs, job.TransferJob)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Id < jobs[j].Id })
+	return jobs
+}
+
+// PauseTransfer stops sending chunks of job id until it's resumed.
+func (host *Host) PauseTransfer(id string) error {
+	host.transfers.mutex.Lock()
+	defer host.transfers.mutex.Unlock()
+
+	job, ok := host.transfers.jobs[id]
+	if !ok {
+		return ErrUnknownJob
+	}
+	if job.State == JobRunning {
+		job.State = JobPaused
+		job.resume = make(chan struct{})
+	}
+	return nil
+}
+
+func (host *Host) ResumeTransfer(id string) error {
+	host.transfers.mutex.Lock()
+	defer host.transfers.mutex.Unlock()
+
+	job, ok := host.transfers.jobs[id]
+	if !ok {
+		return ErrUnknownJob
+	}
+	if job.State == JobPaused {
+		job.State = JobRunning
+		close(job.resume)
+	}
+	return nil
+}
+
+// CancelTransfer stops job id, peer drops the part it has received.
+func (host *Host) CancelTransfer(id string) error {
+	host.transfers.mutex.Lock()
+	defer host.transfers.mutex.Unlock()
+
+	job, ok := host.transfers.jobs[id]
+	if !ok {
+		return ErrUnknownJob
+	}
+	if job.State != JobCanceled {
+		job.State = JobCanceled
+		close(job.cancel)
+	}
+	return nil
+}
+
+func (host *Host) createJob(peer *Peer, name string) (*transferJob, error) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 8)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &transferJob{
+		TransferJob: TransferJob{
+			Id:    hex.EncodeToString(buf),
+			Peer:  sessionID(peer),
+			Path:  name,
+			Size:  stat.Size(),
+			State: JobRunning,
+		},
+		cancel: make(chan struct{}),
+	}
+
+	host.transfers.mutex.Lock()
+	if host.transfers.jobs == nil {
+		host.transfers.jobs = make(map[string]*transferJob)
+	}
+	host.transfers.jobs[job.Id] = job
+	host.transfers.mutex.Unlock()
+	return job, nil
+}
+
+func (host *Host) runJob(peer *Peer, job *transferJob) error {
+	var err error
+	if !peer.waitFeatures(FeatureTimeout) {
+		err = ErrNoFeatures
+	} else if peer.HasFeature(featureTransfer) {
+		err = host.sendFile(peer, job)
+	} else {
+		err = host.sendFileChunks(peer, job)
+	}
+
+	host.transfers.mutex.Lock()
+	delete(host.transfers.jobs, job.Id)
+	switch {
+	case err == ErrTransferCanceled:
+		job.State = JobCanceled
+	case err != nil:
+		job.State = JobFailed
+		job.Error = err.Error()
+	default:
+		job.State = JobDone
+	}
+	host.transfers.mutex.Unlock()
+
+	host.progress(job, 0, true)
+	return err
+}
+
+// nextChunk waits while job is paused and for the turn of job to send chunk
+// to peer. Chunks of every transfer to peer take turns through the single
+// slot, so commands sent meanwhile wait for one chunk at most. The returned
+// function frees the slot.
+func (host *Host) nextChunk(peer *Peer, job *transferJob) (func(), error) {
+	for {
+		host.transfers.mutex.Lock()
+		state, resume := job.State, job.resume
+		host.transfers.mutex.Unlock()
+
+		switch state {
+		case JobCanceled:
+			return nil, ErrTransferCanceled
+		case JobPaused:
+			select {
+			case <-resume:
+			case <-job.cancel:
+			}
+			continue
+		}
+
+		slot := peer.chunkSlot()
+		select {
+		case slot <- struct{}{}:
+			return func() { <-slot }, nil
+		case <-job.cancel:
+			return nil, ErrTransferCanceled
+		}
+	}
+}
+
+// progress adds sent bytes to job and publishes PROG event if the last one
+// is older than ProgressInterval or the job is finished.
+func (host *Host) progress(job *transferJob, sent int64, final bool) {
+	host.transfers.mutex.Lock()
+	job.Sent += sent
+	now := time.Now()
+	if !final && now.Sub(job.published) < ProgressInterval {
+		host.transfers.mutex.Unlock()
+		return
+	}
+	job.published = now
+	js, _ := json.Marshal(job.TransferJob)
+	host.transfers.mutex.Unlock()
+
+	host.Events.PublishProgress(string(js))
+}
+
+func (t *transfers) job(job *transferJob) TransferJob {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return job.TransferJob
+}
+
+func (p *Peer) chunkSlot() chan struct{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.chunks == nil {
+		p.chunks = make(chan struct{}, 1)
+	}
+	return p.chunks
+}
@@ -0,0 +1,171 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// expectProgress waits for progress of job in state.
+func expectProgress(t *testing.T, sub *Subscription, id, state string) TransferJob {
+	t.Helper()
+	for {
+		select {
+		case js := <-sub.Progress:
+			job := TransferJob{}
+			if err := json.Unmarshal([]byte(js), &job); err != nil {
+				t.Fatal(err)
+			}
+			if job.Id == id && job.State == state {
+				return job
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s progress is lost", state)
+		}
+	}
+}
+
+func TestTransferJobs(t *testing.T) {
+	network := CreateMemoryNetwork()
+	a, b := testHost(t, "a", network.Transport("10.0.0.1")), testHost(t, "b", network.Transport("10.0.0.2"))
+	a.Downloads = t.TempDir()
+	subA, subB := a.Events.Subscribe(), b.Events.Subscribe()
+	pa, pb := connectHosts(t, a, b, "10.0.0.1:7000")
+	defer pa.Close()
+	defer pb.Close()
+	waitFeature(t, pb, featureTransfer)
+
+	b.addSession("10.0.0.1", pb)
+	manager, responses := testManager(t)
+	run := func(cmd Command, data string) error {
+		handler, arg, err := manager.Commands.GetHandler(packCommand(cmd, []byte(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler.(ManagerHandler)(b, manager, arg)
+	}
+
+	data := make([]byte, 3*fileChunkSize(pb, true)+100)
+	rand.Read(data)
+	src := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(src, data, 0600)
+
+	// FILE returns as soon as the job is started
+	if err := run(file, "10.0.0.1 "+src); err != nil {
+		t.Fatal(err)
+	}
+	jobs := []TransferJob{}
+	json.Unmarshal(expectResponse(t, responses, retr), &jobs)
+	if len(jobs) != 1 || jobs[0].Peer != "10.0.0.1" || jobs[0].Size != int64(len(data)) || jobs[0].State != JobRunning {
+		t.Fatalf("wrong jobs %+v", jobs)
+	}
+	id := jobs[0].Id
+
+	// Paused job sends nothing after the offer is accepted
+	offer := &fileOffer{}
+	json.Unmarshal([]byte(expectEvent(t, subA, "FileOffer").Data), offer)
+	if err := run(tpau, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AcceptFile("10.0.0.2", offer.Id); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if jobs := b.Transfers(); len(jobs) != 1 || jobs[0].State != JobPaused || jobs[0].Sent != 0 {
+		t.Fatalf("wrong jobs %+v", jobs)
+	}
+
+	if err := run(trsm, id); err != nil {
+		t.Fatal(err)
+	}
+	if job := expectProgress(t, subB, id, JobDone); job.Sent != job.Size {
+		t.Fatalf("wrong progress %+v", job)
+	}
+	expectEvent(t, subA, "File")
+	if got, _ := os.ReadFile(filepath.Join(a.Downloads, Fingerprint(b.Identity.Public), "file")); !bytes.Equal(got, data) {
+		t.Fatal("received file differs")
+	}
+	if jobs := b.Transfers(); len(jobs) != 0 {
+		t.Fatalf("finished jobs are listed %+v", jobs)
+	}
+
+	// Canceled job makes peer drop the offered file
+	job, err := b.StartTransfer(pb, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, subA, "FileOffer")
+	if err := run(tcan, job.Id); err != nil {
+		t.Fatal(err)
+	}
+	expectProgress(t, subB, job.Id, JobCanceled)
+	if msg := expectEvent(t, subA, "FileCanceled"); msg.Data != "file" {
+		t.Fatalf("wrong event %+v", msg)
+	}
+	if _, ok := a.transfers.pending(transferKey("10.0.0.2", offer.Id)); ok {
+		t.Fatal("canceled file is still offered")
+	}
+	if err := run(tcan, job.Id); err != ErrUnknownJob {
+		t.Fatalf("expected %v, got %v", ErrUnknownJob, err)
+	}
+
+	// Progress is passed to managers with PROG
+	if err := manager.SendProgress(`{"Id":"job"}`); err != nil {
+		t.Fatal(err)
+	}
+	if got := expectResponse(t, responses, prog); string(got) != `{"Id":"job"}` {
+		t.Fatalf("wrong progress %q", got)
+	}
+}
+
+func TestChunkTurns(t *testing.T) {
+	network := CreateMemoryNetwork()
+	a, b := testHost(t, "a", network.Transport("10.0.0.1")), testHost(t, "b", network.Transport("10.0.0.2"))
+	a.Downloads = t.TempDir()
+	subA := a.Events.Subscribe()
+	pa, pb := connectHosts(t, a, b, "10.0.0.1:7000")
+	defer pa.Close()
+	defer pb.Close()
+	waitFeature(t, pb, featureTransfer)
+	a.Files.AutoAccept = []string{Fingerprint(b.Identity.Public)}
+
+	src := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(src, bytes.Repeat([]byte("data"), 1000), 0600)
+
+	// Chunk of another transfer is being sent
+	slot := pb.chunkSlot()
+	slot <- struct{}{}
+	result := make(chan error, 1)
+	go func() { result <- b.SendFile(pb, src) }()
+	for i := 0; len(b.Transfers()) == 0; i++ {
+		if i == 100 {
+			t.Fatal("transfer isn't started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Messages don't wait for the whole file
+	if err := sendCommand(pb, send, []byte("between chunks")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectEvent(t, subA, "Message"); msg.Data != "between chunks" {
+		t.Fatalf("wrong message %+v", msg)
+	}
+	if jobs := b.Transfers(); len(jobs) != 1 || jobs[0].Sent != 0 {
+		t.Fatalf("chunk is sent out of turn %+v", jobs)
+	}
+
+	<-slot
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("file transfer isn't finished")
+	}
+}
@@ -3,8 +3,7 @@ package proto
 import (
 	"encoding/json"
 	"errors"
-	"os"
-	"path/filepath"
+	"strings"
 )
 
 /*
@@ -13,30 +12,66 @@ command name must consist of 4 bytes
 all commands declarated in proto/commands.go
 commands:
 
-CONN ip    - initiate connection with peer
-LIST       - request for peer list
-SEND msg   - send message to peer with appropriate ip address
-FILE path  - send file to peer with appropriate ip address
-SEEK login - request for peers with appropriate login
-QUIT       - quit
+AUTH token   - authenticate manager, the first command if token is set
+CONN addr    - initiate session with peer, session id is ip of peer
+DISC id      - close session with peer
+SESS         - request for active sessions
+LIST         - request for peer list
+SEND id msg  - send text message to peer of session id
+MESG id data - send message with content type and reply-to to peer of session id
+READ id mid  - send read receipt for message mid to peer of session id
+RSND id msg  - send message to known peer id through relays
+FILE id path - send file to peer of session id in background
+TRNS         - request for active transfer jobs
+TPAU job     - pause transfer job
+TRSM job     - resume paused transfer job
+TCAN job     - cancel transfer job
+FACC id tid  - accept file tid offered by peer of session id
+FREJ id tid  - reject file tid offered by peer of session id
+OUTB         - request for items queued for offline peers
+OUTB id      - request for items queued for peer id
+OCAN id item - cancel item queued for peer id
+GNEW name    - create group
+GINV gid id  - invite peer of session id to group gid owned by host
+GACC gid     - join group gid the host is invited to
+GREJ gid     - decline invitation to group gid
+GSND gid msg - send message to every member of group gid
+GLEA gid     - leave group gid
+GRPS         - request for groups
+SEEK login   - request for peers with appropriate login
+KEYS         - request for pinned identity keys
+KVER ip fp   - check pinned key of peer against fingerprint fp
+KPIN ip      - re-pin key of peer with the key it offered last time
+VRFY ip      - request for safety number of the session with peer
+VRFY ip sn   - mark peer as verified if safety number sn matches
+QUIT         - quit
 
-RELI data  - response for LIST request
-RESE data  - response for SEEK request
-REER data  - response with error
+RESD data    - response for SEND, MESG, RSND and GSND requests with sent or queued message
+REOB data    - response for OUTB request
+RETR data    - response for FILE and TRNS requests with transfer jobs
+PROG data    - progress of transfer job
+RESS data    - response for SESS request
+REGR data    - response for GNEW, GACC and GRPS requests
+RELI data    - response for LIST request
+RESE data    - response for SEEK request
+REKE data    - response for KEYS and KVER requests
+REVR data    - response for VRFY request
+REAU         - response for successful AUTH request
+REER data    - response with error
 
 */
 
-const fileBufReserved = 1024
-
 type Manager struct {
 	Conn     *Conn
-	Peer     *Peer
 	Commands *CommandParser
 }
 
-type File struct {
-	Name string
-	Data []byte
+type Verification struct {
+	Addr         string
+	Login        string
+	Fingerprint  string
+	SafetyNumber string
+	Verified     bool
 }
 
 type ManagerHandler func(*Host, *Manager, []byte) error
@@ -47,9 +82,33 @@ func managerCommands() *CommandParser {
 	parser := CreateCommandParser(func(i interface{}) bool { _, ok := i.(ManagerHandler); return ok })
 	parser.AddCommand(conn, ManagerHandler(managerConnHandler))
 	parser.AddCommand(disc, ManagerHandler(managerDiscHandler))
+	parser.AddCommand(sess, ManagerHandler(managerSessHandler))
 	parser.AddCommand(list, ManagerHandler(managerListHandler))
+	parser.AddCommand(seek, ManagerHandler(managerSeekHandler))
 	parser.AddCommand(send, ManagerHandler(managerSendHandler))
+	parser.AddCommand(mesg, ManagerHandler(managerMesgHandler))
+	parser.AddCommand(read, ManagerHandler(managerReadHandler))
+	parser.AddCommand(rsnd, ManagerHandler(managerRsndHandler))
 	parser.AddCommand(file, ManagerHandler(managerFileHandler))
+	parser.AddCommand(outb, ManagerHandler(managerOutbHandler))
+	parser.AddCommand(ocan, ManagerHandler(managerOcanHandler))
+	parser.AddCommand(trns, ManagerHandler(managerTrnsHandler))
+	parser.AddCommand(tpau, ManagerHandler(managerTpauHandler))
+	parser.AddCommand(trsm, ManagerHandler(managerTrsmHandler))
+	parser.AddCommand(tcan, ManagerHandler(managerTcanHandler))
+	parser.AddCommand(facc, ManagerHandler(managerFaccHandler))
+	parser.AddCommand(frej, ManagerHandler(managerFrejHandler))
+	parser.AddCommand(gnew, ManagerHandler(managerGnewHandler))
+	parser.AddCommand(ginv, ManagerHandler(managerGinvHandler))
+	parser.AddCommand(gsnd, ManagerHandler(managerGsndHandler))
+	parser.AddCommand(glea, ManagerHandler(managerGleaHandler))
+	parser.AddCommand(grps, ManagerHandler(managerGrpsHandler))
+	parser.AddCommand(gacc, ManagerHandler(managerGaccHandler))
+	parser.AddCommand(grej, ManagerHandler(managerGrejHandler))
+	parser.AddCommand(keys, ManagerHandler(managerKeysHandler))
+	parser.AddCommand(kver, ManagerHandler(managerKverHandler))
+	parser.AddCommand(kpin, ManagerHandler(managerKpinHandler))
+	parser.AddCommand(vrfy, ManagerHandler(managerVrfyHandler))
 	parser.AddCommand(quit, ManagerHandler(managerQuitHandler))
 	return parser
 }
@@ -58,38 +117,76 @@ func (manager *Manager) SendMessage(msg []byte) error {
 	return sendCommand(manager.Conn, send, msg)
 }
 
-func managerConnHandler(host *Host, manager *Manager, data []byte) error {
-	conn, err := Dial("tcp", string(data))
+// SendProgress sends progress of transfer job to manager.
+func (manager *Manager) SendProgress(progress string) error {
+	return sendCommand(manager.Conn, prog, []byte(progress))
+}
+
+// splitArg splits data into the first argument and the rest.
+func splitArg(cmd Command, data []byte) (string, []byte, error) {
+	args := strings.SplitN(string(data), " ", 2)
+	if len(args) != 2 {
+		return "", nil, wrongCommandData(cmd)
+	}
+	return args[0], []byte(args[1]), nil
+}
+
+// sessionArg returns peer of session with id from the first argument and the
+// rest of data.
+func sessionArg(host *Host, cmd Command, data []byte) (*Peer, []byte, error) {
+	id, rest, err := splitArg(cmd, data)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	peer, err := host.Session(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return peer, rest, nil
+}
+
+// outboxPeer returns session of peer id, or nil if items for peer must be
+// queued. Queued items go first, so messages keep their order.
+func outboxPeer(host *Host, id string) (*Peer, error) {
+	peer, err := host.Session(id)
+	if err == nil && host.Outbox.Len(id) == 0 {
+		return peer, nil
+	}
+	if _, ok := host.Peers.Get(id); err != nil && !ok {
+		return nil, err
 	}
+	return nil, nil
+}
 
-	if manager.Peer != nil {
-		manager.Peer.Close()
+func managerConnHandler(host *Host, manager *Manager, data []byte) error {
+	addr := strings.TrimSpace(string(data))
+	if host.hasSession(addrIP(addr)) {
+		return ErrSessionExists
 	}
 
-	manager.Peer, err = host.DialPeer(conn)
+	conn, err := host.Transport.Dial(addr)
 	if err != nil {
 		return err
 	}
 
-	go func() {
-		host.Commands.CommandLoop(manager.Peer, func(handler interface{}, arg []byte) error {
-			h := handler.(PeerHandler)
-			return h(host, manager.Peer, arg)
-		})
-	}()
+	peer, err := host.DialPeer(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
 
-	sendCommand(manager.Peer, info, nil)
+	host.StartSession(peer)
 	return nil
 }
 
 func managerDiscHandler(host *Host, manager *Manager, data []byte) error {
-	if manager.Peer != nil {
-		manager.Peer.Close()
-		manager.Peer = nil
-	}
-	return nil
+	return host.CloseSession(strings.TrimSpace(string(data)))
+}
+
+func managerSessHandler(host *Host, manager *Manager, data []byte) error {
+	js, _ := json.Marshal(host.Sessions())
+	return sendCommand(manager.Conn, ress, js)
 }
 
 func managerListHandler(host *Host, manager *Manager, data []byte) error {
@@ -97,55 +194,312 @@ func managerListHandler(host *Host, manager *Manager, data []byte) error {
 	return sendCommand(manager.Conn, reli, js)
 }
 
+func managerSeekHandler(host *Host, manager *Manager, data []byte) error {
+	js, _ := json.Marshal(host.Peers.ByLogin(strings.TrimSpace(string(data))))
+	return sendCommand(manager.Conn, rese, js)
+}
+
 func managerSendHandler(host *Host, manager *Manager, data []byte) error {
-	if manager.Peer == nil {
-		return errors.New("can't send to unknown peer")
+	id, msg, err := splitArg(send, data)
+	if err != nil {
+		return err
 	}
 
-	return sendCommand(manager.Peer, send, data)
+	env, err := CreateEnvelope(string(msg), "", "")
+	if err != nil {
+		return err
+	}
+	return sendEnvelope(host, manager, id, env)
 }
 
-func managerFileHandler(host *Host, manager *Manager, data []byte) error {
-	if manager.Peer == nil {
-		return errors.New("can't send to unknown peer")
+func managerMesgHandler(host *Host, manager *Manager, data []byte) error {
+	id, js, err := splitArg(mesg, data)
+	if err != nil {
+		return err
 	}
 
-	fd, err := os.Open(string(data))
+	msg := &Envelope{}
+	err = json.Unmarshal(js, msg)
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
 
-	stat, err := fd.Stat()
+	env, err := CreateEnvelope(msg.Data, msg.ContentType, msg.ReplyTo)
 	if err != nil {
 		return err
 	}
+	return sendEnvelope(host, manager, id, env)
+}
 
-	chunkSize := int64(((MaxPacketSize - CommandLength - fileBufReserved) * 3) / 4)
-	chunks := stat.Size() / chunkSize
-	if stat.Size()%chunkSize != 0 {
-		chunks++
+// sendEnvelope sends envelope to peer id or queues it if the peer is offline.
+func sendEnvelope(host *Host, manager *Manager, id string, env *Envelope) error {
+	peer, err := outboxPeer(host, id)
+	if err != nil {
+		return err
 	}
 
-	fstruct := File{
-		Name: filepath.Base(string(data)),
-	}
-	buf := make([]byte, chunkSize)
-	for ; chunks > 0; chunks-- {
-		n, err := fd.Read(buf)
+	var sent Message
+	if peer == nil {
+		err = host.Queue(id, QueueMessage(env))
 		if err != nil {
 			return err
 		}
-		fstruct.Data = buf[:n]
-		js, _ := json.Marshal(fstruct)
-		err = sendCommand(manager.Peer, file, js)
+		sent = env.message("Queued")
+		sent.Peer = id
+		if peer, err := host.Session(id); err == nil {
+			go host.flushOutbox(id, peer)
+		}
+	} else {
+		err = host.SendEnvelope(peer, env)
 		if err != nil {
 			return err
 		}
+		sent = host.recordSent(id, env)
+	}
+
+	js, _ := json.Marshal(sent)
+	return sendCommand(manager.Conn, resd, js)
+}
+
+func managerReadHandler(host *Host, manager *Manager, data []byte) error {
+	peer, id, err := sessionArg(host, read, data)
+	if err != nil {
+		return err
+	}
+	if !peer.HasFeature(featureEnvelope) {
+		return errors.New("peer doesn't support receipts")
+	}
+	return sendReceipt(peer, strings.TrimSpace(string(id)), ReceiptRead)
+}
+
+func managerRsndHandler(host *Host, manager *Manager, data []byte) error {
+	id, msg, err := splitArg(rsnd, data)
+	if err != nil {
+		return err
+	}
+
+	env, err := CreateEnvelope(string(msg), "", "")
+	if err != nil {
+		return err
+	}
+	err = host.SendRelayed(id, env)
+	if err != nil {
+		return err
+	}
+
+	sent := host.recordSent(id, env)
+	sent.Type = "Relayed"
+	js, _ := json.Marshal(sent)
+	return sendCommand(manager.Conn, resd, js)
+}
+
+func managerFileHandler(host *Host, manager *Manager, data []byte) error {
+	id, path, err := splitArg(file, data)
+	if err != nil {
+		return err
+	}
+
+	peer, err := outboxPeer(host, id)
+	if err != nil {
+		return err
+	}
+	if peer != nil {
+		job, err := host.StartTransfer(peer, string(path))
+		if err != nil {
+			return err
+		}
+		js, _ := json.Marshal([]*TransferJob{job})
+		return sendCommand(manager.Conn, retr, js)
+	}
+
+	item, err := QueueFile(string(path))
+	if err != nil {
+		return err
+	}
+	err = host.Queue(id, item)
+	if err != nil {
+		return err
+	}
+	if peer, err := host.Session(id); err == nil {
+		go host.flushOutbox(id, peer)
 	}
 	return nil
 }
 
+func managerOutbHandler(host *Host, manager *Manager, data []byte) error {
+	js, _ := json.Marshal(host.Outbox.Items(strings.TrimSpace(string(data))))
+	return sendCommand(manager.Conn, reob, js)
+}
+
+func managerOcanHandler(host *Host, manager *Manager, data []byte) error {
+	args := strings.Fields(string(data))
+	if len(args) != 2 {
+		return wrongCommandData(ocan)
+	}
+	return host.Outbox.Cancel(args[0], args[1])
+}
+
+func managerTrnsHandler(host *Host, manager *Manager, data []byte) error {
+	js, _ := json.Marshal(host.Transfers())
+	return sendCommand(manager.Conn, retr, js)
+}
+
+func managerTpauHandler(host *Host, manager *Manager, data []byte) error {
+	return host.PauseTransfer(strings.TrimSpace(string(data)))
+}
+
+func managerTrsmHandler(host *Host, manager *Manager, data []byte) error {
+	return host.ResumeTransfer(strings.TrimSpace(string(data)))
+}
+
+func managerTcanHandler(host *Host, manager *Manager, data []byte) error {
+	return host.CancelTransfer(strings.TrimSpace(string(data)))
+}
+
+func managerFaccHandler(host *Host, manager *Manager, data []byte) error {
+	args := strings.Fields(string(data))
+	if len(args) != 2 {
+		return wrongCommandData(facc)
+	}
+	return host.AcceptFile(args[0], args[1])
+}
+
+func managerFrejHandler(host *Host, manager *Manager, data []byte) error {
+	args := strings.Fields(string(data))
+	if len(args) != 2 {
+		return wrongCommandData(frej)
+	}
+	return host.RejectFile(args[0], args[1])
+}
+
+func managerGnewHandler(host *Host, manager *Manager, data []byte) error {
+	name := strings.TrimSpace(string(data))
+	if name == "" {
+		return wrongCommandData(gnew)
+	}
+
+	group, err := host.Groups.Create(name)
+	if err != nil {
+		return err
+	}
+	js, _ := json.Marshal([]*Group{group})
+	return sendCommand(manager.Conn, regr, js)
+}
+
+func managerGinvHandler(host *Host, manager *Manager, data []byte) error {
+	args := strings.Fields(string(data))
+	if len(args) != 2 {
+		return wrongCommandData(ginv)
+	}
+	return host.InviteToGroup(args[0], args[1])
+}
+
+func managerGsndHandler(host *Host, manager *Manager, data []byte) error {
+	args := strings.SplitN(string(data), " ", 2)
+	if len(args) != 2 {
+		return wrongCommandData(gsnd)
+	}
+
+	env, err := CreateEnvelope(args[1], "", "")
+	if err != nil {
+		return err
+	}
+	unreachable, err := host.SendGroup(args[0], env)
+	if err != nil {
+		return err
+	}
+
+	sent := env.message("Sent")
+	sent.Group = args[0]
+	js, _ := json.Marshal(sent)
+	err = sendCommand(manager.Conn, resd, js)
+	if err != nil {
+		return err
+	}
+	return unreachableError(unreachable)
+}
+
+func managerGleaHandler(host *Host, manager *Manager, data []byte) error {
+	return host.LeaveGroup(strings.TrimSpace(string(data)))
+}
+
+func managerGrpsHandler(host *Host, manager *Manager, data []byte) error {
+	js, _ := json.Marshal(host.Groups.All())
+	return sendCommand(manager.Conn, regr, js)
+}
+
+func managerGaccHandler(host *Host, manager *Manager, data []byte) error {
+	group, err := host.AcceptGroup(strings.TrimSpace(string(data)))
+	if err != nil {
+		return err
+	}
+	js, _ := json.Marshal([]*Group{group})
+	return sendCommand(manager.Conn, regr, js)
+}
+
+func managerGrejHandler(host *Host, manager *Manager, data []byte) error {
+	return host.DeclineGroup(strings.TrimSpace(string(data)))
+}
+
+func managerKeysHandler(host *Host, manager *Manager, data []byte) error {
+	js, _ := json.Marshal(host.Pins)
+	return sendCommand(manager.Conn, reke, js)
+}
+
+func managerKverHandler(host *Host, manager *Manager, data []byte) error {
+	args := strings.Fields(string(data))
+	if len(args) != 2 {
+		return wrongCommandData(kver)
+	}
+
+	pin, err := host.Pins.Verify(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	js, _ := json.Marshal(map[string]*Pin{args[0]: pin})
+	return sendCommand(manager.Conn, reke, js)
+}
+
+func managerKpinHandler(host *Host, manager *Manager, data []byte) error {
+	return host.Pins.Repin(strings.TrimSpace(string(data)))
+}
+
+func managerVrfyHandler(host *Host, manager *Manager, data []byte) error {
+	args := strings.SplitN(strings.TrimSpace(string(data)), " ", 2)
+	peer, ok := host.Peers.Get(args[0])
+	if !ok || peer.SafetyNumber == "" {
+		return errors.New("no session with peer " + args[0])
+	}
+
+	if len(args) == 2 {
+		if !CompareSafetyNumbers(peer.SafetyNumber, args[1]) {
+			return ErrSafetyNumber
+		}
+		// Session may be renewed since safety number was read
+		var stored *Peer
+		host.Peers.Update(args[0], func(known *Peer) {
+			if known.SafetyNumber == peer.SafetyNumber {
+				known.Verified = true
+				stored = known.record()
+			}
+		})
+		if stored == nil {
+			return ErrSessionRenewed
+		}
+		peer = stored
+	}
+
+	js, _ := json.Marshal(Verification{
+		Addr:         peer.Addr,
+		Login:        peer.Login,
+		Fingerprint:  Fingerprint(peer.Key),
+		SafetyNumber: peer.SafetyNumber,
+		Verified:     peer.Verified,
+	})
+	return sendCommand(manager.Conn, revr, js)
+}
+
 func managerQuitHandler(host *Host, manager *Manager, data []byte) error {
 	host.Quit <- true
 	return nil
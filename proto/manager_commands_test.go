@@ -0,0 +1,159 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// runManager executes manager command on host.
+func runManager(t *testing.T, host *Host, manager *Manager, cmd Command, data string) error {
+	t.Helper()
+	handler, arg, err := manager.Commands.GetHandler(packCommand(cmd, []byte(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler.(ManagerHandler)(host, manager, arg)
+}
+
+func TestManagerKeyHandlers(t *testing.T) {
+	host := testHost(t, "a", nil)
+	host.Pins = CreatePinStore(nil)
+	pinned, offered := testIdentity(t).Public, testIdentity(t).Public
+	host.Pins.Check("10.0.0.2", "b", pinned)
+	host.Pins.Check("10.0.0.2", "b", offered)
+	manager, responses := testManager(t)
+
+	tests := []struct {
+		cmd  Command
+		data string
+		err  error
+		pins []string
+	}{
+		{keys, "", nil, []string{"10.0.0.2"}},
+		{kver, "10.0.0.2 " + Fingerprint(pinned), nil, []string{"10.0.0.2"}},
+		{kver, "10.0.0.2 " + Fingerprint(offered), ErrFingerprintMatch, nil},
+		{kver, "10.0.0.3 " + Fingerprint(pinned), ErrUnknownPin, nil},
+		{kver, "10.0.0.2", wrongCommandData(kver), nil},
+		{kpin, "10.0.0.3", ErrUnknownPin, nil},
+		{kpin, "10.0.0.2", nil, nil},
+		{kver, "10.0.0.2 " + Fingerprint(offered), nil, []string{"10.0.0.2"}},
+	}
+	for _, test := range tests {
+		err := runManager(t, host, manager, test.cmd, test.data)
+		if (err == nil) != (test.err == nil) || err != nil && err.Error() != test.err.Error() {
+			t.Fatalf("%s %s: expected %v, got %v", test.cmd[:], test.data, test.err, err)
+		}
+		if test.pins == nil {
+			continue
+		}
+
+		pins := map[string]*Pin{}
+		if err := json.Unmarshal(expectResponse(t, responses, reke), &pins); err != nil {
+			t.Fatal(err)
+		}
+		if len(pins) != len(test.pins) || pins[test.pins[0]] == nil {
+			t.Fatalf("%s %s: wrong pins %v", test.cmd[:], test.data, pins)
+		}
+	}
+
+	if pin, _ := host.Pins.Get("10.0.0.2"); !bytes.Equal(pin.Key, offered) {
+		t.Fatal("offered key isn't pinned")
+	}
+}
+
+func TestManagerVrfyHandler(t *testing.T) {
+	network := CreateMemoryNetwork()
+	a, b := testHost(t, "a", network.Transport("10.0.0.1")), testHost(t, "b", network.Transport("10.0.0.2"))
+	a.Pins = CreatePinStore(nil)
+	serveHost(t, a, "10.0.0.1:7000")
+	defer a.Disconnect()
+	manager, responses := testManager(t)
+
+	peer := dialSession(t, b, "10.0.0.1:7000")
+	verify := func(data string) Verification {
+		t.Helper()
+		if err := runManager(t, a, manager, vrfy, data); err != nil {
+			t.Fatal(err)
+		}
+		verification := Verification{}
+		json.Unmarshal(expectResponse(t, responses, revr), &verification)
+		return verification
+	}
+
+	// Both sides see the same safety number
+	if v := verify("10.0.0.2"); v.SafetyNumber != peer.SafetyNumber || v.Verified ||
+		v.Fingerprint != Fingerprint(b.Identity.Public) {
+		t.Fatalf("wrong verification %+v", v)
+	}
+
+	tests := []struct {
+		data string
+		err  error
+	}{
+		{"10.0.0.2 " + SafetyNumber(a.Identity.Public, b.Identity.Public, []byte("other")), ErrSafetyNumber},
+		{"10.0.0.2 12345", ErrSafetyNumber},
+		{"10.0.0.3 " + peer.SafetyNumber, errors.New("no session with peer 10.0.0.3")},
+	}
+	for _, test := range tests {
+		err := runManager(t, a, manager, vrfy, test.data)
+		if err == nil || err.Error() != test.err.Error() {
+			t.Fatalf("%q: expected %v, got %v", test.data, test.err, err)
+		}
+	}
+	if known, _ := a.Peers.Get("10.0.0.2"); known.Verified {
+		t.Fatal("peer is verified with wrong safety number")
+	}
+
+	if v := verify("10.0.0.2 " + peer.SafetyNumber); !v.Verified {
+		t.Fatalf("wrong verification %+v", v)
+	}
+	if known, _ := a.Peers.Get("10.0.0.2"); !known.Verified {
+		t.Fatal("verification isn't stored")
+	}
+	peer.Close()
+
+	// Changed key is refused until it's re-pinned, then verification is reset
+	b.Identity = testIdentity(t)
+	waitKey := func(check func() bool) {
+		t.Helper()
+		for i := 0; !check(); i++ {
+			if i == 100 {
+				t.Fatal("handshake with changed key isn't finished")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if conn, err := b.Transport.Dial("10.0.0.1:7000"); err == nil {
+		go func() {
+			if peer, err := b.DialPeer(conn); err == nil {
+				peer.Close()
+			}
+		}()
+	}
+	waitKey(func() bool {
+		pin, _ := a.Pins.Get("10.0.0.2")
+		return pin.Offered != nil
+	})
+	if known, _ := a.Peers.Get("10.0.0.2"); !known.Verified {
+		t.Fatal("refused handshake changed verification")
+	}
+
+	if err := runManager(t, a, manager, kpin, "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	peer = dialSession(t, b, "10.0.0.1:7000")
+	defer peer.Close()
+	waitKey(func() bool {
+		known, _ := a.Peers.Get("10.0.0.2")
+		return bytes.Equal(known.Key, b.Identity.Public)
+	})
+	if known, _ := a.Peers.Get("10.0.0.2"); known.Verified {
+		t.Fatal("verification is kept for changed key")
+	}
+	if v := verify("10.0.0.2"); v.Verified || v.SafetyNumber != peer.SafetyNumber {
+		t.Fatalf("wrong verification %+v", v)
+	}
+}
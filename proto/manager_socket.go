@@ -0,0 +1,68 @@
+package proto
+
+import (
+	"crypto/subtle"
+	"errors"
+	"os"
+)
+
+var (
+	ErrManagerAuth = errors.New("manager authentication failed")
+	ErrSocketPerm  = errors.New("manager socket is accessible by other users")
+)
+
+// ListenManager listens Unix socket for managers. Socket is accessible only
+// by the owner, connections of other users are rejected by CheckManager too.
+func ListenManager(path string) (*Listener, error) {
+	ln, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, 0600)
+	if err == nil {
+		err = checkSocketPerm(path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func checkSocketPerm(path string) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if stat.Mode().Perm()&0077 != 0 {
+		return ErrSocketPerm
+	}
+	return nil
+}
+
+// CheckManager checks that manager runs under the same user and, if token is
+// set, that manager starts with AUTH token.
+func (host *Host) CheckManager(conn *Conn) error {
+	err := checkPeerUser(conn)
+	if err != nil {
+		return err
+	}
+
+	if host.ManagerToken == "" {
+		return nil
+	}
+
+	buf, err := conn.ReadPackage()
+	if err != nil {
+		return err
+	}
+
+	var cmd Command
+	copy(cmd[:], buf)
+	if cmd != auth || subtle.ConstantTimeCompare(buf[CommandLength:], []byte(host.ManagerToken)) != 1 {
+		sendCommand(conn, reer, []byte(ErrManagerAuth.Error()))
+		return ErrManagerAuth
+	}
+	return sendCommand(conn, reau, nil)
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package proto
+
+func listenPrivate(path string) (*Listener, error) {
+	return UnixTransport{}.Listen(path)
+}
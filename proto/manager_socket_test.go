@@ -0,0 +1,85 @@
+package proto
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// connectManager connects to manager socket and returns both ends.
+func connectManager(t *testing.T) (*Conn, *Conn) {
+	path := filepath.Join(t.TempDir(), "manager.sock")
+	ln, err := ListenManager(path)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Fatalf("expected socket permissions 0600, got %o", stat.Mode().Perm())
+	}
+
+	client, err := UnixTransport{}.Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestCheckManager(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		auth  []byte
+		err   error
+		reply Command
+	}{
+		{"without token", "", nil, nil, Command{}},
+		{"right token", "secret", packCommand(auth, []byte("secret")), nil, reau},
+		{"wrong token", "secret", packCommand(auth, []byte("secreT")), ErrManagerAuth, reer},
+		{"token prefix", "secret", packCommand(auth, []byte("sec")), ErrManagerAuth, reer},
+		{"other command", "secret", packCommand(list, nil), ErrManagerAuth, reer},
+		{"short command", "secret", []byte("AU"), ErrManagerAuth, reer},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := connectManager(t)
+			host := &Host{ManagerToken: test.token}
+
+			if test.auth != nil {
+				go client.WritePackage(test.auth)
+			}
+
+			err := host.CheckManager(server)
+			if err != test.err {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+			if test.auth == nil {
+				return
+			}
+
+			buf, err := client.ReadPackage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var cmd Command
+			copy(cmd[:], buf)
+			if cmd != test.reply {
+				t.Fatalf("expected %s, got %s", test.reply[:], cmd[:])
+			}
+		})
+	}
+}
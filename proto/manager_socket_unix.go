@@ -0,0 +1,14 @@
+//go:build unix
+
+package proto
+
+import "golang.org/x/sys/unix"
+
+// listenPrivate creates socket under restrictive umask, so it's never
+// accessible by other users. Umask is process wide, files created meanwhile
+// only get stricter permissions.
+func listenPrivate(path string) (*Listener, error) {
+	old := unix.Umask(0077)
+	defer unix.Umask(old)
+	return UnixTransport{}.Listen(path)
+}
@@ -0,0 +1,372 @@
+package proto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	OutboxMessage = "message"
+	OutboxFile    = "file"
+)
+
+// OutboxLimits bounds items queued for one peer. Zero value disables limit.
+type OutboxLimits struct {
+	MaxAge  time.Duration
+	MaxSize int64
+}
+
+var DefaultOutboxLimits = OutboxLimits{
+	MaxAge:  7 * 24 * time.Hour,
+	MaxSize: 64 << 20,
+}
+
+// OutboxItem is a message or a file waiting for session with peer. Files are
+// read when they're sent, so Size of file is its size at queueing time.
+type OutboxItem struct {
+	Id       string
+	Kind     string
+	Envelope *Envelope `json:",omitempty"`
+	Path     string    `json:",omitempty"`
+	Size     int64
+	Queued   time.Time
+}
+
+// Outbox keeps undelivered items per peer session id. Items are sent in the
+// order they were queued once peer answers INFO.
+type Outbox struct {
+	mutex    sync.Mutex
+	items    map[string][]*OutboxItem
+	flushing map[string]bool
+	dialing  map[string]bool
+	Limits   OutboxLimits
+	OnChange func()
+}
+
+var (
+	ErrOutboxFull   = errors.New("outbox of peer is full")
+	ErrUnknownItem  = errors.New("no such item in outbox")
+	ErrOutboxNoFile = errors.New("queued path isn't a regular file")
+)
+
+func CreateOutbox(items map[string][]*OutboxItem, limits OutboxLimits) *Outbox {
+	if items == nil {
+		items = make(map[string][]*OutboxItem)
+	}
+	return &Outbox{
+		items:    items,
+		flushing: make(map[string]bool),
+		dialing:  make(map[string]bool),
+		Limits:   limits,
+	}
+}
+
+func QueueMessage(env *Envelope) *OutboxItem {
+	return &OutboxItem{
+		Id:       env.Id,
+		Kind:     OutboxMessage,
+		Envelope: env,
+		Size:     int64(len(env.Data)),
+	}
+}
+
+func QueueFile(path string) (*OutboxItem, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		return nil, ErrOutboxNoFile
+	}
+
+	buf := make([]byte, 16)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboxItem{
+		Id:   hex.EncodeToString(buf),
+		Kind: OutboxFile,
+		Path: path,
+		Size: stat.Size(),
+	}, nil
+}
+
+// Add queues item for peer and returns items dropped because of their age.
+func (ob *Outbox) Add(peer string, item *OutboxItem) ([]*OutboxItem, error) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	expired := ob.expire(peer, time.Now())
+
+	var size int64
+	for _, queued := range ob.items[peer] {
+		size += queued.Size
+	}
+	if ob.Limits.MaxSize > 0 && size+item.Size > ob.Limits.MaxSize {
+		return expired, ErrOutboxFull
+	}
+
+	item.Queued = time.Now()
+	ob.items[peer] = append(ob.items[peer], item)
+	ob.changed()
+	return expired, nil
+}
+
+// Items returns items queued for peer, all peers are listed for empty peer.
+func (ob *Outbox) Items(peer string) map[string][]*OutboxItem {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	items := make(map[string][]*OutboxItem)
+	for p, queued := range ob.items {
+		if peer != "" && p != peer {
+			continue
+		}
+		for _, item := range queued {
+			cpy := *item
+			items[p] = append(items[p], &cpy)
+		}
+	}
+	return items
+}
+
+func (ob *Outbox) Len(peer string) int {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+	return len(ob.items[peer])
+}
+
+func (ob *Outbox) Cancel(peer, id string) error {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	if !ob.remove(peer, id) {
+		return ErrUnknownItem
+	}
+	ob.changed()
+	return nil
+}
+
+func (ob *Outbox) MarshalJSON() ([]byte, error) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+	return json.Marshal(ob.items)
+}
+
+func (ob *Outbox) UnmarshalJSON(data []byte) error {
+	items := make(map[string][]*OutboxItem)
+	err := json.Unmarshal(data, &items)
+	if err != nil {
+		return err
+	}
+	for peer, queued := range items {
+		valid := queued[:0]
+		for _, item := range queued {
+			if item != nil && (item.Envelope != nil || item.Kind == OutboxFile) {
+				valid = append(valid, item)
+			}
+		}
+		items[peer] = valid
+	}
+
+	ob.mutex.Lock()
+	ob.items = items
+	ob.mutex.Unlock()
+	return nil
+}
+
+// next returns the first item queued for peer, expired items are dropped.
+func (ob *Outbox) next(peer string) (*OutboxItem, []*OutboxItem) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	expired := ob.expire(peer, time.Now())
+	if len(ob.items[peer]) == 0 {
+		return nil, expired
+	}
+	return ob.items[peer][0], expired
+}
+
+func (ob *Outbox) sent(peer, id string) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	if ob.remove(peer, id) {
+		ob.changed()
+	}
+}
+
+// acquire marks peer in set, so flushing and dialing are done once at a time.
+func (ob *Outbox) acquire(set map[string]bool, peer string) bool {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	if set[peer] {
+		return false
+	}
+	set[peer] = true
+	return true
+}
+
+func (ob *Outbox) release(set map[string]bool, peer string) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+	delete(set, peer)
+}
+
+func (ob *Outbox) expire(peer string, now time.Time) []*OutboxItem {
+	if ob.Limits.MaxAge <= 0 {
+		return nil
+	}
+
+	var expired []*OutboxItem
+	queued := ob.items[peer]
+	for len(queued) > 0 && now.Sub(queued[0].Queued) > ob.Limits.MaxAge {
+		expired = append(expired, queued[0])
+		queued = queued[1:]
+	}
+	if len(expired) > 0 {
+		ob.setItems(peer, queued)
+		ob.changed()
+	}
+	return expired
+}
+
+func (ob *Outbox) remove(peer, id string) bool {
+	queued := ob.items[peer]
+	for i, item := range queued {
+		if item.Id == id {
+			rest := append([]*OutboxItem(nil), queued[:i]...)
+			ob.setItems(peer, append(rest, queued[i+1:]...))
+			return true
+		}
+	}
+	return false
+}
+
+func (ob *Outbox) setItems(peer string, items []*OutboxItem) {
+	if len(items) == 0 {
+		delete(ob.items, peer)
+	} else {
+		ob.items[peer] = items
+	}
+}
+
+func (ob *Outbox) changed() {
+	if ob.OnChange != nil {
+		go ob.OnChange()
+	}
+}
+
+// Queue puts item to outbox of peer and notifies managers about it.
+func (host *Host) Queue(peer string, item *OutboxItem) error {
+	expired, err := host.Outbox.Add(peer, item)
+	host.publishOutbox("OutboxExpired", peer, expired...)
+	if err != nil {
+		return err
+	}
+	host.publishOutbox("Queued", peer, item)
+	return nil
+}
+
+// DeliverOutbox connects to peer at addr if something is queued for it.
+// Queued items are sent when the session is up.
+func (host *Host) DeliverOutbox(ip, addr string) error {
+	if host.Outbox.Len(ip) == 0 || host.hasSession(ip) {
+		return nil
+	}
+	if !host.Outbox.acquire(host.Outbox.dialing, ip) {
+		return nil
+	}
+	defer host.Outbox.release(host.Outbox.dialing, ip)
+
+	conn, err := host.Transport.Dial(addr)
+	if err != nil {
+		return err
+	}
+	peer, err := host.DialPeer(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	host.StartSession(peer)
+	return nil
+}
+
+// flushOutbox sends items queued for session id until outbox is empty or
+// sending fails.
+func (host *Host) flushOutbox(id string, peer *Peer) {
+	for host.Outbox.acquire(host.Outbox.flushing, id) {
+		err := host.sendQueued(id, peer)
+		host.Outbox.release(host.Outbox.flushing, id)
+
+		// Item may be queued after the last one was taken
+		if err != nil || host.Outbox.Len(id) == 0 {
+			return
+		}
+	}
+}
+
+func (host *Host) sendQueued(id string, peer *Peer) error {
+	for {
+		item, expired := host.Outbox.next(id)
+		host.publishOutbox("OutboxExpired", id, expired...)
+		if item == nil {
+			return nil
+		}
+
+		var err error
+		switch item.Kind {
+		case OutboxMessage:
+			err = host.SendEnvelope(peer, item.Envelope)
+			if err == nil {
+				host.recordSent(id, item.Envelope)
+			}
+		case OutboxFile:
+			// File removed since queueing would block the outbox forever
+			if _, err = os.Stat(item.Path); err != nil {
+				log.Println(err)
+				host.Outbox.sent(id, item.Id)
+				host.publishOutbox("OutboxFailed", id, item)
+				continue
+			}
+			err = host.SendFile(peer, item.Path)
+			if err == ErrFileRejected || err == ErrFileQuota || err == ErrTransferCanceled {
+				log.Println(err)
+				host.Outbox.sent(id, item.Id)
+				host.publishOutbox("OutboxFailed", id, item)
+				continue
+			}
+		}
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		host.Outbox.sent(id, item.Id)
+		host.publishOutbox("OutboxSent", id, item)
+	}
+}
+
+func (host *Host) publishOutbox(event, peer string, items ...*OutboxItem) {
+	for _, item := range items {
+		msg := Message{
+			Type: event,
+			Id:   item.Id,
+			Peer: peer,
+			Data: item.Path,
+		}
+		if item.Envelope != nil {
+			msg.Data = item.Envelope.Data
+		}
+		js, _ := json.Marshal(msg)
+		host.Events.Publish(string(js))
+	}
+}
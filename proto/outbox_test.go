@@ -0,0 +1,157 @@
+package proto
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	ob := CreateOutbox(nil, OutboxLimits{MaxSize: 10})
+
+	first, _ := CreateEnvelope("12345", "", "")
+	second, _ := CreateEnvelope("123456", "", "")
+	if _, err := ob.Add("10.0.0.2", QueueMessage(first)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ob.Add("10.0.0.2", QueueMessage(second)); err != ErrOutboxFull {
+		t.Fatalf("expected %v, got %v", ErrOutboxFull, err)
+	}
+	if _, err := ob.Add("10.0.0.3", QueueMessage(second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if items := ob.Items(""); len(items) != 2 || len(items["10.0.0.2"]) != 1 {
+		t.Fatalf("wrong items %v", items)
+	}
+	if items := ob.Items("10.0.0.3"); len(items) != 1 || items["10.0.0.3"][0].Id != second.Id {
+		t.Fatalf("wrong items %v", items)
+	}
+
+	js, _ := json.Marshal(ob)
+	loaded := CreateOutbox(nil, OutboxLimits{})
+	if err := json.Unmarshal(js, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len("10.0.0.2") != 1 || loaded.Items("10.0.0.2")["10.0.0.2"][0].Envelope.Data != "12345" {
+		t.Fatal("outbox isn't restored")
+	}
+
+	if err := ob.Cancel("10.0.0.2", second.Id); err != ErrUnknownItem {
+		t.Fatalf("expected %v, got %v", ErrUnknownItem, err)
+	}
+	if err := ob.Cancel("10.0.0.2", first.Id); err != nil {
+		t.Fatal(err)
+	}
+	if ob.Len("10.0.0.2") != 0 {
+		t.Fatal("item isn't cancelled")
+	}
+
+	dir := t.TempDir()
+	if _, err := QueueFile(dir); err != ErrOutboxNoFile {
+		t.Fatalf("expected %v, got %v", ErrOutboxNoFile, err)
+	}
+	if _, err := QueueFile(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("missing file is queued")
+	}
+}
+
+func TestOutboxExpire(t *testing.T) {
+	ob := CreateOutbox(nil, OutboxLimits{MaxAge: time.Millisecond})
+	old, _ := CreateEnvelope("old", "", "")
+	ob.Add("10.0.0.2", QueueMessage(old))
+	time.Sleep(5 * time.Millisecond)
+
+	fresh, _ := CreateEnvelope("fresh", "", "")
+	expired, err := ob.Add("10.0.0.2", QueueMessage(fresh))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].Id != old.Id {
+		t.Fatalf("wrong expired items %v", expired)
+	}
+	if item, _ := ob.next("10.0.0.2"); item.Id != fresh.Id {
+		t.Fatal("fresh item is dropped")
+	}
+}
+
+func TestOutboxDelivery(t *testing.T) {
+	network := CreateMemoryNetwork()
+	a, b := testHost(t, "a", network.Transport("10.0.0.1")), testHost(t, "b", network.Transport("10.0.0.2"))
+	subA, subB := a.Events.Subscribe(), b.Events.Subscribe()
+	defer a.Disconnect()
+	manager, responses := testManager(t)
+	run := func(cmd Command, data string) error {
+		handler, arg, err := manager.Commands.GetHandler(packCommand(cmd, []byte(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler.(ManagerHandler)(a, manager, arg)
+	}
+
+	if err := run(send, "10.0.0.2 unknown"); err != ErrNoSession {
+		t.Fatalf("expected %v, got %v", ErrNoSession, err)
+	}
+	a.Peers.Add("10.0.0.2", &Peer{Login: "b", Addr: "10.0.0.2:7000"})
+
+	for _, msg := range []string{"first", "second"} {
+		if err := run(send, "10.0.0.2 "+msg); err != nil {
+			t.Fatal(err)
+		}
+		queued := Message{}
+		json.Unmarshal(expectResponse(t, responses, resd), &queued)
+		if queued.Type != "Queued" || queued.Data != msg || queued.Id == "" {
+			t.Fatalf("wrong response %+v", queued)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(path, []byte("data"), 0600)
+	if err := run(file, "10.0.0.2 "+path); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(outb, "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	items := map[string][]*OutboxItem{}
+	json.Unmarshal(expectResponse(t, responses, reob), &items)
+	queued := items["10.0.0.2"]
+	if len(queued) != 3 || queued[2].Kind != OutboxFile || queued[2].Size != 4 {
+		t.Fatalf("wrong items %v", items)
+	}
+	if err := run(ocan, "10.0.0.2 "+queued[2].Id); err != nil {
+		t.Fatal(err)
+	}
+
+	serveHost(t, b, "10.0.0.2:7000")
+	if err := a.DeliverOutbox("10.0.0.2", "10.0.0.2:7000"); err != nil {
+		t.Fatal(err)
+	}
+	for i, item := range queued[:2] {
+		msg := expectEvent(t, subB, "Message")
+		if msg.Id != item.Id || msg.Data != []string{"first", "second"}[i] {
+			t.Fatalf("wrong message %+v", msg)
+		}
+		if sent := expectEvent(t, subA, "OutboxSent"); sent.Id != item.Id {
+			t.Fatalf("wrong event %+v", sent)
+		}
+	}
+	if a.Outbox.Len("10.0.0.2") != 0 {
+		t.Fatal("outbox isn't flushed")
+	}
+
+	// Session is up, so messages are sent directly
+	if err := run(send, "10.0.0.2 third"); err != nil {
+		t.Fatal(err)
+	}
+	sent := Message{}
+	json.Unmarshal(expectResponse(t, responses, resd), &sent)
+	if sent.Type != "Sent" {
+		t.Fatalf("wrong response %+v", sent)
+	}
+	if msg := expectEvent(t, subB, "Message"); msg.Data != "third" {
+		t.Fatalf("wrong message %+v", msg)
+	}
+}
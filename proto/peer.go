@@ -1,31 +1,103 @@
 package proto
 
+import (
+	"crypto/ed25519"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPeerClosed is returned by closed peer. DISC handler returns it to stop
+// the command loop of session.
+var ErrPeerClosed = errors.New("peer is closed")
+
 type Peer struct {
-	Login  string
-	Addr   string
-	DifHel *DHState     `json:"-"`
-	Crypto *CryptoState `json:"-"`
-	Conn   *Conn        `json:"-"`
+	Login        string
+	Addr         string
+	Key          ed25519.PublicKey
+	Verified     bool
+	SafetyNumber string      `json:"-"`
+	DifHel       *DHState    `json:"-"`
+	Crypto       CryptoState `json:"-"`
+	Conn         *Conn       `json:"-"`
+	Rekey        RekeyPolicy `json:"-"`
+
+	mutex        sync.Mutex
+	closed       atomic.Bool
+	recCrypto    CryptoState
+	rekey        *rekeyState
+	session      session
+	sentMessages uint32
+	sentBytes    uint64
+	keyTime      time.Time
+	features     []string
+	negotiated   chan struct{}
+	chunks       chan struct{}
 }
 
 func (p *Peer) WritePackage(buf []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed.Load() {
+		return 0, ErrPeerClosed
+	}
+
+	n, err := p.writePackage(buf)
+	if err != nil {
+		return n, err
+	}
+
+	if p.Rekey.due(p.sentMessages, p.sentBytes, p.keyTime) {
+		err = p.startRekey()
+	}
+	return n, err
+}
+
+func (p *Peer) writePackage(buf []byte) (int, error) {
 	enc, err := p.Crypto.AuthAndEncrypt(buf)
 	if err != nil {
 		return 0, err
 	}
 
+	p.sentMessages++
+	p.sentBytes += uint64(len(buf))
 	return p.Conn.WritePackage(enc)
 }
 
 func (p *Peer) ReadPackage() ([]byte, error) {
+	if p.closed.Load() {
+		return nil, ErrPeerClosed
+	}
 	enc, err := p.Conn.ReadPackage()
 	if err != nil {
 		return nil, err
 	}
 
-	return p.Crypto.DecryptAndAuth(enc)
+	crypto := p.recCrypto
+	if crypto == nil {
+		crypto = p.Crypto
+	}
+	return crypto.DecryptAndAuth(enc)
 }
 
+// Close closes connection of peer. Packages buffered before are dropped.
 func (p *Peer) Close() {
+	p.closed.Store(true)
 	p.Conn.Close()
 }
+
+// info returns login and address of peer. REFO changes them in session
+// goroutine, so the other goroutines read them under lock.
+func (p *Peer) info() (string, string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.Login, p.Addr
+}
+
+func (p *Peer) setInfo(login, addr string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.Login = login
+	p.Addr = addr
+}
@@ -3,8 +3,7 @@ package proto
 import (
 	"encoding/json"
 	"os"
-	"path"
-	"strings"
+	"time"
 )
 
 /*
@@ -16,23 +15,46 @@ commands:
 INFO                   - request user info
 LIST                   - request for peer list
 SEND msg               - send message with text msg
-FILE name data         - send part of file
+MESG envelope          - send message in envelope, see proto/envelope.go
+ACKN receipt           - delivery or read receipt for MESG and GMSG
+FILE name data         - send part of file, legacy
+FOFR offer             - offer of file with size and hash, see proto/transfer.go
+FCHK chunk             - part of offered file at offset
+FDAT chunk             - binary part of offered file, see proto/transfer.go
 SEEK DHState           - request for ip of peer with DHState
 DISC                   - notification about disconnection
+RKEY eph               - request for session rekey, see proto/rekey.go
+RKOK                   - confirmation of session rekey
+GINV data              - invitation to group or new member list of group
+GLEA data              - notification about leaving group
+GMSG data              - message to group
+RLAY data              - sealed message to be relayed, see proto/relay.go
 
 REFO data              - response for INFO request
-RELI data              - response for LIST request
+RELI data              - response for LIST request, relays also send it to announce new peers
 RESE data              - response for SEEK request
+RERK eph               - response for RKEY request
+FACK status            - response for FOFR request with offset to send from
+FEND status            - result of offered file verification
+FCAN status            - notification about canceled sending of offered file
 
 */
 
 type PeerHandler func(*Host, *Peer, []byte) error
 
 type Message struct {
-	Type  string
-	Login string
-	Addr  string
-	Data  string
+	Type        string
+	Id          string     `json:",omitempty"`
+	Sent        *time.Time `json:",omitempty"`
+	ContentType string     `json:",omitempty"`
+	ReplyTo     string     `json:",omitempty"`
+	From        string     `json:",omitempty"`
+	Via         string     `json:",omitempty"`
+	Peer        string     `json:",omitempty"`
+	Group       string     `json:",omitempty"`
+	Login       string
+	Addr        string
+	Data        string
 }
 
 var PeerCommands = peerCommands()
@@ -42,31 +64,100 @@ func peerCommands() *CommandParser {
 	parser.AddCommand(info, PeerHandler(peerInfoHandler))
 	parser.AddCommand(list, PeerHandler(peerListHandler))
 	parser.AddCommand(send, PeerHandler(peerSendHandler))
+	parser.AddCommand(mesg, PeerHandler(peerMesgHandler))
+	parser.AddCommand(ackn, PeerHandler(peerAcknHandler))
 	parser.AddCommand(file, PeerHandler(peerFileHandler))
 	parser.AddCommand(disc, PeerHandler(peerDiscHandler))
 	parser.AddCommand(refo, PeerHandler(peerRefoHandler))
 	parser.AddCommand(reli, PeerHandler(peerReliHandler))
+	parser.AddCommand(rkey, PeerHandler(peerRkeyHandler))
+	parser.AddCommand(rerk, PeerHandler(peerRerkHandler))
+	parser.AddCommand(rkok, PeerHandler(peerRkokHandler))
+	parser.AddCommand(ginv, PeerHandler(peerGinvHandler))
+	parser.AddCommand(glea, PeerHandler(peerGleaHandler))
+	parser.AddCommand(gmsg, PeerHandler(peerGmsgHandler))
+	parser.AddCommand(rlay, PeerHandler(peerRlayHandler))
+	parser.AddCommand(fofr, PeerHandler(peerFofrHandler))
+	parser.AddCommand(fchk, PeerHandler(peerFchkHandler))
+	parser.AddCommand(fdat, PeerHandler(peerFdatHandler))
+	parser.AddCommand(fack, PeerHandler(peerFackHandler))
+	parser.AddCommand(fend, PeerHandler(peerFendHandler))
+	parser.AddCommand(fcan, PeerHandler(peerFcanHandler))
 	return parser
 }
 
 func peerInfoHandler(host *Host, peer *Peer, data []byte) error {
-	js, _ := json.Marshal(host)
+	js, _ := json.Marshal(peerInfo{
+		Login:     host.Login,
+		Addr:      host.Addr,
+		Features:  host.features(),
+		MaxPacket: peer.Conn.maxRead(),
+	})
 	return sendCommand(peer, refo, js)
 }
 
 func peerListHandler(host *Host, peer *Peer, data []byte) error {
-	js, _ := json.Marshal(host.Peers)
+	js, _ := json.Marshal(host.Peers.announced())
 	return sendCommand(peer, reli, js)
 }
 
 func peerSendHandler(host *Host, peer *Peer, data []byte) error {
-	js, _ := json.Marshal(Message{
+	msg := Message{
 		Type:  "Message",
+		Peer:  sessionID(peer),
 		Login: peer.Login,
 		Addr:  peer.Addr,
 		Data:  string(data),
+	}
+	host.Record(&msg)
+
+	js, _ := json.Marshal(msg)
+	host.Events.Publish(string(js))
+	return nil
+}
+
+func peerMesgHandler(host *Host, peer *Peer, data []byte) error {
+	env := &Envelope{}
+	err := json.Unmarshal(data, env)
+	if err != nil {
+		return err
+	}
+	err = env.check()
+	if err != nil {
+		return err
+	}
+
+	msg := env.message("Message")
+	msg.Peer = sessionID(peer)
+	msg.Login = peer.Login
+	msg.Addr = peer.Addr
+	host.Record(&msg)
+
+	js, _ := json.Marshal(msg)
+	host.Events.Publish(string(js))
+	return sendReceipt(peer, env.Id, ReceiptDelivered)
+}
+
+func peerAcknHandler(host *Host, peer *Peer, data []byte) error {
+	receipt := &Receipt{}
+	err := json.Unmarshal(data, receipt)
+	if err != nil {
+		return err
+	}
+	if receipt.Id == "" {
+		return wrongCommandData(ackn)
+	}
+
+	js, _ := json.Marshal(Message{
+		Type:  "Receipt",
+		Id:    receipt.Id,
+		Sent:  &receipt.Time,
+		Peer:  sessionID(peer),
+		Login: peer.Login,
+		Addr:  peer.Addr,
+		Data:  receipt.Status,
 	})
-	host.Msg <- string(js)
+	host.Events.Publish(string(js))
 	return nil
 }
 
@@ -77,60 +168,271 @@ func peerFileHandler(host *Host, peer *Peer, data []byte) error {
 		return err
 	}
 
-	// Create directory with name of peer
-	file := path.Join("./", peer.Login)
-	err = os.MkdirAll(file, 0777)
+	// Create directory for peer
+	dir, err := host.peerDir(peer.Key)
 	if err != nil {
 		return err
 	}
-
-	// Create file ./Login/file
-	file = path.Join(file, fstruct.Name)
-	fd, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	defer dir.Close()
+	err = host.checkLegacyFile(sessionID(peer), dir.path, int64(len(fstruct.Data)))
+	if err != nil {
+		return err
+	}
+	name := safeName(fstruct.Name, "file")
+	fd, err := dir.open(name, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return err
 	}
 	defer fd.Close()
 
-	js, _ := json.Marshal(Message{
+	msg := Message{
 		Type:  "File",
+		Peer:  sessionID(peer),
 		Login: peer.Login,
 		Addr:  peer.Addr,
-		Data:  fstruct.Name,
-	})
-	host.Msg <- string(js)
-	_, err = fd.Write(fstruct.Data)
-	return err
+		Data:  fd.Name(),
+	}
+	host.Record(&msg)
+
+	js, _ := json.Marshal(msg)
+	host.Events.Publish(string(js))
+
+	// Append to file of peer directory
+	return host.Vault.AppendTo(fd, fstruct.Data)
+}
+
+func peerFofrHandler(host *Host, peer *Peer, data []byte) error {
+	offer := &fileOffer{}
+	err := json.Unmarshal(data, offer)
+	if err != nil {
+		return err
+	}
+
+	in, err := host.offerFile(peer, offer)
+	if err != nil {
+		return err
+	}
+	return host.offerReceived(in)
+}
+
+func peerFchkHandler(host *Host, peer *Peer, data []byte) error {
+	chunk := &fileChunk{}
+	err := json.Unmarshal(data, chunk)
+	if err != nil {
+		return err
+	}
+
+	return host.storeChunk(peer, chunk)
+}
+
+func peerFdatHandler(host *Host, peer *Peer, data []byte) error {
+	chunk := &fileChunk{}
+	err := chunk.UnmarshalBinary(data)
+	if err != nil {
+		return err
+	}
+	return host.storeChunk(peer, chunk)
+}
+
+func peerFackHandler(host *Host, peer *Peer, data []byte) error {
+	status := &fileStatus{}
+	err := json.Unmarshal(data, status)
+	if err != nil {
+		return err
+	}
+	return host.transfers.notify(transferKey(sessionID(peer), status.Id), status)
+}
+
+func peerFendHandler(host *Host, peer *Peer, data []byte) error {
+	status := &fileStatus{end: true}
+	err := json.Unmarshal(data, status)
+	if err != nil {
+		return err
+	}
+	return host.transfers.notify(transferKey(sessionID(peer), status.Id), status)
+}
+
+func peerFcanHandler(host *Host, peer *Peer, data []byte) error {
+	status := &fileStatus{}
+	err := json.Unmarshal(data, status)
+	if err != nil {
+		return err
+	}
+	return host.canceledFile(sessionID(peer), status.Id)
 }
 
 func peerDiscHandler(host *Host, peer *Peer, data []byte) error {
 	peer.Close()
-	peer.Crypto = nil
-	return nil
+	return ErrPeerClosed
 }
 
 func peerRefoHandler(host *Host, peer *Peer, data []byte) error {
-	p := &Peer{}
+	p := &peerInfo{}
 	err := json.Unmarshal(data, p)
-	if err == nil {
-		ip := strings.Split(peer.Conn.RemoteAddr().String(), ":")[0]
-		host.Peers[ip].Login = p.Login
-		host.Peers[ip].Addr = p.Addr
+	if err != nil {
+		return err
+	}
+
+	peer.setInfo(p.Login, p.Addr)
+	peer.setFeatures(p.Features)
+
+	// Packages are bounded by limits of both sides
+	limit := p.MaxPacket
+	if limit > peer.Conn.maxRead() {
+		limit = peer.Conn.maxRead()
+	}
+	peer.Conn.setLimits(peer.Conn.maxRead(), limit)
+	host.Peers.Update(sessionID(peer), func(known *Peer) {
+		known.Login = p.Login
+		known.Addr = p.Addr
+	})
+
+	// Features of peer are known now, so queued envelopes can be sent
+	go host.flushOutbox(sessionID(peer), peer)
+	if host.Relay {
+		go host.announcePeers(sessionID(peer))
 	}
-	return err
+	return nil
 }
 
 func peerReliHandler(host *Host, peer *Peer, data []byte) error {
 	peers := make(map[string]*Peer)
-	err := json.Unmarshal(data, peers)
+	err := json.Unmarshal(data, &peers)
 	if err != nil {
 		return err
 	}
+	host.routes.set(sessionID(peer), peers)
 	for k, v := range peers {
-		_, ok := host.Peers[k]
-		if !ok {
-			host.Peers[k] = v
+		if v != nil {
+			// Identity key and verification are trusted only when they come
+			// from handshake and the local user
+			v.Key = nil
+			v.Verified = false
+			host.Peers.Add(k, v)
 		}
 	}
 	return nil
 }
+
+func peerRkeyHandler(host *Host, peer *Peer, data []byte) error {
+	return peer.acceptRekey(data)
+}
+
+func peerRerkHandler(host *Host, peer *Peer, data []byte) error {
+	return peer.finishRekey(data)
+}
+
+func peerRkokHandler(host *Host, peer *Peer, data []byte) error {
+	return peer.confirmRekey()
+}
+
+func peerGinvHandler(host *Host, peer *Peer, data []byte) error {
+	invite := &groupInvite{}
+	err := json.Unmarshal(data, invite)
+	if err != nil {
+		return err
+	}
+	if invite.Id == "" {
+		return wrongCommandData(ginv)
+	}
+
+	group, pending, err := host.Groups.Invite(sessionID(peer), addrIP(host.Addr), invite)
+	if err != nil {
+		return err
+	}
+
+	// Invitation waits for GACC or GREJ of the user
+	if pending {
+		host.publishGroup("GroupInvite", group)
+	} else {
+		host.publishGroup("GroupMembers", group)
+	}
+	return nil
+}
+
+func peerGleaHandler(host *Host, peer *Peer, data []byte) error {
+	msg := &groupMessage{}
+	err := json.Unmarshal(data, msg)
+	if err != nil {
+		return err
+	}
+
+	group, err := host.Groups.RemoveMember(msg.Id, sessionID(peer))
+	if err != nil {
+		return err
+	}
+	host.publishGroup("GroupMembers", group)
+
+	// Owner tells the rest of members, peer which declined invitation
+	// notifies only the owner
+	if group.Owner == "" {
+		host.sendMembers(group)
+	}
+	return nil
+}
+
+func peerGmsgHandler(host *Host, peer *Peer, data []byte) error {
+	gm := &groupMessage{}
+	err := json.Unmarshal(data, gm)
+	if err != nil {
+		return err
+	}
+	if gm.Envelope == nil {
+		return wrongCommandData(gmsg)
+	}
+	err = gm.Envelope.check()
+	if err != nil {
+		return err
+	}
+
+	id := sessionID(peer)
+	group, ok := host.Groups.Get(gm.Id)
+	if !ok {
+		return ErrUnknownGroup
+	}
+	if !group.HasMember(id) {
+		return ErrNotMember
+	}
+
+	msg := gm.Envelope.message("GroupMessage")
+	msg.Peer = id
+	msg.Group = gm.Id
+	msg.Login = peer.Login
+	msg.Addr = peer.Addr
+	host.Record(&msg)
+
+	js, _ := json.Marshal(msg)
+	host.Events.Publish(string(js))
+	return sendReceipt(peer, gm.Envelope.Id, ReceiptDelivered)
+}
+
+func peerRlayHandler(host *Host, peer *Peer, data []byte) error {
+	pkt := &relayPacket{}
+	err := json.Unmarshal(data, pkt)
+	if err != nil {
+		return err
+	}
+	if pkt.Id == "" || pkt.To == "" {
+		return wrongCommandData(rlay)
+	}
+
+	if !host.relayed.add(pkt.Id) {
+		return nil
+	}
+	if pkt.To == Fingerprint(host.Identity.Public) {
+		return host.receiveRelayed(peer, pkt)
+	}
+
+	if !host.Relay {
+		return ErrRelayDisabled
+	}
+	// Packet doesn't travel further than the local limit allows
+	if pkt.Hops > host.relayHops() {
+		pkt.Hops = host.relayHops()
+	}
+	if pkt.Hops == 0 {
+		return ErrRelayHops
+	}
+	pkt.Hops--
+	return host.forwardRelay(pkt, sessionID(peer))
+}
@@ -0,0 +1,148 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+)
+
+// testPeer returns peer with AEAD session, everything it sends is discarded.
+func testPeer(t testing.TB) (*Host, *Peer) {
+	a, b := net.Pipe()
+	go io.Copy(io.Discard, b)
+
+	crypto, err := DeriveAEADState(testSecret, testTranscript, SuiteAESGCM, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := &Peer{
+		Login:  "peer",
+		Addr:   "pipe",
+		Conn:   CreateConn(a),
+		Crypto: crypto,
+		session: session{
+			secret:    testSecret,
+			suite:     SuiteAESGCM,
+			isUserA:   true,
+			rekeyable: true,
+		},
+	}
+
+	host := &Host{
+		Login:    "host",
+		Identity: testIdentity(t),
+		Peers:    CreatePeerRegistry(map[string]*Peer{"pipe": peer}),
+		Groups:   CreateGroupStore(nil),
+		Outbox:   CreateOutbox(nil, DefaultOutboxLimits),
+		Commands: PeerCommands,
+		Events:   CreateEventBus(DefaultEventQueue, DefaultOfflineEvents),
+	}
+	return host, peer
+}
+
+func TestPeerReliHandler(t *testing.T) {
+	host, peer := testPeer(t)
+	defer peer.Close()
+
+	id := testIdentity(t)
+	js, _ := json.Marshal(map[string]*Peer{
+		"pipe":     {Login: "changed"},
+		"10.0.0.2": {Login: "second", Key: id.Public, Verified: true},
+		"10.0.0.3": nil,
+	})
+
+	err := peerReliHandler(host, peer, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if known, _ := host.Peers.Get("pipe"); known.Login != "peer" {
+		t.Fatal("known peer was replaced")
+	}
+	second, ok := host.Peers.Get("10.0.0.2")
+	if !ok || second.Login != "second" {
+		t.Fatal("new peer wasn't added")
+	}
+	if second.Key != nil || second.Verified {
+		t.Fatal("identity key or verification was taken from peer list")
+	}
+
+	// Verification isn't told to peers
+	host.Peers.Update("10.0.0.2", func(known *Peer) { known.Verified = true })
+	if host.Peers.announced()["10.0.0.2"].Verified {
+		t.Fatal("verification is announced")
+	}
+}
+
+func TestPeerRefoHandler(t *testing.T) {
+	host, peer := testPeer(t)
+	defer peer.Close()
+
+	err := peerRefoHandler(host, peer, []byte(`{"Login":"renamed","Addr":"10.0.0.1:7000"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Login != "renamed" || peer.Addr != "10.0.0.1:7000" {
+		t.Fatalf("peer wasn't updated: %s %s", peer.Login, peer.Addr)
+	}
+	known, _ := host.Peers.Get("pipe")
+	if known.Login != "renamed" || known.Addr != "10.0.0.1:7000" {
+		t.Fatalf("known peer wasn't updated: %s %s", known.Login, known.Addr)
+	}
+
+	// Info from peer which isn't in peer list
+	host.Peers = CreatePeerRegistry(nil)
+	err = peerRefoHandler(host, peer, []byte(`{"Login":"other"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Peers.Len() != 0 {
+		t.Fatal("unknown peer was added by its info")
+	}
+}
+
+func FuzzPeerHandlers(f *testing.F) {
+	commands := []Command{refo, reli, rkey, rerk, rkok, ginv, glea, gmsg, mesg, ackn, rlay, fack, fend, fdat, fcan}
+
+	f.Add(uint8(0), false, []byte(`{"Login":"login","Addr":"127.0.0.1:7000"}`))
+	f.Add(uint8(1), false, []byte(`{"10.0.0.2":{"Login":"login","Addr":"10.0.0.2:7000"},"10.0.0.3":null}`))
+	f.Add(uint8(2), false, []byte(`{"Ephemeral":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`))
+	f.Add(uint8(3), true, []byte(`{"Ephemeral":"CQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`))
+	f.Add(uint8(4), true, []byte{})
+	f.Add(uint8(2), true, []byte("null"))
+	f.Add(uint8(5), false, []byte(`{"Id":"group","Name":"name","Members":["10.0.0.2","pipe"]}`))
+	f.Add(uint8(6), false, []byte(`{"Id":"group"}`))
+	f.Add(uint8(7), false, []byte(`{"Id":"group","Envelope":{"Version":1,"Id":"id","Data":"message"}}`))
+	f.Add(uint8(8), false, []byte(`{"Version":1,"Id":"id","Time":"2020-01-01T00:00:00Z","Data":"message"}`))
+	f.Add(uint8(9), false, []byte(`{"Id":"id","Status":"read"}`))
+	f.Add(uint8(11), false, []byte(`{"Id":"id","Offset":10,"Error":"file hash mismatch"}`))
+	f.Add(uint8(13), false, append(bytes.Repeat([]byte{0xab}, 32), 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 'd', 'a', 't', 'a'))
+	f.Add(uint8(14), false, []byte(`{"Id":"id","Error":"file transfer is canceled"}`))
+	f.Add(uint8(10), false, []byte(`{"Id":"id","To":"fingerprint","Hops":1,"Ephemeral":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=","Sealed":"AA=="}`))
+
+	f.Fuzz(func(t *testing.T, kind uint8, pending bool, data []byte) {
+		host, peer := testPeer(t)
+		defer peer.Close()
+
+		if pending {
+			err := peer.StartRekey()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		handler, arg, err := PeerCommands.GetHandler(packCommand(commands[int(kind)%len(commands)], data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.(PeerHandler)(host, peer, arg)
+
+		for k, v := range host.Peers.All() {
+			if k != "pipe" && v.Key != nil {
+				t.Fatalf("identity key of %s was taken from peer list", k)
+			}
+		}
+	})
+}
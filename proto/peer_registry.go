@@ -0,0 +1,150 @@
+package proto
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// PeerRegistry keeps known peers keyed by ip. It stores and returns copies
+// of peer records, live sessions are never shared through it.
+type PeerRegistry struct {
+	mutex    sync.RWMutex
+	peers    map[string]*Peer
+	OnChange func(ip string)
+}
+
+func CreatePeerRegistry(peers map[string]*Peer) *PeerRegistry {
+	pr := &PeerRegistry{peers: make(map[string]*Peer)}
+	for ip, peer := range peers {
+		if peer != nil {
+			pr.peers[ip] = peer.record()
+		}
+	}
+	return pr
+}
+
+func (pr *PeerRegistry) Get(ip string) (*Peer, bool) {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	peer, ok := pr.peers[ip]
+	if !ok {
+		return nil, false
+	}
+	return peer.record(), true
+}
+
+// Add adds peer unless ip is already known.
+func (pr *PeerRegistry) Add(ip string, peer *Peer) bool {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	if _, ok := pr.peers[ip]; ok {
+		return false
+	}
+	pr.peers[ip] = peer.record()
+	pr.changed(ip)
+	return true
+}
+
+// Put adds peer or replaces the known one.
+func (pr *PeerRegistry) Put(ip string, peer *Peer) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	pr.peers[ip] = peer.record()
+	pr.changed(ip)
+}
+
+// Update calls update with record of ip under lock, if ip is known.
+func (pr *PeerRegistry) Update(ip string, update func(*Peer)) bool {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	peer, ok := pr.peers[ip]
+	if !ok {
+		return false
+	}
+	update(peer)
+	pr.changed(ip)
+	return true
+}
+
+func (pr *PeerRegistry) ByLogin(login string) map[string]*Peer {
+	return pr.filter(func(peer *Peer) bool { return peer.Login == login })
+}
+
+func (pr *PeerRegistry) ByFingerprint(fingerprint string) map[string]*Peer {
+	fingerprint = normalizeFingerprint(fingerprint)
+	return pr.filter(func(peer *Peer) bool {
+		return peer.Key != nil && Fingerprint(peer.Key) == fingerprint
+	})
+}
+
+func (pr *PeerRegistry) All() map[string]*Peer {
+	return pr.filter(func(*Peer) bool { return true })
+}
+
+// announced returns peers told to other peers in RELI. Verification is
+// decision of the local user, so it isn't told.
+func (pr *PeerRegistry) announced() map[string]*Peer {
+	peers := pr.All()
+	for _, peer := range peers {
+		peer.Verified = false
+	}
+	return peers
+}
+
+func (pr *PeerRegistry) Len() int {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+	return len(pr.peers)
+}
+
+func (pr *PeerRegistry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pr.All())
+}
+
+func (pr *PeerRegistry) UnmarshalJSON(data []byte) error {
+	peers := make(map[string]*Peer)
+	err := json.Unmarshal(data, &peers)
+	if err != nil {
+		return err
+	}
+
+	loaded := CreatePeerRegistry(peers)
+	pr.mutex.Lock()
+	pr.peers = loaded.peers
+	pr.mutex.Unlock()
+	return nil
+}
+
+func (pr *PeerRegistry) filter(match func(*Peer) bool) map[string]*Peer {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	peers := make(map[string]*Peer)
+	for ip, peer := range pr.peers {
+		if match(peer) {
+			peers[ip] = peer.record()
+		}
+	}
+	return peers
+}
+
+func (pr *PeerRegistry) changed(ip string) {
+	if pr.OnChange != nil {
+		go pr.OnChange(ip)
+	}
+}
+
+// record returns copy of the fields kept for known peers.
+func (p *Peer) record() *Peer {
+	return &Peer{
+		Login:        p.Login,
+		Addr:         p.Addr,
+		Key:          p.Key,
+		Verified:     p.Verified,
+		SafetyNumber: p.SafetyNumber,
+	}
+}
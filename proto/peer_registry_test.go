@@ -0,0 +1,135 @@
+package proto
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPeerRegistry(t *testing.T) {
+	id := testIdentity(t)
+	pr := CreatePeerRegistry(map[string]*Peer{
+		"10.0.0.1": {Login: "alice", Addr: "10.0.0.1:7000", Key: id.Public},
+		"10.0.0.2": {Login: "bob", Addr: "10.0.0.2:7000"},
+		"10.0.0.3": nil,
+	})
+	if pr.Len() != 2 {
+		t.Fatalf("expected 2 peers, got %d", pr.Len())
+	}
+
+	peer, ok := pr.Get("10.0.0.1")
+	if !ok || peer.Login != "alice" {
+		t.Fatal("known peer isn't found")
+	}
+	peer.Login = "changed"
+	if peer, _ = pr.Get("10.0.0.1"); peer.Login != "alice" {
+		t.Fatal("registry shares its records")
+	}
+
+	if pr.Add("10.0.0.2", &Peer{Login: "mallory"}) {
+		t.Fatal("known peer was replaced by Add")
+	}
+	if !pr.Add("10.0.0.4", &Peer{Login: "bob"}) {
+		t.Fatal("new peer wasn't added")
+	}
+	if !pr.Update("10.0.0.4", func(p *Peer) { p.Addr = "10.0.0.4:7000" }) {
+		t.Fatal("known peer wasn't updated")
+	}
+	if pr.Update("10.0.0.5", func(p *Peer) { t.Fatal("update of unknown peer is called") }) {
+		t.Fatal("unknown peer was updated")
+	}
+
+	bobs := pr.ByLogin("bob")
+	if len(bobs) != 2 || bobs["10.0.0.4"].Addr != "10.0.0.4:7000" {
+		t.Fatalf("wrong peers by login %v", bobs)
+	}
+
+	fingerprint := strings.ToUpper(Fingerprint(id.Public))
+	byKey := pr.ByFingerprint(fingerprint[:8] + " " + fingerprint[8:])
+	if len(byKey) != 1 || byKey["10.0.0.1"] == nil {
+		t.Fatalf("wrong peers by fingerprint %v", byKey)
+	}
+	if len(pr.ByFingerprint("")) != 0 {
+		t.Fatal("peers without key match empty fingerprint")
+	}
+
+	js, err := json.Marshal(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := CreatePeerRegistry(nil)
+	err = json.Unmarshal(js, loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != 3 {
+		t.Fatalf("expected 3 loaded peers, got %d", loaded.Len())
+	}
+	if peer, _ := loaded.Get("10.0.0.1"); Fingerprint(peer.Key) != Fingerprint(id.Public) {
+		t.Fatal("identity key is lost")
+	}
+}
+
+func TestPeerRegistryOnChange(t *testing.T) {
+	changes := make(chan string, 3)
+	pr := CreatePeerRegistry(nil)
+	pr.OnChange = func(ip string) { changes <- ip }
+
+	pr.Add("10.0.0.1", &Peer{})
+	pr.Add("10.0.0.1", &Peer{})
+	pr.Update("10.0.0.2", func(*Peer) {})
+	pr.Put("10.0.0.2", &Peer{})
+
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case ip := <-changes:
+			got[ip] = true
+		case <-time.After(time.Second):
+			t.Fatal("change notification is lost")
+		}
+	}
+	if !got["10.0.0.1"] || !got["10.0.0.2"] {
+		t.Fatalf("wrong notifications %v", got)
+	}
+	select {
+	case ip := <-changes:
+		t.Fatalf("unexpected notification for %s", ip)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPeerRegistryConcurrent(t *testing.T) {
+	pr := CreatePeerRegistry(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ip := "10.0.0." + strconv.Itoa(j%10)
+				switch (i + j) % 5 {
+				case 0:
+					pr.Add(ip, &Peer{Login: "login"})
+				case 1:
+					pr.Update(ip, func(p *Peer) { p.Login = strconv.Itoa(i) })
+				case 2:
+					pr.Get(ip)
+				case 3:
+					pr.ByLogin("login")
+				case 4:
+					json.Marshal(pr)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if pr.Len() != 10 {
+		t.Fatalf("expected 10 peers, got %d", pr.Len())
+	}
+}
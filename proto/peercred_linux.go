@@ -0,0 +1,44 @@
+//go:build linux
+
+package proto
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+var ErrManagerUser = errors.New("manager runs under another user")
+
+// checkPeerUser compares user of Unix socket peer with the current user.
+func checkPeerUser(conn *Conn) error {
+	unixConn, ok := conn.conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return err
+	}
+	if credErr != nil {
+		return credErr
+	}
+
+	if int(cred.Uid) != os.Getuid() {
+		return ErrManagerUser
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Pin struct {
+	Key     ed25519.PublicKey
+	Login   string
+	Pinned  time.Time
+	Offered ed25519.PublicKey `json:",omitempty"`
+}
+
+// PinStore keeps identity keys of peers pinned on first use, keyed by ip.
+type PinStore struct {
+	mutex    sync.Mutex
+	pins     map[string]*Pin
+	OnChange func()
+}
+
+var (
+	ErrKeyChanged       = errors.New("second user's identity key doesn't match pinned key")
+	ErrUnknownPin       = errors.New("no pinned key for this peer")
+	ErrFingerprintMatch = errors.New("fingerprint doesn't match pinned key")
+)
+
+func CreatePinStore(pins map[string]*Pin) *PinStore {
+	if pins == nil {
+		pins = make(map[string]*Pin)
+	}
+	return &PinStore{pins: pins}
+}
+
+// Check pins key for ip if it's seen for the first time. If peer has changed
+// its ip, pin is moved to the new ip. Different key for pinned ip is refused
+// and remembered as offered, so it can be re-pinned by user.
+func (ps *PinStore) Check(ip, login string, key ed25519.PublicKey) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	pin, ok := ps.pins[ip]
+	if ok {
+		if bytes.Equal(pin.Key, key) {
+			pin.Login = login
+			return nil
+		}
+		pin.Offered = key
+		ps.changed()
+		return ErrKeyChanged
+	}
+
+	for k, v := range ps.pins {
+		if bytes.Equal(v.Key, key) {
+			delete(ps.pins, k)
+			v.Login = login
+			ps.pins[ip] = v
+			ps.changed()
+			return nil
+		}
+	}
+
+	ps.pins[ip] = &Pin{
+		Key:    key,
+		Login:  login,
+		Pinned: time.Now(),
+	}
+	ps.changed()
+	return nil
+}
+
+func (ps *PinStore) Get(ip string) (*Pin, bool) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	pin, ok := ps.pins[ip]
+	if !ok {
+		return nil, false
+	}
+	cpy := *pin
+	return &cpy, true
+}
+
+// Verify checks pinned key of ip against fingerprint received out of band.
+func (ps *PinStore) Verify(ip, fingerprint string) (*Pin, error) {
+	pin, ok := ps.Get(ip)
+	if !ok {
+		return nil, ErrUnknownPin
+	}
+
+	if normalizeFingerprint(fingerprint) != Fingerprint(pin.Key) {
+		return nil, ErrFingerprintMatch
+	}
+	return pin, nil
+}
+
+// Repin replaces pinned key of ip with the key offered by the last refused
+// handshake. Without offered key the pin is removed and the next handshake
+// pins a new one.
+func (ps *PinStore) Repin(ip string) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	pin, ok := ps.pins[ip]
+	if !ok {
+		return ErrUnknownPin
+	}
+
+	if pin.Offered == nil {
+		delete(ps.pins, ip)
+	} else {
+		pin.Key = pin.Offered
+		pin.Offered = nil
+		pin.Pinned = time.Now()
+	}
+	ps.changed()
+	return nil
+}
+
+func (ps *PinStore) MarshalJSON() ([]byte, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return json.Marshal(ps.pins)
+}
+
+func (ps *PinStore) UnmarshalJSON(data []byte) error {
+	pins := make(map[string]*Pin)
+	err := json.Unmarshal(data, &pins)
+	if err != nil {
+		return err
+	}
+
+	ps.mutex.Lock()
+	ps.pins = pins
+	ps.mutex.Unlock()
+	return nil
+}
+
+func (ps *PinStore) changed() {
+	if ps.OnChange != nil {
+		go ps.OnChange()
+	}
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9', r >= 'a' && r <= 'f':
+			return r
+		case r >= 'A' && r <= 'F':
+			return r - 'A' + 'a'
+		}
+		return -1
+	}, fingerprint)
+}
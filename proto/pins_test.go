@@ -0,0 +1,96 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+)
+
+func TestPinStore(t *testing.T) {
+	first, second := testIdentity(t).Public, testIdentity(t).Public
+	pins := CreatePinStore(nil)
+
+	steps := []struct {
+		name string
+		ip   string
+		key  ed25519.PublicKey
+		err  error
+	}{
+		{"first key is pinned", "10.0.0.1", first, nil},
+		{"pinned key is accepted", "10.0.0.1", first, nil},
+		{"changed key is refused", "10.0.0.1", second, ErrKeyChanged},
+		{"changed key is refused again", "10.0.0.1", second, ErrKeyChanged},
+		{"pin moves to new ip", "10.0.0.2", first, nil},
+		{"new ip keeps the key", "10.0.0.2", second, ErrKeyChanged},
+	}
+	for _, step := range steps {
+		if err := pins.Check(step.ip, "peer", step.key); err != step.err {
+			t.Fatalf("%s: expected %v, got %v", step.name, step.err, err)
+		}
+	}
+	if _, ok := pins.Get("10.0.0.1"); ok {
+		t.Fatal("moved pin is kept at the old ip")
+	}
+	if pin, _ := pins.Get("10.0.0.2"); !bytes.Equal(pin.Key, first) || !bytes.Equal(pin.Offered, second) {
+		t.Fatalf("wrong pin %+v", pin)
+	}
+}
+
+func TestPinStoreRepin(t *testing.T) {
+	first, second := testIdentity(t).Public, testIdentity(t).Public
+	pins := CreatePinStore(nil)
+	pins.Check("10.0.0.1", "peer", first)
+	pins.Check("10.0.0.1", "peer", second)
+
+	// Offered key replaces the pinned one
+	if err := pins.Repin("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if pin, _ := pins.Get("10.0.0.1"); !bytes.Equal(pin.Key, second) || pin.Offered != nil {
+		t.Fatalf("wrong pin %+v", pin)
+	}
+	if err := pins.Check("10.0.0.1", "peer", first); err != ErrKeyChanged {
+		t.Fatalf("expected %v, got %v", ErrKeyChanged, err)
+	}
+
+	// Pin without offered key is removed, the next key is pinned
+	pins.Check("10.0.0.2", "other", first)
+	if err := pins.Repin("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pins.Get("10.0.0.2"); ok {
+		t.Fatal("pin isn't removed")
+	}
+	if err := pins.Repin("10.0.0.2"); err != ErrUnknownPin {
+		t.Fatalf("expected %v, got %v", ErrUnknownPin, err)
+	}
+}
+
+func TestPinStoreVerify(t *testing.T) {
+	key := testIdentity(t).Public
+	pins := CreatePinStore(nil)
+	pins.Check("10.0.0.1", "peer", key)
+
+	fingerprint := Fingerprint(key)
+	tests := []struct {
+		ip          string
+		fingerprint string
+		err         error
+	}{
+		{"10.0.0.1", fingerprint, nil},
+		{"10.0.0.1", strings.ToUpper(fingerprint[:32]) + " " + fingerprint[32:], nil},
+		{"10.0.0.1", Fingerprint(testIdentity(t).Public), ErrFingerprintMatch},
+		{"10.0.0.1", "", ErrFingerprintMatch},
+		{"10.0.0.2", fingerprint, ErrUnknownPin},
+	}
+	for _, test := range tests {
+		pin, err := pins.Verify(test.ip, test.fingerprint)
+		if err != test.err {
+			t.Fatalf("%s %q: expected %v, got %v", test.ip, test.fingerprint, test.err, err)
+		}
+		if err == nil && !bytes.Equal(pin.Key, key) {
+			t.Fatalf("wrong pin %+v", pin)
+		}
+	}
+}
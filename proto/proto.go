@@ -1,24 +1,66 @@
 package proto
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"io"
 	"net"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const MaxPacketSize uint32 = 8192
+const (
+	// MaxPacketSize is accepted by every peer, sessions may negotiate bigger
+	// packages up to LimitPacketSize in REFO
+	MaxPacketSize    uint32 = 8192
+	LimitPacketSize  uint32 = 1 << 20
+	DefaultMaxPacket uint32 = 64 << 10
+	connBufferSize          = 2 * (4 + int(MaxPacketSize))
+	// Crypto states add header and tag to every package
+	packageReserved = 128
+)
 
-var ErrLongPacket = errors.New("packet is too long")
+var (
+	ErrLongPacket    = errors.New("packet is too long")
+	ErrPackageLength = errors.New("wrong length")
+)
 
 type Host struct {
-	Login    string
-	Addr     string
-	DifHel   *DHState         `json:"-"`
-	Peers    map[string]*Peer `json:"-"`
-	Commands *CommandParser   `json:"-"`
-	Msg      chan string      `json:"-"`
-	Quit     chan bool        `json:"-"`
+	Login        string
+	Addr         string
+	DifHel       *DHState       `json:"-"`
+	Identity     *Identity      `json:"-"`
+	Pins         *PinStore      `json:"-"`
+	Legacy       bool           `json:"-"`
+	Suites       []uint8        `json:"-"`
+	Rekey        RekeyPolicy    `json:"-"`
+	ReplayWindow uint32         `json:"-"`
+	MaxPacket    uint32         `json:"-"`
+	Relay        bool           `json:"-"`
+	Downloads    string         `json:"-"`
+	Files        FileLimits     `json:"-"`
+	RelayHops    uint8          `json:"-"`
+	Transport    Transport      `json:"-"`
+	ManagerToken string         `json:"-"`
+	Vault        *Vault         `json:"-"`
+	History      string         `json:"-"`
+	Peers        *PeerRegistry  `json:"-"`
+	Groups       *GroupStore    `json:"-"`
+	Outbox       *Outbox        `json:"-"`
+	Commands     *CommandParser `json:"-"`
+	Events       *EventBus      `json:"-"`
+	Quit         chan bool      `json:"-"`
+
+	sessionsMutex sync.Mutex
+	sessions      map[string]*Peer
+	relayed       seenSet
+	envelopes     envelopeSet
+	routes        relayRoutes
+	transfers     transfers
 }
 
 type PackageReadWriter interface {
@@ -26,8 +68,19 @@ type PackageReadWriter interface {
 	WritePackage([]byte) (int, error)
 }
 
+// Conn frames packages with 4 bytes length prefix. Stream connections are
+// read through a buffer, datagram connections are read a datagram at a time.
 type Conn struct {
-	conn net.Conn
+	conn     net.Conn
+	reader   *bufio.Reader
+	datagram bool
+
+	// Zero limit means MaxPacketSize
+	readLimit  atomic.Uint32
+	writeLimit atomic.Uint32
+
+	wmutex sync.Mutex
+	writer *bufio.Writer
 }
 
 type Listener struct {
@@ -35,9 +88,14 @@ type Listener struct {
 }
 
 func CreateConn(conn net.Conn) *Conn {
-	return &Conn{
-		conn: conn,
+	c := &Conn{conn: conn}
+	if isDatagram(conn) {
+		c.datagram = true
+	} else {
+		c.reader = bufio.NewReader(conn)
+		c.writer = bufio.NewWriterSize(conn, connBufferSize)
 	}
+	return c
 }
 
 func Dial(network, address string) (*Conn, error) {
@@ -45,7 +103,7 @@ func Dial(network, address string) (*Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Conn{conn: conn}, nil
+	return CreateConn(conn), nil
 }
 
 func CreateListener(listener net.Listener) *Listener {
@@ -62,44 +120,142 @@ func Listen(network, address string) (*Listener, error) {
 	return &Listener{listener: ln}, nil
 }
 
+// WritePackage writes length prefix and data with a single write, so packages
+// of concurrent writers don't interleave.
 func (c *Conn) WritePackage(data []byte) (int, error) {
+	if uint64(len(data)) > uint64(c.maxWrite()) {
+		return 0, ErrLongPacket
+	}
+
 	lbuf := make([]byte, 4)
 	binary.LittleEndian.PutUint32(lbuf, uint32(len(data)))
 
-	_, err := c.conn.Write(lbuf)
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+
+	// Old nodes read length and data of a datagram package separately
+	if c.datagram {
+		_, err := c.conn.Write(lbuf)
+		if err != nil {
+			return 0, err
+		}
+		return c.conn.Write(data)
+	}
+
+	_, err := c.writer.Write(lbuf)
 	if err != nil {
 		return 0, err
 	}
-
-	return c.conn.Write(data)
+	n, err := c.writer.Write(data)
+	if err != nil {
+		return n, err
+	}
+	return n, c.writer.Flush()
 }
 
 func (c *Conn) ReadPackage() ([]byte, error) {
+	if c.datagram {
+		return c.readDatagram()
+	}
+
 	lbuf := make([]byte, 4)
-	n, err := c.conn.Read(lbuf)
+	_, err := io.ReadFull(c.reader, lbuf)
 	if err != nil {
 		return nil, err
 	}
-	if n != 4 {
-		return nil, errors.New("wrong length")
-	}
 
 	length := binary.LittleEndian.Uint32(lbuf)
-	if length > MaxPacketSize {
+	if length > c.maxRead() {
 		return nil, ErrLongPacket
 	}
 
 	buf := make([]byte, length)
+	_, err = io.ReadFull(c.reader, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readDatagram reads package, which is either sent in one datagram or split
+// into length and data datagrams.
+func (c *Conn) readDatagram() ([]byte, error) {
+	buf := make([]byte, 4+MaxPacketSize)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n < 4 {
+		return nil, ErrPackageLength
+	}
+
+	length := binary.LittleEndian.Uint32(buf)
+	if length > MaxPacketSize {
+		return nil, ErrLongPacket
+	}
+	if n > 4 {
+		if uint32(n-4) != length {
+			return nil, ErrPackageLength
+		}
+		return buf[4:n], nil
+	}
+
 	n, err = c.conn.Read(buf)
 	if err != nil {
 		return nil, err
 	}
 	if uint32(n) != length {
-		return nil, errors.New("wrong length")
+		return nil, ErrPackageLength
+	}
+	return buf[:n], nil
+}
+
+// setLimits sets sizes of packages which may be read and written. Datagram
+// connections keep MaxPacketSize.
+func (c *Conn) setLimits(read, write uint32) {
+	if c.datagram {
+		return
 	}
+	c.readLimit.Store(clampPacketSize(read))
+	c.writeLimit.Store(clampPacketSize(write))
+}
 
-	return buf, nil
+func (c *Conn) maxRead() uint32 {
+	if limit := c.readLimit.Load(); limit != 0 {
+		return limit
+	}
+	return MaxPacketSize
+}
 
+func (c *Conn) maxWrite() uint32 {
+	if limit := c.writeLimit.Load(); limit != 0 {
+		return limit
+	}
+	return MaxPacketSize
+}
+
+func clampPacketSize(size uint32) uint32 {
+	if size < MaxPacketSize {
+		return MaxPacketSize
+	}
+	if size > LimitPacketSize {
+		return LimitPacketSize
+	}
+	return size
+}
+
+func isDatagram(conn net.Conn) bool {
+	switch conn.(type) {
+	case *net.UDPConn, *net.IPConn:
+		return true
+	case *net.UnixConn:
+		addr := conn.LocalAddr()
+		return addr != nil && addr.Network() == "unixgram"
+	}
+	return false
 }
 
 func (c *Conn) RemoteAddr() net.Addr {
@@ -119,7 +275,7 @@ func (ln *Listener) Accept() (*Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Conn{conn: conn}, nil
+	return CreateConn(conn), nil
 }
 
 func (ln *Listener) Close() error {
@@ -131,33 +287,27 @@ func (ln *Listener) Addr() net.Addr {
 }
 
 func (host *Host) DialPeer(conn *Conn) (*Peer, error) {
-	addr := conn.RemoteAddr().String()
-	ip := strings.Split(addr, ":")[0]
-
 	peer := &Peer{
-		Addr:   addr,
+		Addr:   conn.RemoteAddr().String(),
 		DifHel: &DHState{},
 		Conn:   conn,
 	}
-	v, ok := host.Peers[ip]
-	if ok {
-		peer.Login = v.Login
-		peer.Addr = v.Addr
-		peer.Crypto = v.Crypto
-	}
 
-	if peer.Crypto == nil {
-		key, err := peer.DifHel.PassiveDHExchange(peer.Conn)
-		if err != nil {
-			return nil, err
-		}
+	var dh *DHState
+	if host.Legacy {
+		dh = peer.DifHel
+	}
 
-		peer.Crypto = InitCryptoState(key, true)
+	exch, err := PassiveExchange(peer.Conn, host.Identity, dh, host.Suites)
+	if err != nil {
+		return nil, err
 	}
 
-	if !ok {
-		host.Peers[ip] = peer
+	err = host.initSession(peer, exch, true)
+	if err != nil {
+		return nil, err
 	}
+	host.Peers.Put(sessionID(peer), peer)
 
 	sendCommand(peer, info, nil)
 	sendCommand(peer, list, nil)
@@ -165,46 +315,102 @@ func (host *Host) DialPeer(conn *Conn) (*Peer, error) {
 }
 
 func (host *Host) AcceptPeer(conn *Conn) (*Peer, error) {
-	addr := conn.RemoteAddr().String()
-	ip := strings.Split(addr, ":")[0]
-
 	peer := &Peer{
-		Addr:   addr,
+		Addr:   conn.RemoteAddr().String(),
 		DifHel: &DHState{},
+		Conn:   conn,
+	}
+
+	var dh *DHState
+	if host.Legacy {
+		dh = host.DifHel
+	}
+
+	exch, err := ActiveExchange(peer.Conn, host.Identity, dh, host.Suites)
+	if err != nil {
+		return nil, err
+	}
+
+	err = host.initSession(peer, exch, false)
+	if err != nil {
+		return nil, err
 	}
-	v, ok := host.Peers[ip]
+	host.Peers.Put(sessionID(peer), peer)
+
+	sendCommand(peer, info, nil)
+	sendCommand(peer, list, nil)
+	return peer, nil
+}
+
+func (host *Host) initSession(peer *Peer, exch *Exchange, isUserA bool) error {
+	// Peers of transports without IP addresses are known only after handshake
+	id := peerID(peer.Conn, exch.PeerKey)
+	v, ok := host.Peers.Get(id)
 	if ok {
 		peer.Login = v.Login
 		peer.Addr = v.Addr
-		peer.Crypto = v.Crypto
+		peer.Key = v.Key
+		peer.Verified = v.Verified
+		peer.SafetyNumber = v.SafetyNumber
 	}
-	peer.Conn = conn
+	peer.Rekey = host.Rekey
 
-	if peer.Crypto == nil {
-		key, err := host.DifHel.ActiveDHExchange(peer.Conn)
-		if err != nil {
-			return nil, err
-		}
+	err := host.checkPeerKey(id, peer, exch)
+	if err != nil {
+		return err
+	}
 
-		peer.Crypto = InitCryptoState(key, false)
+	// Verification is bound to the key it was made for
+	if !bytes.Equal(peer.Key, exch.PeerKey) {
+		peer.Verified = false
+	}
+	peer.Key = exch.PeerKey
+	peer.SafetyNumber = SafetyNumber(host.Identity.Public, exch.PeerKey, exch.Transcript)
+	crypto, err := exch.InitCryptoState(isUserA)
+	if err != nil {
+		return err
+	}
+	if aead, ok := crypto.(*AEADState); ok {
+		aead.SetReplayWindow(host.ReplayWindow)
 	}
 
-	if !ok {
-		host.Peers[ip] = peer
+	peer.Crypto = crypto
+	peer.session = session{
+		secret:    exch.Key,
+		suite:     exch.Suite,
+		isUserA:   isUserA,
+		rekeyable: exch.Version != LegacyProtocolVersion && exch.Suite != SuiteRatchet,
+		window:    host.ReplayWindow,
 	}
+	peer.keyTime = time.Now()
 
-	sendCommand(peer, info, nil)
-	sendCommand(peer, list, nil)
-	return peer, nil
+	// Peer may send bigger packages once it gets REFO with our limit
+	peer.Conn.setLimits(host.MaxPacket, MaxPacketSize)
+	return nil
+}
+
+// checkPeerKey rejects an exchange signed with an identity key that differs
+// from the key pinned for the same peer and notifies manager about it.
+func (host *Host) checkPeerKey(id string, peer *Peer, exch *Exchange) error {
+	if host.Pins == nil {
+		return nil
+	}
+
+	err := host.Pins.Check(id, peer.Login, exch.PeerKey)
+	if err == ErrKeyChanged {
+		js, _ := json.Marshal(Message{
+			Type:  "KeyChanged",
+			Login: peer.Login,
+			Addr:  peer.Addr,
+			Data:  Fingerprint(exch.PeerKey),
+		})
+		host.Events.Publish(string(js))
+	}
+	return err
 }
 
 func (host *Host) Disconnect() {
-	for _, p := range host.Peers {
-		if p.Conn == nil {
-			continue
-		}
-		sendCommand(p, disc, nil)
-		p.Close()
-		p.Crypto = nil
+	for _, s := range host.Sessions() {
+		host.CloseSession(s.Id)
 	}
 }
@@ -0,0 +1,335 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// fragmentingConn reads and writes at most max bytes at once, like a slow
+// link does.
+type fragmentingConn struct {
+	net.Conn
+	max int
+}
+
+func (c *fragmentingConn) Read(buf []byte) (int, error) {
+	if len(buf) > c.max {
+		buf = buf[:c.max]
+	}
+	return c.Conn.Read(buf)
+}
+
+func (c *fragmentingConn) Write(buf []byte) (int, error) {
+	written := 0
+	for len(buf) > 0 {
+		n := len(buf)
+		if n > c.max {
+			n = c.max
+		}
+		n, err := c.Conn.Write(buf[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		buf = buf[n:]
+	}
+	return written, nil
+}
+
+func fragmentingPipe(max int) (*Conn, *Conn) {
+	a, b := net.Pipe()
+	return CreateConn(&fragmentingConn{a, max}), CreateConn(&fragmentingConn{b, max})
+}
+
+func TestConnRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	ca, cb := CreateConn(a), CreateConn(b)
+	defer ca.Close()
+	defer cb.Close()
+
+	packages := [][]byte{
+		[]byte("INFO"),
+		[]byte("SEND hello"),
+		bytes.Repeat([]byte{0xaa}, int(MaxPacketSize)),
+	}
+
+	go func() {
+		for _, pkg := range packages {
+			_, err := ca.WritePackage(pkg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for _, pkg := range packages {
+		buf, err := cb.ReadPackage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, pkg) {
+			t.Fatalf("expected package of length %d, got %d", len(pkg), len(buf))
+		}
+	}
+}
+
+func TestConnFragmented(t *testing.T) {
+	for _, max := range []int{1, 3, 1000} {
+		ca, cb := fragmentingPipe(max)
+
+		packages := [][]byte{{}, []byte("INFO"), bytes.Repeat([]byte{0x55}, int(MaxPacketSize))}
+		go func() {
+			for _, pkg := range packages {
+				ca.WritePackage(pkg)
+			}
+		}()
+
+		for _, pkg := range packages {
+			buf, err := cb.ReadPackage()
+			if err != nil {
+				t.Fatalf("max %d: %v", max, err)
+			}
+			if !bytes.Equal(buf, pkg) {
+				t.Fatalf("max %d: expected package of length %d, got %d", max, len(pkg), len(buf))
+			}
+		}
+		ca.Close()
+		cb.Close()
+	}
+}
+
+func TestConnTruncatedPackage(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	go func() {
+		lbuf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(lbuf, 100)
+		a.Write(append(lbuf, "short"...))
+		a.Close()
+	}()
+
+	_, err := CreateConn(b).ReadPackage()
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestConnWriteLongPackage(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	_, err := CreateConn(a).WritePackage(make([]byte, MaxPacketSize+1))
+	if err != ErrLongPacket {
+		t.Fatalf("expected %v, got %v", ErrLongPacket, err)
+	}
+}
+
+func TestConnDatagram(t *testing.T) {
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	reader := CreateConn(ln)
+	defer reader.Close()
+
+	raw, err := net.Dial("udp", ln.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := CreateConn(raw)
+	defer writer.Close()
+
+	// Length and data in separate datagrams
+	_, err = writer.WritePackage([]byte("split"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := reader.ReadPackage()
+	if err != nil || string(buf) != "split" {
+		t.Fatalf("expected split, got %q: %v", buf, err)
+	}
+
+	// Length and data in one datagram
+	lbuf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(lbuf, 6)
+	raw.Write(append(lbuf, "single"...))
+	buf, err = reader.ReadPackage()
+	if err != nil || string(buf) != "single" {
+		t.Fatalf("expected single, got %q: %v", buf, err)
+	}
+}
+
+func TestConnLongPackage(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go func() {
+		lbuf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(lbuf, MaxPacketSize+1)
+		a.Write(lbuf)
+	}()
+
+	_, err := CreateConn(b).ReadPackage()
+	if err != ErrLongPacket {
+		t.Fatalf("expected %v, got %v", ErrLongPacket, err)
+	}
+}
+
+func TestConnPacketLimits(t *testing.T) {
+	a, b := net.Pipe()
+	ca, cb := CreateConn(a), CreateConn(b)
+	defer ca.Close()
+	defer cb.Close()
+
+	big := bytes.Repeat([]byte{0x33}, 3*int(MaxPacketSize))
+	if _, err := ca.WritePackage(big); err != ErrLongPacket {
+		t.Fatalf("expected %v, got %v", ErrLongPacket, err)
+	}
+
+	ca.setLimits(MaxPacketSize, 4*MaxPacketSize)
+	cb.setLimits(4*MaxPacketSize, MaxPacketSize)
+	go ca.WritePackage(big)
+	buf, err := cb.ReadPackage()
+	if err != nil || !bytes.Equal(buf, big) {
+		t.Fatalf("big package isn't read: %v", err)
+	}
+
+	// Reader with default limit refuses package
+	go ca.WritePackage(big)
+	if _, err := CreateConn(b).ReadPackage(); err != ErrLongPacket {
+		t.Fatalf("expected %v, got %v", ErrLongPacket, err)
+	}
+
+	ca.setLimits(1, 1<<31)
+	if ca.maxRead() != MaxPacketSize || ca.maxWrite() != LimitPacketSize {
+		t.Fatalf("limits aren't clamped: %d %d", ca.maxRead(), ca.maxWrite())
+	}
+}
+
+func TestPeerRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	for name, pair := range cryptoPairs(t) {
+		t.Run(name, func(t *testing.T) {
+			csA, csB := pair()
+			pa := &Peer{Conn: CreateConn(a), Crypto: csA}
+			pb := &Peer{Conn: CreateConn(b), Crypto: csB}
+
+			go func() {
+				for _, msg := range []string{"first", "second", "third"} {
+					err := sendCommand(pa, send, []byte(msg))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+
+			for _, msg := range []string{"first", "second", "third"} {
+				buf, err := pb.ReadPackage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler, arg, err := PeerCommands.GetHandler(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if handler == nil || string(arg) != msg {
+					t.Fatalf("expected %q, got %q", msg, arg)
+				}
+			}
+		})
+	}
+}
+
+func TestPeerRejectsForgedPackage(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	csA, csB := cryptoPairs(t)["aes-256-gcm"]()
+	pb := &Peer{Conn: CreateConn(b), Crypto: csB}
+
+	go func() {
+		enc, _ := csA.AuthAndEncrypt(packCommand(send, []byte("hello")))
+		enc[len(enc)-1] ^= 1
+		CreateConn(a).WritePackage(enc)
+	}()
+
+	_, err := pb.ReadPackage()
+	if err != ErrAuth {
+		t.Fatalf("expected %v, got %v", ErrAuth, err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	sizes := []int{0, 1, StreamChunkSize, StreamChunkSize + 1, 3*StreamChunkSize - 7, 100000}
+
+	for name, pair := range cryptoPairs(t) {
+		t.Run(name, func(t *testing.T) {
+			ca, cb := fragmentingPipe(7)
+			defer ca.Close()
+			defer cb.Close()
+
+			csA, csB := pair()
+			pa := &Peer{Conn: ca, Crypto: csA}
+			pb := &Peer{Conn: cb, Crypto: csB}
+
+			for _, size := range sizes {
+				payload := make([]byte, size)
+				rand.Read(payload)
+
+				go func() {
+					stream := CreateStreamWriter(pa)
+					// Odd writes check chunk boundaries
+					for data := payload; len(data) > 0; {
+						n := len(data)
+						if n > 1000 {
+							n = 1000
+						}
+						_, err := stream.Write(data[:n])
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						data = data[n:]
+					}
+					if err := stream.Close(); err != nil {
+						t.Error(err)
+					}
+				}()
+
+				buf, err := io.ReadAll(CreateStreamReader(pb))
+				if err != nil {
+					t.Fatalf("size %d: %v", size, err)
+				}
+				if !bytes.Equal(buf, payload) {
+					t.Fatalf("size %d: payload mismatch, got %d bytes", size, len(buf))
+				}
+			}
+		})
+	}
+}
+
+func TestStreamBrokenChunk(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go CreateConn(a).WritePackage([]byte{7, 'x'})
+
+	_, err := io.ReadAll(CreateStreamReader(CreateConn(b)))
+	if err != ErrStreamChunk {
+		t.Fatalf("expected %v, got %v", ErrStreamChunk, err)
+	}
+}
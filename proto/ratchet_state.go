@@ -0,0 +1,301 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+
+Double ratchet record format:
+
+version (1 byte) | ratchet key (32 bytes) | PN (4 bytes, LE) | N (4 bytes, LE) | ciphertext | tag
+
+PN is the length of the previous sending chain, N is the number of message in
+the current sending chain. Header is associated data together with handshake
+transcript hash.
+
+*/
+
+const (
+	RatchetRecordVersion = 3
+	ratchetKeySize       = 32
+	ratchetHeaderSize    = 1 + ratchetKeySize + 4 + 4
+
+	MaxSkip        = 1000
+	MaxSkippedKeys = 2000
+)
+
+var (
+	ErrRatchetKey     = errors.New("wrong ratchet key")
+	ErrTooManySkipped = errors.New("too many skipped messages")
+)
+
+type skippedKey struct {
+	dh [ratchetKeySize]byte
+	n  uint32
+}
+
+type ratchetChains struct {
+	RootKey   []byte
+	SendChain []byte
+	RecChain  []byte
+	SendDH    *ecdh.PrivateKey
+	RecDH     []byte
+	SendN     uint32
+	RecN      uint32
+	PrevN     uint32
+}
+
+// RatchetState is a double ratchet: every message is encrypted with its own
+// key, new DH ratchet key is generated every time the direction of
+// conversation changes.
+type RatchetState struct {
+	mutex sync.Mutex
+	ratchetChains
+	ad      []byte
+	skipped map[skippedKey][]byte
+	order   []skippedKey
+}
+
+// InitRatchetState starts ratchet from handshake secret. User B uses his
+// handshake ephemeral key as the first ratchet key, user A performs the first
+// DH ratchet step against it. Both users also get initial chains, so user B
+// can send before he receives anything.
+func InitRatchetState(secret, transcript []byte, ephemeral *ecdh.PrivateKey, peerEphemeral []byte, isUserA bool) (*RatchetState, error) {
+	prk := hkdf.Extract(sha256.New, secret, transcript)
+	ad := sha256.Sum256(transcript)
+
+	rs := &RatchetState{
+		ad:      ad[:],
+		skipped: make(map[skippedKey][]byte),
+	}
+	rs.RootKey = hkdfExpand(prk, "Root key")
+	chainB := hkdfExpand(prk, "Chain from B to A")
+
+	if !isUserA {
+		rs.SendDH = ephemeral
+		rs.SendChain = chainB
+		return rs, nil
+	}
+
+	if len(peerEphemeral) != ratchetKeySize {
+		return nil, ErrRatchetKey
+	}
+
+	var err error
+	rs.RecDH = peerEphemeral
+	rs.RecChain = chainB
+	rs.SendDH, err = ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	rs.RootKey, rs.SendChain, err = kdfRoot(rs.RootKey, rs.SendDH, rs.RecDH)
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (rs *RatchetState) AuthAndEncrypt(data []byte) ([]byte, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if rs.SendN == MaxMessagesCount {
+		return nil, ErrCounterOverflow
+	}
+
+	var mk []byte
+	rs.SendChain, mk = kdfChain(rs.SendChain)
+
+	header := make([]byte, ratchetHeaderSize, ratchetHeaderSize+len(data)+16)
+	header[0] = RatchetRecordVersion
+	copy(header[1:], rs.SendDH.PublicKey().Bytes())
+	binary.LittleEndian.PutUint32(header[1+ratchetKeySize:], rs.PrevN)
+	binary.LittleEndian.PutUint32(header[1+ratchetKeySize+4:], rs.SendN)
+	rs.SendN++
+
+	aead, nonce := messageCipher(mk)
+	return aead.Seal(header, nonce, data, rs.associatedData(header)), nil
+}
+
+func (rs *RatchetState) DecryptAndAuth(data []byte) ([]byte, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if len(data) < ratchetHeaderSize+16 {
+		return nil, ErrShortMessage
+	}
+
+	header := data[:ratchetHeaderSize]
+	if header[0] != RatchetRecordVersion {
+		return nil, ErrRecordVersion
+	}
+
+	var key skippedKey
+	copy(key.dh[:], header[1:])
+	dh := key.dh[:]
+	pn := binary.LittleEndian.Uint32(header[1+ratchetKeySize:])
+	key.n = binary.LittleEndian.Uint32(header[1+ratchetKeySize+4:])
+	ad := rs.associatedData(header)
+
+	// Delayed message from one of the previous chains
+	if mk, ok := rs.skipped[key]; ok {
+		plainText, err := openMessage(mk, data[ratchetHeaderSize:], ad)
+		if err != nil {
+			return nil, err
+		}
+		delete(rs.skipped, key)
+		return plainText, nil
+	}
+
+	// Work on a copy, so forged message can't break the state
+	chains := rs.ratchetChains
+	var skipped map[skippedKey][]byte
+
+	if !bytes.Equal(dh, chains.RecDH) {
+		if chains.RecChain != nil {
+			if err := chains.skip(pn, &skipped); err != nil {
+				return nil, err
+			}
+		}
+		if err := chains.step(dh); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := chains.skip(key.n, &skipped); err != nil {
+		return nil, err
+	}
+
+	var mk []byte
+	chains.RecChain, mk = kdfChain(chains.RecChain)
+	chains.RecN++
+
+	plainText, err := openMessage(mk, data[ratchetHeaderSize:], ad)
+	if err != nil {
+		return nil, err
+	}
+
+	rs.ratchetChains = chains
+	for k, v := range skipped {
+		rs.addSkipped(k, v)
+	}
+	return plainText, nil
+}
+
+// skip stores message keys of the current receiving chain up to message n.
+func (rc *ratchetChains) skip(n uint32, skipped *map[skippedKey][]byte) error {
+	if n < rc.RecN {
+		return ErrLowCounter
+	}
+	if n-rc.RecN > MaxSkip {
+		return ErrTooManySkipped
+	}
+
+	if n > rc.RecN && *skipped == nil {
+		*skipped = make(map[skippedKey][]byte)
+	}
+
+	var key skippedKey
+	copy(key.dh[:], rc.RecDH)
+	for ; rc.RecN < n; rc.RecN++ {
+		var mk []byte
+		rc.RecChain, mk = kdfChain(rc.RecChain)
+		key.n = rc.RecN
+		(*skipped)[key] = mk
+	}
+	return nil
+}
+
+// step performs DH ratchet step on new ratchet key of second user.
+func (rc *ratchetChains) step(dh []byte) error {
+	var err error
+
+	rc.PrevN = rc.SendN
+	rc.SendN = 0
+	rc.RecN = 0
+	rc.RecDH = append([]byte{}, dh...)
+
+	rc.RootKey, rc.RecChain, err = kdfRoot(rc.RootKey, rc.SendDH, rc.RecDH)
+	if err != nil {
+		return err
+	}
+
+	rc.SendDH, err = ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	rc.RootKey, rc.SendChain, err = kdfRoot(rc.RootKey, rc.SendDH, rc.RecDH)
+	return err
+}
+
+// addSkipped stores message key, the oldest keys are evicted once
+// MaxSkippedKeys is reached.
+func (rs *RatchetState) addSkipped(key skippedKey, mk []byte) {
+	rs.skipped[key] = mk
+	rs.order = append(rs.order, key)
+
+	for len(rs.skipped) > MaxSkippedKeys || len(rs.order) > 2*MaxSkippedKeys {
+		delete(rs.skipped, rs.order[0])
+		rs.order = rs.order[1:]
+	}
+}
+
+func (rs *RatchetState) associatedData(header []byte) []byte {
+	ad := make([]byte, 0, len(rs.ad)+len(header))
+	ad = append(ad, rs.ad...)
+	return append(ad, header...)
+}
+
+func kdfRoot(rk []byte, priv *ecdh.PrivateKey, pub []byte) ([]byte, []byte, error) {
+	dh, err := x25519(priv, pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]byte, 64)
+	io.ReadFull(hkdf.New(sha256.New, dh, rk, []byte("sechan ratchet")), keys)
+	return keys[:32], keys[32:], nil
+}
+
+func kdfChain(ck []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write([]byte{1})
+	mk := mac.Sum(nil)
+
+	mac.Reset()
+	mac.Write([]byte{2})
+	return mac.Sum(nil), mk
+}
+
+func messageCipher(mk []byte) (cipher.AEAD, []byte) {
+	keys := make([]byte, 32+12)
+	io.ReadFull(hkdf.New(sha256.New, mk, nil, []byte("sechan message key")), keys)
+
+	block, _ := aes.NewCipher(keys[:32])
+	aead, _ := cipher.NewGCM(block)
+	return aead, keys[32:]
+}
+
+func openMessage(mk, data, ad []byte) ([]byte, error) {
+	aead, nonce := messageCipher(mk)
+	plainText, err := aead.Open(nil, nonce, data, ad)
+	if err != nil {
+		return nil, ErrAuth
+	}
+	return plainText, nil
+}
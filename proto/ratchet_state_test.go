@@ -0,0 +1,116 @@
+package proto
+
+import (
+	"fmt"
+	"testing"
+)
+
+// ratchetPair returns user B, which sends first, and user A.
+func ratchetPair(t *testing.T) (*RatchetState, *RatchetState) {
+	ephemeral := testEphemeral(t)
+	b, err := InitRatchetState(testSecret, testTranscript, ephemeral, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := InitRatchetState(testSecret, testTranscript, nil, ephemeral.PublicKey().Bytes(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, a
+}
+
+func encryptAll(t *testing.T, cs CryptoState, prefix string, count int) [][]byte {
+	t.Helper()
+	msgs := make([][]byte, count)
+	for i := range msgs {
+		enc, err := cs.AuthAndEncrypt([]byte(fmt.Sprintf("%s %d", prefix, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs[i] = enc
+	}
+	return msgs
+}
+
+func expectPlain(t *testing.T, cs CryptoState, enc []byte, expected string) {
+	t.Helper()
+	plain, err := cs.DecryptAndAuth(enc)
+	if err != nil {
+		t.Fatalf("%s: %v", expected, err)
+	}
+	if string(plain) != expected {
+		t.Fatalf("expected %q, got %q", expected, plain)
+	}
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	b, a := ratchetPair(t)
+
+	first := encryptAll(t, b, "first", 5)
+	for _, i := range []int{4, 0, 2} {
+		expectPlain(t, a, first[i], fmt.Sprintf("first %d", i))
+	}
+
+	// Reply makes B take a DH ratchet step
+	reply := encryptAll(t, a, "reply", 2)
+	expectPlain(t, b, reply[1], "reply 1")
+	second := encryptAll(t, b, "second", 2)
+	expectPlain(t, a, second[1], "second 1")
+
+	// Messages of the previous chains are still accepted once
+	expectPlain(t, a, first[3], "first 3")
+	expectPlain(t, a, first[1], "first 1")
+	expectPlain(t, a, second[0], "second 0")
+	expectPlain(t, b, reply[0], "reply 0")
+	for _, enc := range [][]byte{first[1], first[4], second[0]} {
+		if _, err := a.DecryptAndAuth(enc); err == nil {
+			t.Fatal("replayed message accepted")
+		}
+	}
+	if len(a.skipped) != 0 || len(b.skipped) != 0 {
+		t.Fatalf("used keys are kept: %d %d", len(a.skipped), len(b.skipped))
+	}
+}
+
+func TestRatchetMaxSkip(t *testing.T) {
+	b, a := ratchetPair(t)
+	msgs := encryptAll(t, b, "msg", MaxSkip+2)
+
+	if _, err := a.DecryptAndAuth(msgs[MaxSkip+1]); err != ErrTooManySkipped {
+		t.Fatalf("expected %v, got %v", ErrTooManySkipped, err)
+	}
+	if len(a.skipped) != 0 || a.RecN != 0 {
+		t.Fatal("refused message changed the state")
+	}
+
+	expectPlain(t, a, msgs[MaxSkip], fmt.Sprintf("msg %d", MaxSkip))
+	if len(a.skipped) != MaxSkip {
+		t.Fatalf("expected %d skipped keys, got %d", MaxSkip, len(a.skipped))
+	}
+	expectPlain(t, a, msgs[0], "msg 0")
+	expectPlain(t, a, msgs[MaxSkip+1], fmt.Sprintf("msg %d", MaxSkip+1))
+}
+
+func TestRatchetSkippedEviction(t *testing.T) {
+	b, a := ratchetPair(t)
+
+	// Every round skips MaxSkip messages of a new chain of B
+	rounds := make([][][]byte, MaxSkippedKeys/MaxSkip+1)
+	for r := range rounds {
+		rounds[r] = encryptAll(t, b, fmt.Sprintf("round %d", r), MaxSkip+1)
+		expectPlain(t, a, rounds[r][MaxSkip], fmt.Sprintf("round %d %d", r, MaxSkip))
+
+		reply := encryptAll(t, a, "reply", 1)
+		expectPlain(t, b, reply[0], "reply 0")
+	}
+
+	if len(a.skipped) > MaxSkippedKeys {
+		t.Fatalf("%d skipped keys are kept, limit is %d", len(a.skipped), MaxSkippedKeys)
+	}
+	// The oldest keys are evicted first
+	if _, err := a.DecryptAndAuth(rounds[0][0]); err == nil {
+		t.Fatal("evicted key is used")
+	}
+	last := len(rounds) - 1
+	expectPlain(t, a, rounds[last][0], fmt.Sprintf("round %d 0", last))
+}
@@ -0,0 +1,210 @@
+package proto
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+
+Rekey runs X25519 exchange over the encrypted channel:
+
+RKEY eph - initiator offers ephemeral key, sent under the old keys
+RERK eph - responder answers with ephemeral key under the old keys and
+           switches its sending direction to the new keys
+RKOK     - initiator confirms under the old keys and switches its sending
+           direction, responder switches receiving direction on it
+
+Every direction switches right after a message, so nothing in flight is lost.
+
+Only AEAD and aes-256-hmac sessions of protocol v2 are rekeyed. Double
+ratchet sessions, the default suite, renew keys by themselves: every message
+has its own key and a new DH ratchet key is used every time the direction of
+conversation changes, so RekeyPolicy doesn't apply to them.
+
+*/
+
+type RekeyPolicy struct {
+	Messages uint32
+	Bytes    uint64
+	Interval time.Duration
+}
+
+type Rekey struct {
+	Ephemeral []byte
+}
+
+type session struct {
+	secret    []byte
+	suite     uint8
+	isUserA   bool
+	rekeyable bool
+	window    uint32
+}
+
+type rekeyState struct {
+	priv *ecdh.PrivateKey
+}
+
+var DefaultRekeyPolicy = RekeyPolicy{
+	Messages: 1 << 24,
+	Bytes:    1 << 32,
+	Interval: time.Hour,
+}
+
+var ErrUnexpectedRekey = errors.New("unexpected rekey response")
+
+// due reports whether session keys have to be changed.
+func (policy *RekeyPolicy) due(messages uint32, bytes uint64, since time.Time) bool {
+	return (policy.Messages != 0 && messages >= policy.Messages) ||
+		(policy.Bytes != 0 && bytes >= policy.Bytes) ||
+		(policy.Interval != 0 && time.Since(since) >= policy.Interval)
+}
+
+// StartRekey sends RKEY unless rekey is already in progress.
+func (p *Peer) StartRekey() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.startRekey()
+}
+
+func (p *Peer) startRekey() error {
+	if !p.session.rekeyable || p.rekey != nil {
+		return nil
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	js, _ := json.Marshal(Rekey{Ephemeral: priv.PublicKey().Bytes()})
+	_, err = p.writePackage(packCommand(rkey, js))
+	if err != nil {
+		return err
+	}
+
+	p.rekey = &rekeyState{priv: priv}
+	return nil
+}
+
+// acceptRekey answers RKEY from second user. If both users have started
+// rekey simultaneously, rekey of user A wins.
+func (p *Peer) acceptRekey(data []byte) error {
+	msg := &Rekey{}
+	err := json.Unmarshal(data, msg)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.session.rekeyable {
+		return wrongCommandData(rkey)
+	}
+
+	if p.rekey != nil {
+		if p.session.isUserA {
+			return nil
+		}
+		p.rekey = nil
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	next, secret, err := p.session.next(priv, msg.Ephemeral)
+	if err != nil {
+		return err
+	}
+
+	js, _ := json.Marshal(Rekey{Ephemeral: priv.PublicKey().Bytes()})
+	_, err = p.writePackage(packCommand(rerk, js))
+	if err != nil {
+		return err
+	}
+
+	// Second user keeps sending under the old keys until RKOK
+	p.recCrypto = p.Crypto
+	p.switchCrypto(next, secret)
+	return nil
+}
+
+func (p *Peer) finishRekey(data []byte) error {
+	msg := &Rekey{}
+	err := json.Unmarshal(data, msg)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.rekey == nil {
+		return ErrUnexpectedRekey
+	}
+
+	next, secret, err := p.session.next(p.rekey.priv, msg.Ephemeral)
+	if err != nil {
+		return err
+	}
+	p.rekey = nil
+
+	_, err = p.writePackage(packCommand(rkok, nil))
+	if err != nil {
+		return err
+	}
+
+	p.recCrypto = nil
+	p.switchCrypto(next, secret)
+	return nil
+}
+
+func (p *Peer) confirmRekey() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.recCrypto == nil {
+		return ErrUnexpectedRekey
+	}
+	p.recCrypto = nil
+	return nil
+}
+
+func (p *Peer) switchCrypto(next CryptoState, secret []byte) {
+	p.Crypto = next
+	p.session.secret = secret
+	p.sentMessages = 0
+	p.sentBytes = 0
+	p.keyTime = time.Now()
+}
+
+// next derives crypto state from the current session secret and result of
+// X25519 exchange.
+func (s *session) next(priv *ecdh.PrivateKey, peerPub []byte) (CryptoState, []byte, error) {
+	dh, err := x25519(priv, peerPub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret := hkdf.Extract(sha256.New, dh, s.secret)
+	if s.suite == SuiteCTRHMAC {
+		return DeriveCryptoState(secret, nil, s.isUserA), secret, nil
+	}
+
+	cs, err := DeriveAEADState(secret, nil, s.suite, s.isUserA)
+	if err != nil {
+		return nil, nil, err
+	}
+	cs.SetReplayWindow(s.window)
+	return cs, secret, nil
+}
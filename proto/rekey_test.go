@@ -0,0 +1,91 @@
+package proto
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRekey(t *testing.T) {
+	suites := map[string]uint8{
+		"aes-256-hmac":      SuiteCTRHMAC,
+		"aes-256-gcm":       SuiteAESGCM,
+		"chacha20-poly1305": SuiteChaCha20Poly1305,
+	}
+
+	for name, suite := range suites {
+		t.Run(name, func(t *testing.T) {
+			network := CreateMemoryNetwork()
+			a, b := testHost(t, "a", network.Transport("10.0.0.1")), testHost(t, "b", network.Transport("10.0.0.2"))
+			for _, host := range []*Host{a, b} {
+				host.Suites = []uint8{suite}
+				host.Rekey = RekeyPolicy{Messages: 5}
+			}
+			subA, subB := a.Events.Subscribe(), b.Events.Subscribe()
+			pa, pb := connectHosts(t, a, b, "10.0.0.1:7000")
+			defer pa.Close()
+			defer pb.Close()
+
+			pa.mutex.Lock()
+			first := pa.Crypto
+			pa.mutex.Unlock()
+
+			// Both sides send meanwhile, so rekeys cross messages in flight
+			const count = 40
+			done := make(chan error, 2)
+			for _, peer := range []*Peer{pa, pb} {
+				go func(peer *Peer) {
+					for i := 0; i < count; i++ {
+						if err := sendCommand(peer, send, []byte(fmt.Sprint(i))); err != nil {
+							done <- err
+							return
+						}
+					}
+					done <- nil
+				}(peer)
+			}
+			for i := 0; i < 2; i++ {
+				if err := <-done; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, sub := range []*Subscription{subA, subB} {
+				for i := 0; i < count; i++ {
+					if msg := expectEvent(t, sub, "Message"); msg.Data != fmt.Sprint(i) {
+						t.Fatalf("expected message %d, got %q", i, msg.Data)
+					}
+				}
+			}
+
+			// The last rekey may still run
+			for i := 0; ; i++ {
+				pa.mutex.Lock()
+				changed := pa.Crypto != first && pa.rekey == nil && pa.recCrypto == nil
+				pa.mutex.Unlock()
+				if changed {
+					break
+				}
+				if i == 100 {
+					t.Fatal("session keys aren't changed")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestRatchetSessionNotRekeyed(t *testing.T) {
+	network := CreateMemoryNetwork()
+	a, b := testHost(t, "a", network.Transport("10.0.0.1")), testHost(t, "b", network.Transport("10.0.0.2"))
+	pa, pb := connectHosts(t, a, b, "10.0.0.1:7000")
+	defer pa.Close()
+	defer pb.Close()
+
+	if _, ok := pb.Crypto.(*RatchetState); !ok || pb.session.rekeyable {
+		t.Fatalf("default session isn't a ratchet one: %T", pb.Crypto)
+	}
+	if err := pb.StartRekey(); err != nil || pb.rekey != nil {
+		t.Fatalf("ratchet session started rekey: %v", err)
+	}
+}
@@ -0,0 +1,381 @@
+package proto
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	DefaultRelayHops = 3
+
+	// Peers which announce relay feature in REFO forward RLAY packets
+	featureRelay = "relay"
+
+	relaySeenSize   = 4096
+	relayRoutesSize = 4096
+	relayLabel      = "sechan relay"
+)
+
+// relayPacket is the body of RLAY command. Only the target can open Sealed,
+// relays see fingerprint of its identity key.
+type relayPacket struct {
+	Id        string
+	To        string
+	Hops      uint8
+	Ephemeral []byte
+	Sealed    []byte
+}
+
+// sealedMessage is the plaintext of relayPacket. Sig binds the envelope to
+// the target key and the ephemeral key of the packet.
+type sealedMessage struct {
+	From     ed25519.PublicKey
+	Envelope []byte
+	Sig      []byte
+}
+
+// seenSet remembers ids of the last relayed packets to drop duplicates.
+type seenSet struct {
+	mutex sync.Mutex
+	ids   map[string]struct{}
+	order []string
+}
+
+// envelopeSet remembers ids of relayed envelopes while they're in
+// RelayWindow, older envelopes are refused by their signed time.
+type envelopeSet struct {
+	mutex sync.Mutex
+	ids   map[string]time.Time
+}
+
+// relayRoutes remembers fingerprints of identity keys from peer lists sent by
+// peers. They only show where to forward packets, peers aren't trusted with
+// them.
+type relayRoutes struct {
+	mutex sync.Mutex
+	known map[string]map[string]struct{}
+}
+
+var (
+	ErrRelayDisabled = errors.New("relay is disabled")
+	ErrRelayHops     = errors.New("relay hop limit is exceeded")
+	ErrRelayTarget   = errors.New("identity key of relay target is unknown")
+	ErrRelayKey      = errors.New("wrong identity key for relay")
+	ErrRelayOpen     = errors.New("failed to open relayed message")
+	ErrRelaySig      = errors.New("relayed message signature is invalid")
+	ErrNoRelay       = errors.New("no connected relay knows the target")
+	ErrRelayTime     = errors.New("relayed message is too old or from the future")
+)
+
+// RelayWindow bounds difference between time of relayed envelope and the
+// local clock, so relays can't replay packets after restart
+var RelayWindow = 10 * time.Minute
+
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// SendRelayed seals envelope for known peer id and hands it to relays.
+func (host *Host) SendRelayed(id string, env *Envelope) error {
+	known, ok := host.Peers.Get(id)
+	if !ok || known.Key == nil {
+		return ErrRelayTarget
+	}
+
+	pkt, err := sealRelay(host.Identity, known.Key, env, host.relayHops())
+	if err != nil {
+		return err
+	}
+	host.relayed.add(pkt.Id)
+	return host.forwardRelay(pkt, "")
+}
+
+// forwardRelay sends packet to its target if there is session with it, or to
+// relays which know the target except the one it came from.
+func (host *Host) forwardRelay(pkt *relayPacket, from string) error {
+	js, _ := json.Marshal(pkt)
+	for ip := range host.Peers.ByFingerprint(pkt.To) {
+		if target, err := host.Session(ip); err == nil {
+			return sendCommand(target, rlay, js)
+		}
+	}
+
+	sent := false
+	for id, peer := range host.livePeers() {
+		if id == from || !peer.HasFeature(featureRelay) || !host.routes.reaches(id, pkt.To) {
+			continue
+		}
+		if sendCommand(peer, rlay, js) == nil {
+			sent = true
+		}
+	}
+	if !sent {
+		return ErrNoRelay
+	}
+	return nil
+}
+
+func (host *Host) receiveRelayed(via *Peer, pkt *relayPacket) error {
+	sealed, env, err := openRelay(host.Identity, pkt)
+	if err != nil {
+		return err
+	}
+	if age := time.Since(env.Time); age > RelayWindow || age < -RelayWindow {
+		return ErrRelayTime
+	}
+	// Relays can change packet id, but not envelope id
+	if !host.envelopes.add(env.Id, env.Time) {
+		return nil
+	}
+
+	msg := env.message("Message")
+	msg.From = Fingerprint(sealed.From)
+	msg.Via = sessionID(via)
+	for ip, known := range host.Peers.ByFingerprint(msg.From) {
+		msg.Peer = ip
+		msg.Login = known.Login
+		msg.Addr = known.Addr
+		break
+	}
+	host.Record(&msg)
+
+	js, _ := json.Marshal(msg)
+	host.Events.Publish(string(js))
+	return nil
+}
+
+// announcePeers sends peer list of relay to every session except id, so
+// they know whom the relay reaches.
+func (host *Host) announcePeers(except string) {
+	js, _ := json.Marshal(host.Peers.announced())
+	for id, peer := range host.livePeers() {
+		if id != except {
+			sendCommand(peer, reli, js)
+		}
+	}
+}
+
+func (host *Host) relayHops() uint8 {
+	if host.RelayHops == 0 {
+		return DefaultRelayHops
+	}
+	return host.RelayHops
+}
+
+func (host *Host) features() []string {
+	features := []string{featureEnvelope, featureTransfer, featureBinaryChunks}
+	if host.Relay {
+		features = append(features, featureRelay)
+	}
+	return features
+}
+
+func sealRelay(id *Identity, to ed25519.PublicKey, env *Envelope, hops uint8) (*relayPacket, error) {
+	target, err := sealingPublic(to)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := x25519(eph, target)
+	if err != nil {
+		return nil, err
+	}
+
+	ephPub := eph.PublicKey().Bytes()
+	body, _ := json.Marshal(env)
+	plain, _ := json.Marshal(sealedMessage{
+		From:     id.Public,
+		Envelope: body,
+		Sig:      ed25519.Sign(id.Private, relaySigData(to, ephPub, body)),
+	})
+
+	aead, err := relayAEAD(secret, ephPub, target)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := Fingerprint(to)
+	return &relayPacket{
+		Id:        env.Id,
+		To:        fingerprint,
+		Hops:      hops,
+		Ephemeral: ephPub,
+		// Key is never reused, so nonce is constant
+		Sealed: aead.Seal(nil, make([]byte, aead.NonceSize()), plain, []byte(fingerprint)),
+	}, nil
+}
+
+func openRelay(id *Identity, pkt *relayPacket) (*sealedMessage, *Envelope, error) {
+	priv, err := id.sealingKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := x25519(priv, pkt.Ephemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := relayAEAD(secret, pkt.Ephemeral, priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), pkt.Sealed, []byte(pkt.To))
+	if err != nil {
+		return nil, nil, ErrRelayOpen
+	}
+
+	sealed := &sealedMessage{}
+	err = json.Unmarshal(plain, sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(sealed.From) != ed25519.PublicKeySize ||
+		!ed25519.Verify(sealed.From, relaySigData(id.Public, pkt.Ephemeral, sealed.Envelope), sealed.Sig) {
+		return nil, nil, ErrRelaySig
+	}
+
+	env := &Envelope{}
+	err = json.Unmarshal(sealed.Envelope, env)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sealed, env, env.check()
+}
+
+func relayAEAD(secret, ephemeral, target []byte) (cipher.AEAD, error) {
+	prk := hkdf.Extract(sha256.New, secret, append(append([]byte{}, ephemeral...), target...))
+	return chacha20poly1305.New(hkdfExpand(prk, relayLabel))
+}
+
+func relaySigData(to ed25519.PublicKey, ephemeral, envelope []byte) []byte {
+	data := []byte(relayLabel)
+	data = append(data, to...)
+	data = append(data, ephemeral...)
+	return append(data, envelope...)
+}
+
+// sealingKey returns X25519 key of identity. It's the Montgomery form of the
+// Ed25519 key, so peers get its public part from the pinned identity key.
+func (id *Identity) sealingKey() (*ecdh.PrivateKey, error) {
+	if len(id.Private) != ed25519.PrivateKeySize {
+		return nil, ErrRelayKey
+	}
+	h := sha512.Sum512(id.Private.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+// sealingPublic maps Ed25519 public key to X25519: u = (1 + y) / (1 - y).
+func sealingPublic(key ed25519.PublicKey) ([]byte, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, ErrRelayKey
+	}
+
+	le := make([]byte, len(key))
+	for i := range key {
+		le[len(key)-1-i] = key[i]
+	}
+	le[0] &= 0x7f
+	y := new(big.Int).SetBytes(le)
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, ErrRelayKey
+	}
+
+	num := new(big.Int).Add(big.NewInt(1), y)
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, ErrRelayKey
+	}
+	u := num.Mul(num, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+
+	be := u.FillBytes(make([]byte, 32))
+	for i, j := 0, len(be)-1; i < j; i, j = i+1, j-1 {
+		be[i], be[j] = be[j], be[i]
+	}
+	return be, nil
+}
+
+// add reports whether id is seen for the first time.
+func (s *seenSet) add(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ids == nil {
+		s.ids = make(map[string]struct{})
+	}
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	if len(s.order) == relaySeenSize {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.ids[id] = struct{}{}
+	s.order = append(s.order, id)
+	return true
+}
+
+// add remembers envelope id with its time and forgets envelopes which left
+// RelayWindow.
+func (s *envelopeSet) add(id string, sent time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ids == nil {
+		s.ids = make(map[string]time.Time)
+	}
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	for seen, t := range s.ids {
+		if time.Since(t) > RelayWindow {
+			delete(s.ids, seen)
+		}
+	}
+	s.ids[id] = sent
+	return true
+}
+
+// set replaces fingerprints known by peer of session id with the ones from
+// its peer list.
+func (r *relayRoutes) set(id string, peers map[string]*Peer) {
+	fingerprints := make(map[string]struct{})
+	for _, peer := range peers {
+		if len(fingerprints) == relayRoutesSize {
+			break
+		}
+		if peer != nil && len(peer.Key) == ed25519.PublicKeySize {
+			fingerprints[Fingerprint(peer.Key)] = struct{}{}
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.known == nil {
+		r.known = make(map[string]map[string]struct{})
+	}
+	r.known[id] = fingerprints
+}
+
+// reaches reports whether peer of session id knows fingerprint.
+func (r *relayRoutes) reaches(id, fingerprint string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, ok := r.known[id][fingerprint]
+	return ok
+}
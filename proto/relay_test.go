@@ -0,0 +1,263 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRelaySeal(t *testing.T) {
+	from, to := testIdentity(t), testIdentity(t)
+
+	priv, err := to.sealingKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := sealingPublic(to.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pub, priv.PublicKey().Bytes()) {
+		t.Fatal("sealing keys don't match")
+	}
+
+	env, _ := CreateEnvelope("secret", "", "")
+	pkt, err := sealRelay(from, to.Public, env, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.To != Fingerprint(to.Public) || pkt.Id != env.Id || bytes.Contains(pkt.Sealed, []byte("secret")) {
+		t.Fatalf("wrong packet %+v", pkt)
+	}
+
+	sealed, opened, err := openRelay(to, pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sealed.From, from.Public) || opened.Id != env.Id || opened.Data != "secret" {
+		t.Fatalf("wrong message %+v", opened)
+	}
+
+	if _, _, err := openRelay(from, pkt); err != ErrRelayOpen {
+		t.Fatalf("expected %v, got %v", ErrRelayOpen, err)
+	}
+	tampered := *pkt
+	tampered.Sealed = append([]byte(nil), pkt.Sealed...)
+	tampered.Sealed[0] ^= 1
+	if _, _, err := openRelay(to, &tampered); err != ErrRelayOpen {
+		t.Fatalf("expected %v, got %v", ErrRelayOpen, err)
+	}
+
+	// Sender identity must sign the envelope
+	forger := testIdentity(t)
+	forged, _ := sealRelay(forger, to.Public, env, 2)
+	plain := sealedMessage{}
+	forgedKey, _ := to.sealingKey()
+	secret, _ := x25519(forgedKey, forged.Ephemeral)
+	aead, _ := relayAEAD(secret, forged.Ephemeral, forgedKey.PublicKey().Bytes())
+	buf, _ := aead.Open(nil, make([]byte, aead.NonceSize()), forged.Sealed, []byte(forged.To))
+	json.Unmarshal(buf, &plain)
+	plain.From = from.Public
+	buf, _ = json.Marshal(plain)
+	forged.Sealed = aead.Seal(nil, make([]byte, aead.NonceSize()), buf, []byte(forged.To))
+	if _, _, err := openRelay(to, forged); err != ErrRelaySig {
+		t.Fatalf("expected %v, got %v", ErrRelaySig, err)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	network := CreateMemoryNetwork()
+	a := testHost(t, "a", network.Transport("10.0.0.1"))
+	relay := testHost(t, "relay", network.Transport("10.0.0.2"))
+	b := testHost(t, "b", network.Transport("10.0.0.3"))
+	relay.Relay = true
+	serveHost(t, relay, "10.0.0.2:7000")
+	defer a.Disconnect()
+	defer b.Disconnect()
+	subB := b.Events.Subscribe()
+
+	a.Peers.Put("10.0.0.3", &Peer{Login: "b", Key: b.Identity.Public})
+	pa := dialSession(t, a, "10.0.0.2:7000")
+	dialSession(t, b, "10.0.0.2:7000")
+	waitFeature(t, pa, featureRelay)
+	for i := 0; !a.routes.reaches("10.0.0.2", Fingerprint(b.Identity.Public)); i++ {
+		if i == 100 {
+			t.Fatal("route to b isn't announced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	env, _ := CreateEnvelope("through relay", "", "")
+	if err := a.SendRelayed("10.0.0.3", env); err != nil {
+		t.Fatal(err)
+	}
+	msg := expectEvent(t, subB, "Message")
+	if msg.Id != env.Id || msg.Data != "through relay" || msg.From != Fingerprint(a.Identity.Public) ||
+		msg.Via != "10.0.0.2" {
+		t.Fatalf("wrong message %+v", msg)
+	}
+
+	// Duplicates are dropped by envelope id
+	pkt, _ := sealRelay(a.Identity, b.Identity.Public, env, 1)
+	pkt.Id = "other"
+	js, _ := json.Marshal(pkt)
+	pb, _ := b.Session("10.0.0.2")
+	if err := peerRlayHandler(b, pb, js); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.SendRelayed("10.0.0.9", env); err != ErrRelayTarget {
+		t.Fatalf("expected %v, got %v", ErrRelayTarget, err)
+	}
+
+	pkt, _ = sealRelay(a.Identity, testIdentity(t).Public, env, 0)
+	pkt.Id = "hops"
+	js, _ = json.Marshal(pkt)
+	pr, _ := relay.Session("10.0.0.1")
+	if err := peerRlayHandler(relay, pr, js); err != ErrRelayHops {
+		t.Fatalf("expected %v, got %v", ErrRelayHops, err)
+	}
+	pkt.Id, pkt.Hops = "disabled", 1
+	js, _ = json.Marshal(pkt)
+	if err := peerRlayHandler(b, pb, js); err != ErrRelayDisabled {
+		t.Fatalf("expected %v, got %v", ErrRelayDisabled, err)
+	}
+
+	env, _ = CreateEnvelope("once", "", "")
+	if err := a.SendRelayed("10.0.0.3", env); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectEvent(t, subB, "Message"); msg.Data != "once" {
+		t.Fatalf("duplicate message %+v", msg)
+	}
+}
+
+// captureRelay makes host pass RLAY packets it gets to the returned channel.
+func captureRelay(host *Host) <-chan *relayPacket {
+	packets := make(chan *relayPacket, 8)
+	host.Commands = peerCommands()
+	host.Commands.AddCommand(rlay, PeerHandler(func(host *Host, peer *Peer, data []byte) error {
+		pkt := &relayPacket{}
+		json.Unmarshal(data, pkt)
+		packets <- pkt
+		return nil
+	}))
+	return packets
+}
+
+func TestRelayHopLimit(t *testing.T) {
+	network := CreateMemoryNetwork()
+	relay := testHost(t, "relay", network.Transport("10.0.0.1"))
+	b := testHost(t, "b", network.Transport("10.0.0.2"))
+	relay.Relay, relay.RelayHops = true, 2
+	packets := captureRelay(b)
+	pr, pb := connectHosts(t, relay, b, "10.0.0.1:7000")
+	defer pr.Close()
+	defer pb.Close()
+	relay.addSession("10.0.0.2", pr)
+
+	env, _ := CreateEnvelope("far", "", "")
+	pkt, _ := sealRelay(testIdentity(t), b.Identity.Public, env, 200)
+	js, _ := json.Marshal(pkt)
+	if err := peerRlayHandler(relay, &Peer{}, js); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case pkt := <-packets:
+		if pkt.Hops != 1 {
+			t.Fatalf("expected 1 hop left, got %d", pkt.Hops)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("packet isn't forwarded")
+	}
+}
+
+func TestRelayRoutes(t *testing.T) {
+	network := CreateMemoryNetwork()
+	a := testHost(t, "a", network.Transport("10.0.0.1"))
+	relay := testHost(t, "relay", network.Transport("10.0.0.2"))
+	other := testHost(t, "other", network.Transport("10.0.0.3"))
+	b := testHost(t, "b", network.Transport("10.0.0.4"))
+	relay.Relay, other.Relay = true, true
+	serveHost(t, relay, "10.0.0.2:7000")
+	serveHost(t, other, "10.0.0.3:7000")
+	defer a.Disconnect()
+	defer b.Disconnect()
+	packets := captureRelay(other)
+	subB, subOther := b.Events.Subscribe(), other.Events.Subscribe()
+
+	a.Peers.Put("10.0.0.4", &Peer{Login: "b", Key: b.Identity.Public})
+	pr := dialSession(t, a, "10.0.0.2:7000")
+	po := dialSession(t, a, "10.0.0.3:7000")
+	waitFeature(t, pr, featureRelay)
+	waitFeature(t, po, featureRelay)
+
+	// Relay announces b when it connects
+	dialSession(t, b, "10.0.0.2:7000")
+	for i := 0; !a.routes.reaches("10.0.0.2", Fingerprint(b.Identity.Public)); i++ {
+		if i == 100 {
+			t.Fatal("route to b isn't announced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	env, _ := CreateEnvelope("routed", "", "")
+	if err := a.SendRelayed("10.0.0.4", env); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectEvent(t, subB, "Message"); msg.Data != "routed" {
+		t.Fatalf("wrong message %+v", msg)
+	}
+
+	// Packets are ordered, so relay which doesn't know b would have the
+	// packet before this message
+	sendCommand(po, send, []byte("after"))
+	expectMessages(t, subOther, "after", 1)
+	select {
+	case <-packets:
+		t.Fatal("packet is sent to relay which doesn't know the target")
+	default:
+	}
+}
+
+func TestRelayReplay(t *testing.T) {
+	host, via := testPeer(t)
+	defer via.Close()
+	sub := host.Events.Subscribe()
+	from := testIdentity(t)
+
+	relayed := func(sent time.Time) *relayPacket {
+		t.Helper()
+		env, _ := CreateEnvelope("relayed", "", "")
+		env.Time = sent
+		pkt, err := sealRelay(from, host.Identity.Public, env, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pkt
+	}
+
+	pkt := relayed(time.Now())
+	for i := 0; i < 2; i++ {
+		if err := host.receiveRelayed(via, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectEvent(t, sub, "Message")
+
+	// Ids are forgotten on restart, old packets are refused by signed time
+	host.envelopes.ids = nil
+	for _, sent := range []time.Time{time.Now().Add(-RelayWindow - time.Minute), time.Now().Add(RelayWindow + time.Minute)} {
+		if err := host.receiveRelayed(via, relayed(sent)); err != ErrRelayTime {
+			t.Fatalf("expected %v, got %v", ErrRelayTime, err)
+		}
+	}
+
+	select {
+	case js := <-sub.Events:
+		t.Fatalf("replayed message is delivered: %s", js)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
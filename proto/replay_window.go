@@ -0,0 +1,85 @@
+package proto
+
+import "errors"
+
+const DefaultReplayWindow = 1024
+
+var ErrReplay = errors.New("message is replayed")
+
+// ReplayWindow accepts message counters which are not older than size
+// counters behind the highest one, every counter is accepted only once. Bit
+// of counter c is c mod size, like in RFC 6479.
+type ReplayWindow struct {
+	size   uint32
+	top    uint32
+	bitmap []uint64
+}
+
+// CreateReplayWindow creates window, size is rounded up to multiple of 64.
+func CreateReplayWindow(size uint32) *ReplayWindow {
+	if size == 0 {
+		size = DefaultReplayWindow
+	}
+	words := (size + 63) / 64
+	return &ReplayWindow{
+		size:   words * 64,
+		bitmap: make([]uint64, words),
+	}
+}
+
+func (w *ReplayWindow) Size() uint32 {
+	return w.size
+}
+
+// Check reports whether counter can be accepted. Window isn't changed, so
+// counter must be passed to Update after message authentication.
+func (w *ReplayWindow) Check(counter uint32) error {
+	if counter == 0 {
+		return ErrLowCounter
+	}
+
+	if counter > w.top {
+		return nil
+	}
+
+	if w.top-counter >= w.size {
+		return ErrLowCounter
+	}
+
+	if w.bit(counter) {
+		return ErrReplay
+	}
+	return nil
+}
+
+func (w *ReplayWindow) Update(counter uint32) {
+	if counter > w.top {
+		diff := counter - w.top
+		if diff >= w.size {
+			for i := range w.bitmap {
+				w.bitmap[i] = 0
+			}
+		} else {
+			for c := w.top + 1; c != counter; c++ {
+				w.clear(c)
+			}
+		}
+		w.top = counter
+	}
+	w.set(counter)
+}
+
+func (w *ReplayWindow) bit(counter uint32) bool {
+	idx := counter % w.size
+	return w.bitmap[idx/64]&(1<<(idx%64)) != 0
+}
+
+func (w *ReplayWindow) set(counter uint32) {
+	idx := counter % w.size
+	w.bitmap[idx/64] |= 1 << (idx % 64)
+}
+
+func (w *ReplayWindow) clear(counter uint32) {
+	idx := counter % w.size
+	w.bitmap[idx/64] &^= 1 << (idx % 64)
+}
@@ -0,0 +1,142 @@
+package proto
+
+import "testing"
+
+func TestReplayWindowReordering(t *testing.T) {
+	w := CreateReplayWindow(64)
+	for _, ctr := range []uint32{1, 3, 2, 10, 5, 4, 9, 6, 8, 7} {
+		if err := w.Check(ctr); err != nil {
+			t.Fatalf("counter %d: %v", ctr, err)
+		}
+		w.Update(ctr)
+	}
+}
+
+func TestReplayWindowDuplicates(t *testing.T) {
+	w := CreateReplayWindow(64)
+	for _, ctr := range []uint32{1, 2, 5} {
+		w.Update(ctr)
+	}
+
+	for _, ctr := range []uint32{1, 2, 5} {
+		if err := w.Check(ctr); err != ErrReplay {
+			t.Fatalf("counter %d: expected %v, got %v", ctr, ErrReplay, err)
+		}
+	}
+
+	for _, ctr := range []uint32{3, 4} {
+		if err := w.Check(ctr); err != nil {
+			t.Fatalf("counter %d: %v", ctr, err)
+		}
+	}
+
+	if err := w.Check(0); err != ErrLowCounter {
+		t.Fatalf("counter 0: expected %v, got %v", ErrLowCounter, err)
+	}
+}
+
+func TestReplayWindowEdges(t *testing.T) {
+	w := CreateReplayWindow(64)
+	if w.Size() != 64 {
+		t.Fatalf("expected size 64, got %d", w.Size())
+	}
+	w.Update(100)
+
+	// 100-63 is the oldest counter inside window
+	if err := w.Check(37); err != nil {
+		t.Fatalf("counter 37: %v", err)
+	}
+	if err := w.Check(36); err != ErrLowCounter {
+		t.Fatalf("counter 36: expected %v, got %v", ErrLowCounter, err)
+	}
+
+	// Slide by exactly window size: old bits must be cleared
+	w.Update(37)
+	w.Update(164)
+	if err := w.Check(101); err != nil {
+		t.Fatalf("counter 101: %v", err)
+	}
+	if err := w.Check(100); err != ErrLowCounter {
+		t.Fatalf("counter 100: expected %v, got %v", ErrLowCounter, err)
+	}
+
+	// Slide by less than window size: bits of skipped counters are cleared
+	w.Update(101)
+	w.Update(200)
+	for ctr := uint32(165); ctr < 200; ctr++ {
+		if err := w.Check(ctr); err != nil {
+			t.Fatalf("counter %d: %v", ctr, err)
+		}
+	}
+	if err := w.Check(164); err != ErrReplay {
+		t.Fatalf("counter 164: expected %v, got %v", ErrReplay, err)
+	}
+}
+
+func TestReplayWindowRoundsSize(t *testing.T) {
+	if size := CreateReplayWindow(65).Size(); size != 128 {
+		t.Fatalf("expected size 128, got %d", size)
+	}
+	if size := CreateReplayWindow(0).Size(); size != DefaultReplayWindow {
+		t.Fatalf("expected size %d, got %d", DefaultReplayWindow, size)
+	}
+}
+
+func TestAEADStateReplayWindow(t *testing.T) {
+	sender, err := DeriveAEADState([]byte("secret"), []byte("transcript"), SuiteAESGCM, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := DeriveAEADState([]byte("secret"), []byte("transcript"), SuiteAESGCM, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.SetReplayWindow(64)
+
+	msgs := make([][]byte, 5)
+	for i := range msgs {
+		msgs[i], err = sender.AuthAndEncrypt(packCommand(send, []byte{byte(i)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, i := range []int{4, 0, 2, 1, 3} {
+		plain, err := receiver.DecryptAndAuth(msgs[i])
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if plain[CommandLength] != byte(i) {
+			t.Fatalf("message %d: wrong plain text %v", i, plain)
+		}
+	}
+
+	if _, err := receiver.DecryptAndAuth(msgs[2]); err != ErrReplay {
+		t.Fatalf("expected %v, got %v", ErrReplay, err)
+	}
+
+	// Forged message must not move the window
+	forged := append([]byte{}, msgs[0]...)
+	forged[2] = 100
+	if _, err := receiver.DecryptAndAuth(forged); err != ErrAuth {
+		t.Fatalf("expected %v, got %v", ErrAuth, err)
+	}
+	if receiver.MsgRecCtr != 5 {
+		t.Fatalf("expected receive counter 5, got %d", receiver.MsgRecCtr)
+	}
+}
+
+func TestAEADStateStrictCounter(t *testing.T) {
+	sender, _ := DeriveAEADState([]byte("secret"), nil, SuiteChaCha20Poly1305, true)
+	receiver, _ := DeriveAEADState([]byte("secret"), nil, SuiteChaCha20Poly1305, false)
+
+	first, _ := sender.AuthAndEncrypt([]byte("first"))
+	second, _ := sender.AuthAndEncrypt([]byte("second"))
+
+	if _, err := receiver.DecryptAndAuth(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.DecryptAndAuth(first); err != ErrLowCounter {
+		t.Fatalf("expected %v, got %v", ErrLowCounter, err)
+	}
+}
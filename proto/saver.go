@@ -0,0 +1,77 @@
+package proto
+
+import (
+	"log"
+	"sync"
+)
+
+// Saver runs saves of a store one at a time. Changes made while the store is
+// being saved are coalesced into one more save, which takes a fresh snapshot,
+// so an older snapshot never replaces a newer one.
+type Saver struct {
+	save    func() error
+	mutex   sync.Mutex
+	idle    sync.Cond
+	running bool
+	pending bool
+}
+
+func CreateSaver(save func() error) *Saver {
+	s := &Saver{save: save}
+	s.idle.L = &s.mutex
+	return s
+}
+
+// Changed schedules save of the store, it never blocks.
+func (s *Saver) Changed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.running {
+		s.pending = true
+		return
+	}
+	s.running = true
+	go s.run()
+}
+
+// Flush waits for the running save and saves the store once more.
+func (s *Saver) Flush() error {
+	s.mutex.Lock()
+	for s.running {
+		s.idle.Wait()
+	}
+	s.running = true
+	s.mutex.Unlock()
+
+	err := s.save()
+	if s.next() {
+		go s.run()
+	}
+	return err
+}
+
+func (s *Saver) run() {
+	for {
+		if err := s.save(); err != nil {
+			log.Println(err)
+		}
+		if !s.next() {
+			return
+		}
+	}
+}
+
+// next reports whether the store was changed during the last save.
+func (s *Saver) next() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pending {
+		s.pending = false
+		return true
+	}
+	s.running = false
+	s.idle.Broadcast()
+	return false
+}
@@ -0,0 +1,50 @@
+package proto
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSaver(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "store")
+	var (
+		value   atomic.Int64
+		running atomic.Int32
+	)
+	saver := CreateSaver(func() error {
+		if running.Add(1) != 1 {
+			t.Error("saves overlap")
+		}
+		defer running.Add(-1)
+		time.Sleep(time.Millisecond)
+		return (*Vault)(nil).WriteFile(name, []byte(strconv.FormatInt(value.Load(), 10)), 0600)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				value.Add(1)
+				saver.Changed()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := saver.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(name); string(got) != "400" {
+		t.Fatalf("expected the last value, got %q", got)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(name)); len(entries) != 1 {
+		t.Fatalf("temporary files are left: %v", entries)
+	}
+}
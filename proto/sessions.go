@@ -0,0 +1,163 @@
+package proto
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// Session describes active connection with peer for managers. Id is used by
+// manager commands to address the peer.
+type Session struct {
+	Id       string
+	Login    string
+	Addr     string
+	Verified bool
+}
+
+var (
+	ErrNoSession     = errors.New("no session with peer")
+	ErrSessionExists = errors.New("session with peer already exists")
+)
+
+// RunSession serves commands of peer until connection is closed. Peer is
+// available to managers by its session id meanwhile.
+func (host *Host) RunSession(peer *Peer) {
+	id := sessionID(peer)
+	host.addSession(id, peer)
+	host.serveSession(id, peer)
+}
+
+// StartSession is like RunSession, but serves peer in background. Session is
+// registered when StartSession returns.
+func (host *Host) StartSession(peer *Peer) {
+	id := sessionID(peer)
+	host.addSession(id, peer)
+	go host.serveSession(id, peer)
+}
+
+func (host *Host) serveSession(id string, peer *Peer) {
+	host.Commands.CommandLoop(peer, func(handler interface{}, arg []byte) error {
+		h := handler.(PeerHandler)
+		return h(host, peer, arg)
+	})
+
+	host.removeSession(id, peer)
+	peer.Close()
+}
+
+func (host *Host) Session(id string) (*Peer, error) {
+	host.sessionsMutex.Lock()
+	defer host.sessionsMutex.Unlock()
+
+	peer, ok := host.sessions[id]
+	if !ok {
+		return nil, ErrNoSession
+	}
+	return peer, nil
+}
+
+func (host *Host) Sessions() []Session {
+	host.sessionsMutex.Lock()
+	defer host.sessionsMutex.Unlock()
+
+	// Fields of live peers are owned by their sessions, so they are taken from
+	// the peer registry
+	sessions := make([]Session, 0, len(host.sessions))
+	for id := range host.sessions {
+		session := Session{Id: id}
+		if known, ok := host.Peers.Get(id); ok {
+			session.Login = known.Login
+			session.Addr = known.Addr
+			session.Verified = known.Verified
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Id < sessions[j].Id })
+	return sessions
+}
+
+// livePeers returns peers of active sessions by session id.
+func (host *Host) livePeers() map[string]*Peer {
+	host.sessionsMutex.Lock()
+	defer host.sessionsMutex.Unlock()
+
+	peers := make(map[string]*Peer, len(host.sessions))
+	for id, peer := range host.sessions {
+		peers[id] = peer
+	}
+	return peers
+}
+
+// CloseSession notifies peer about disconnection and closes connection.
+func (host *Host) CloseSession(id string) error {
+	peer, err := host.Session(id)
+	if err != nil {
+		return err
+	}
+
+	host.removeSession(id, peer)
+	sendCommand(peer, disc, nil)
+	peer.Close()
+	return nil
+}
+
+// addSession registers session of peer. Existing session with the same id is
+// closed, so a reconnected peer replaces its stale session.
+func (host *Host) addSession(id string, peer *Peer) {
+	host.sessionsMutex.Lock()
+	if host.sessions == nil {
+		host.sessions = make(map[string]*Peer)
+	}
+	old := host.sessions[id]
+	host.sessions[id] = peer
+	host.sessionsMutex.Unlock()
+
+	if old != nil && old != peer {
+		old.Close()
+	}
+}
+
+// removeSession removes session unless it's replaced by a newer one.
+func (host *Host) removeSession(id string, peer *Peer) {
+	host.sessionsMutex.Lock()
+	defer host.sessionsMutex.Unlock()
+
+	if host.sessions[id] == peer {
+		delete(host.sessions, id)
+	}
+}
+
+func (host *Host) hasSession(id string) bool {
+	_, err := host.Session(id)
+	return err == nil
+}
+
+func sessionID(peer *Peer) string {
+	if peer.Conn == nil {
+		return ""
+	}
+	return peerID(peer.Conn, peer.Key)
+}
+
+// peerID identifies peer by its IP address. Transports without IP addresses,
+// like unix sockets, identify peer by fingerprint of its identity key.
+func peerID(conn *Conn, key ed25519.PublicKey) string {
+	ip := addrIP(conn.RemoteAddr().String())
+	if _, err := netip.ParseAddr(ip); err != nil && key != nil {
+		return Fingerprint(key)
+	}
+	return ip
+}
+
+// addrIP returns host part of address, address without port is returned as
+// is.
+func addrIP(addr string) string {
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return ip
+}
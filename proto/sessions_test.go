@@ -0,0 +1,254 @@
+package proto
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialSession starts session of host with peer listening on addr.
+func dialSession(t *testing.T, host *Host, addr string) *Peer {
+	conn, err := host.Transport.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := host.DialPeer(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.StartSession(peer)
+	return peer
+}
+
+// serveHost accepts peers of host on address until the test ends.
+func serveHost(t *testing.T, host *Host, address string) {
+	ln, err := host.Transport.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			peer, err := host.AcceptPeer(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go host.RunSession(peer)
+		}
+	}()
+}
+
+// testManager returns manager and responses it gets.
+func testManager(t *testing.T) (*Manager, <-chan []byte) {
+	a, b := net.Pipe()
+	client := CreateConn(b)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	responses := make(chan []byte, 64)
+	go func() {
+		defer close(responses)
+		for {
+			buf, err := client.ReadPackage()
+			if err != nil {
+				return
+			}
+			responses <- buf
+		}
+	}()
+	return &Manager{Conn: CreateConn(a), Commands: ManagerCommands}, responses
+}
+
+// expectResponse waits for response cmd skipping the others.
+func expectResponse(t *testing.T, responses <-chan []byte, cmd Command) []byte {
+	t.Helper()
+	for {
+		select {
+		case buf, ok := <-responses:
+			if !ok {
+				t.Fatalf("manager connection is closed before %s", cmd[:])
+			}
+			if len(buf) >= CommandLength && string(buf[:CommandLength]) == string(cmd[:]) {
+				return buf[CommandLength:]
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s response is lost", cmd[:])
+		}
+	}
+}
+
+func waitNoSession(t *testing.T, host *Host, id string) {
+	t.Helper()
+	for i := 0; host.hasSession(id); i++ {
+		if i == 100 {
+			t.Fatalf("session %s isn't closed", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestManagerSessions(t *testing.T) {
+	network := CreateMemoryNetwork()
+	host := testHost(t, "host", network.Transport("10.0.0.1"))
+	first := testHost(t, "first", network.Transport("10.0.0.2"))
+	second := testHost(t, "second", network.Transport("10.0.0.3"))
+	serveHost(t, first, "10.0.0.2:7000")
+	serveHost(t, second, "10.0.0.3:7000")
+	subFirst, subSecond := first.Events.Subscribe(), second.Events.Subscribe()
+	defer host.Disconnect()
+
+	manager, responses := testManager(t)
+	run := func(cmd Command, data string) error {
+		handler, arg, err := manager.Commands.GetHandler(packCommand(cmd, []byte(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler.(ManagerHandler)(host, manager, arg)
+	}
+
+	for _, addr := range []string{"10.0.0.2:7000", "10.0.0.3:7000"} {
+		if err := run(conn, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := run(conn, "10.0.0.2:7000"); err != ErrSessionExists {
+		t.Fatalf("expected %v, got %v", ErrSessionExists, err)
+	}
+
+	if err := run(sess, ""); err != nil {
+		t.Fatal(err)
+	}
+	var sessions []Session
+	if err := json.Unmarshal(expectResponse(t, responses, ress), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].Id != "10.0.0.2" || sessions[1].Id != "10.0.0.3" {
+		t.Fatalf("wrong sessions %+v", sessions)
+	}
+
+	if err := run(send, "10.0.0.2 to first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(send, "10.0.0.3 to second"); err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, subFirst, "to first", 1)
+	expectMessages(t, subSecond, "to second", 1)
+
+	if err := run(send, "10.0.0.4 nobody"); err != ErrNoSession {
+		t.Fatalf("expected %v, got %v", ErrNoSession, err)
+	}
+	if err := run(send, "10.0.0.2"); err == nil {
+		t.Fatal("message without session id is sent")
+	}
+
+	if err := run(disc, "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := host.Session("10.0.0.2"); err != ErrNoSession {
+		t.Fatalf("expected %v, got %v", ErrNoSession, err)
+	}
+	waitNoSession(t, first, "10.0.0.1")
+
+	// The other session is still alive
+	if err := run(send, "10.0.0.3 again"); err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, subSecond, "again", 1)
+}
+
+func TestReplacedSession(t *testing.T) {
+	network := CreateMemoryNetwork()
+	a, b := testHost(t, "a", network.Transport("10.0.0.1")), testHost(t, "b", network.Transport("10.0.0.2"))
+	serveHost(t, b, "10.0.0.2:7000")
+	sub := b.Events.Subscribe()
+	defer a.Disconnect()
+
+	first := dialSession(t, a, "10.0.0.2:7000")
+	second := dialSession(t, a, "10.0.0.2:7000")
+	if peer, _ := a.Session("10.0.0.2"); peer != second {
+		t.Fatal("session isn't replaced")
+	}
+	if err := sendCommand(first, send, []byte("stale")); err == nil {
+		t.Fatal("replaced session isn't closed")
+	}
+
+	if err := sendCommand(second, send, []byte("fresh")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, sub, "fresh", 1)
+}
+
+func TestAddrIP(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.1:7000":    "10.0.0.1",
+		"[fe80::1]:7000":   "fe80::1",
+		"[::1%lo]:7000":    "::1%lo",
+		"10.0.0.1":         "10.0.0.1",
+		"fe80::1":          "fe80::1",
+		"host.local:12337": "host.local",
+	}
+	for addr, expected := range tests {
+		if ip := addrIP(addr); ip != expected {
+			t.Fatalf("%s: expected %s, got %s", addr, expected, ip)
+		}
+	}
+}
+
+func TestDiscWithBufferedPackage(t *testing.T) {
+	network := CreateMemoryNetwork()
+	a, b := testHost(t, "a", network.Transport("10.0.0.1")), testHost(t, "b", network.Transport("10.0.0.2"))
+	serveHost(t, a, "10.0.0.1:7000")
+	defer a.Disconnect()
+	peer := dialSession(t, b, "10.0.0.1:7000")
+	defer peer.Close()
+
+	// DISC and the next package come in one write, so the second one is
+	// already buffered when DISC closes the session
+	var frames []byte
+	peer.mutex.Lock()
+	for _, pkg := range [][]byte{packCommand(disc, nil), packCommand(send, []byte("after"))} {
+		enc, err := peer.Crypto.AuthAndEncrypt(pkg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = binary.LittleEndian.AppendUint32(frames, uint32(len(enc)))
+		frames = append(frames, enc...)
+	}
+	peer.mutex.Unlock()
+	peer.Conn.wmutex.Lock()
+	_, err := peer.Conn.conn.Write(frames)
+	peer.Conn.wmutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; ; i++ {
+		if _, err := a.Session("10.0.0.2"); err == ErrNoSession {
+			break
+		}
+		if i == 100 {
+			t.Fatal("session isn't closed by DISC")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closed := &Peer{Conn: peer.Conn}
+	closed.Close()
+	if _, err := closed.WritePackage([]byte("SENDlate")); err != ErrPeerClosed {
+		t.Fatalf("expected %v, got %v", ErrPeerClosed, err)
+	}
+	if _, err := closed.ReadPackage(); err != ErrPeerClosed {
+		t.Fatalf("expected %v, got %v", ErrPeerClosed, err)
+	}
+}
@@ -0,0 +1,122 @@
+package proto
+
+import (
+	"errors"
+	"io"
+)
+
+/*
+
+Payload bigger than MaxPacketSize is sent as a stream of packages:
+
+chunk: STRM | flag (1 byte) | data
+
+Every chunk except the last one has streamMore flag, the last chunk may be
+empty. Chunks are commands, so AEAD states authenticate them as any other
+package. Stream owns the connection while it's written or read.
+
+*/
+
+const (
+	StreamChunkSize = int(MaxPacketSize) - packageReserved - CommandLength - 1
+
+	streamLast = 0
+	streamMore = 1
+)
+
+var ErrStreamChunk = errors.New("wrong stream chunk")
+
+type StreamWriter struct {
+	rw  PackageReadWriter
+	buf []byte
+	err error
+}
+
+type StreamReader struct {
+	rw   PackageReadWriter
+	buf  []byte
+	done bool
+}
+
+func CreateStreamWriter(rw PackageReadWriter) *StreamWriter {
+	return &StreamWriter{
+		rw:  rw,
+		buf: make([]byte, CommandLength+1, CommandLength+1+StreamChunkSize),
+	}
+}
+
+func CreateStreamReader(rw PackageReadWriter) *StreamReader {
+	return &StreamReader{rw: rw}
+}
+
+// Write sends data by full chunks, the rest is sent by the next Write or Close.
+func (s *StreamWriter) Write(data []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	written := 0
+	for len(data) > 0 {
+		n := copy(s.buf[len(s.buf):cap(s.buf)], data)
+		s.buf = s.buf[:len(s.buf)+n]
+		data = data[n:]
+		written += n
+
+		// Keep the last chunk, it may be the end of stream
+		if len(s.buf) == cap(s.buf) && len(data) > 0 {
+			s.err = s.flush(streamMore)
+			if s.err != nil {
+				return written, s.err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close sends the last chunk. It doesn't close the connection.
+func (s *StreamWriter) Close() error {
+	if s.err != nil {
+		return s.err
+	}
+	s.err = s.flush(streamLast)
+	if s.err == nil {
+		s.err = io.ErrClosedPipe
+		return nil
+	}
+	return s.err
+}
+
+func (s *StreamWriter) flush(flag byte) error {
+	copy(s.buf, strm[:])
+	s.buf[CommandLength] = flag
+	_, err := s.rw.WritePackage(s.buf)
+	s.buf = s.buf[:CommandLength+1]
+	return err
+}
+
+func (s *StreamReader) Read(data []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+
+		chunk, err := s.rw.ReadPackage()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(chunk) <= CommandLength || Command(chunk[:CommandLength]) != strm ||
+			chunk[CommandLength] > streamMore {
+			return 0, ErrStreamChunk
+		}
+
+		s.done = chunk[CommandLength] == streamLast
+		s.buf = chunk[CommandLength+1:]
+	}
+
+	n := copy(data, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
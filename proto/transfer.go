@@ -0,0 +1,614 @@
+package proto
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Peers which announce transfer feature in REFO get FOFR instead of FILE
+	featureTransfer = "transfer"
+	// Peers which announce binary-chunks feature get FDAT instead of FCHK
+	featureBinaryChunks = "binary-chunks"
+
+	// Binary chunk: id (32 bytes) | offset (8 bytes, LE) | length (4 bytes, LE) | data
+	chunkHeaderSize = sha256.Size + 8 + 4
+
+	transferPartSuffix = ".part"
+
+	// MaxPendingOffers bounds offers of peer waiting for user to accept them
+	MaxPendingOffers = 16
+)
+
+var (
+	// OfferTimeout bounds waiting for user of peer to accept the file
+	OfferTimeout = 10 * time.Minute
+	// TransferTimeout bounds waiting for FEND of peer
+	TransferTimeout = 30 * time.Second
+)
+
+// fileOffer is the body of FOFR command. Id is derived from name and hash,
+// so the offer of the same file after reconnect resumes the transfer.
+type fileOffer struct {
+	Id   string
+	Name string
+	Size int64
+	Hash string
+}
+
+// fileChunk is the body of FCHK command and, in binary form, of FDAT command.
+type fileChunk struct {
+	Id     string
+	Offset int64
+	Data   []byte
+}
+
+// fileStatus is the body of FACK and FEND commands. FACK tells offset to
+// resume from or why the offer is refused, FEND reports result of hash
+// verification.
+type fileStatus struct {
+	Id     string
+	Offset int64
+	Error  string `json:",omitempty"`
+	end    bool
+}
+
+type incomingFile struct {
+	offer    fileOffer
+	peer     *Peer
+	session  string
+	part     string
+	offset   int64
+	hash     hash.Hash
+	accepted bool
+}
+
+// transfers keeps state of file transfers keyed by session id and transfer
+// id and jobs sending files keyed by job id.
+type transfers struct {
+	mutex    sync.Mutex
+	incoming map[string]*incomingFile
+	outgoing map[string]chan *fileStatus
+	jobs     map[string]*transferJob
+}
+
+var (
+	ErrTransferId      = errors.New("wrong transfer id")
+	ErrUnknownTransfer = errors.New("unknown file transfer")
+	ErrTransferExists  = errors.New("file is already being sent to peer")
+	ErrTransferOffset  = errors.New("wrong file chunk offset")
+	ErrTransferTimeout = errors.New("peer doesn't answer file transfer")
+	ErrTransferHash    = errors.New("file hash mismatch")
+	ErrChunkLength     = errors.New("wrong length of file chunk")
+	ErrTooManyOffers   = errors.New("too many pending file offers")
+)
+
+// sendFile offers file of job to peer, sends it from the offset peer has and
+// waits for peer to verify it. Peer drops the offered file if job is
+// canceled.
+func (host *Host) sendFile(peer *Peer, job *transferJob) (err error) {
+	fd, err := os.Open(job.Path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	offer, err := createFileOffer(fd, filepath.Base(job.Path))
+	if err != nil {
+		return err
+	}
+
+	key := transferKey(sessionID(peer), offer.Id)
+	status, err := host.transfers.wait(key)
+	if err != nil {
+		return err
+	}
+	defer host.transfers.done(key)
+
+	js, _ := json.Marshal(offer)
+	err = sendCommand(peer, fofr, js)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == ErrTransferCanceled {
+			js, _ := json.Marshal(fileStatus{Id: offer.Id, Error: err.Error()})
+			sendCommand(peer, fcan, js)
+		}
+	}()
+
+	ack, err := waitStatus(status, false, OfferTimeout, job.cancel)
+	if err != nil {
+		return err
+	}
+	if ack.Error != "" {
+		return statusError(ack.Error)
+	}
+	if ack.Offset < 0 || ack.Offset > offer.Size {
+		return ErrTransferOffset
+	}
+
+	_, err = fd.Seek(ack.Offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	host.progress(job, ack.Offset-job.Sent, false)
+	raw := peer.HasFeature(featureBinaryChunks)
+	chunk := fileChunk{Id: offer.Id, Offset: ack.Offset}
+	buf := make([]byte, fileChunkSize(peer, raw))
+	for chunk.Offset < offer.Size {
+		release, err := host.nextChunk(peer, job)
+		if err != nil {
+			return err
+		}
+		n, err := fd.Read(buf)
+		if err == nil {
+			chunk.Data = buf[:n]
+			err = sendChunk(peer, &chunk, raw)
+		}
+		release()
+		if err != nil {
+			return err
+		}
+		chunk.Offset += int64(n)
+		host.progress(job, int64(n), false)
+	}
+
+	end, err := waitStatus(status, true, TransferTimeout, job.cancel)
+	if err != nil {
+		return err
+	}
+	if end.Error != "" {
+		return statusError(end.Error)
+	}
+
+	login, addr := peer.info()
+	js, _ = json.Marshal(Message{
+		Type:  "FileSent",
+		Id:    offer.Id,
+		Peer:  sessionID(peer),
+		Login: login,
+		Addr:  addr,
+		Data:  offer.Name,
+	})
+	host.Events.Publish(string(js))
+	return nil
+}
+
+// fileBufReserved is space for JSON fields around data of FILE and FCHK
+// chunks of peers without binary chunks.
+const fileBufReserved = 1024
+
+// File is the body of legacy FILE command.
+type File struct {
+	Name string
+	Data []byte
+}
+
+// sendFileChunks sends file of job with legacy FILE command.
+func (host *Host) sendFileChunks(peer *Peer, job *transferJob) error {
+	fd, err := os.Open(job.Path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	stat, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	chunkSize := fileChunkSize(peer, false)
+	chunks := stat.Size() / chunkSize
+	if stat.Size()%chunkSize != 0 {
+		chunks++
+	}
+
+	fstruct := File{
+		Name: filepath.Base(job.Path),
+	}
+	buf := make([]byte, chunkSize)
+	for ; chunks > 0; chunks-- {
+		release, err := host.nextChunk(peer, job)
+		if err != nil {
+			return err
+		}
+		n, err := fd.Read(buf)
+		if err == nil {
+			fstruct.Data = buf[:n]
+			js, _ := json.Marshal(fstruct)
+			err = sendCommand(peer, file, js)
+		}
+		release()
+		if err != nil {
+			return err
+		}
+		host.progress(job, int64(n), false)
+	}
+	return nil
+}
+
+// offerFile registers offered file and returns it with offset of data
+// received before. Chunks are refused until the offer is accepted.
+func (host *Host) offerFile(peer *Peer, offer *fileOffer) (*incomingFile, error) {
+	id, err := hex.DecodeString(offer.Id)
+	if err != nil || len(id) != sha256.Size || offer.Size < 0 {
+		return nil, ErrTransferId
+	}
+
+	dir, err := host.peerDir(peer.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	name := "." + offer.Id + transferPartSuffix
+	in := &incomingFile{
+		offer:   *offer,
+		peer:    peer,
+		session: sessionID(peer),
+		part:    filepath.Join(dir.path, name),
+		hash:    sha256.New(),
+	}
+	in.offer.Name = safeName(offer.Name, "file")
+	// Broken or foreign partial file is received again
+	fd, err := dir.open(name, os.O_RDONLY, 0)
+	if err == ErrUnsafePath {
+		return nil, err
+	}
+	if err == nil {
+		part := &partWriter{hash: in.hash, limit: offer.Size}
+		err = host.Vault.CopyFrom(fd, part)
+		fd.Close()
+		in.offset = part.size
+	}
+	if err != nil {
+		in.offset = 0
+		in.hash.Reset()
+		dir.remove(name)
+	}
+
+	key := transferKey(in.session, offer.Id)
+	host.transfers.mutex.Lock()
+	if host.transfers.incoming == nil {
+		host.transfers.incoming = make(map[string]*incomingFile)
+	}
+	pending := 0
+	for other, file := range host.transfers.incoming {
+		if other != key && !file.accepted && filepath.Dir(file.part) == dir.path {
+			pending++
+		}
+	}
+	if pending >= MaxPendingOffers {
+		host.transfers.mutex.Unlock()
+		return nil, ErrTooManyOffers
+	}
+	host.transfers.incoming[key] = in
+	host.transfers.mutex.Unlock()
+
+	time.AfterFunc(OfferTimeout, func() { host.expireOffer(key, in) })
+	return in, nil
+}
+
+// expireOffer drops offer which isn't accepted in OfferTimeout, the sender
+// stops waiting for it meanwhile.
+func (host *Host) expireOffer(key string, in *incomingFile) {
+	host.transfers.mutex.Lock()
+	expired := !in.accepted && host.transfers.incoming[key] == in
+	if expired {
+		delete(host.transfers.incoming, key)
+	}
+	host.transfers.mutex.Unlock()
+	if !expired {
+		return
+	}
+
+	msg, _ := json.Marshal(host.fileEvent("FileCanceled", in, in.offer.Name))
+	host.Events.Publish(string(msg))
+}
+
+// partWriter hashes partial file which must not exceed the offered size.
+type partWriter struct {
+	hash  hash.Hash
+	size  int64
+	limit int64
+}
+
+func (w *partWriter) Write(data []byte) (int, error) {
+	if w.size+int64(len(data)) > w.limit {
+		return 0, ErrTransferOffset
+	}
+	w.size += int64(len(data))
+	return w.hash.Write(data)
+}
+
+// storeChunk writes chunk and verifies file after its last chunk.
+func (host *Host) storeChunk(peer *Peer, chunk *fileChunk) error {
+	in, err := host.receiveChunk(peer, chunk)
+	if err != nil || in.offset < in.offer.Size {
+		return err
+	}
+	return host.receivedFile(in)
+}
+
+func (host *Host) receiveChunk(peer *Peer, chunk *fileChunk) (*incomingFile, error) {
+	in, ok := host.transfers.accepted(transferKey(sessionID(peer), chunk.Id))
+	if !ok {
+		return nil, ErrUnknownTransfer
+	}
+	if chunk.Offset != in.offset || in.offset+int64(len(chunk.Data)) > in.offer.Size {
+		return nil, ErrTransferOffset
+	}
+
+	err := host.appendPart(in, chunk.Data)
+	if err != nil {
+		return nil, err
+	}
+	in.hash.Write(chunk.Data)
+
+	host.transfers.mutex.Lock()
+	in.offset += int64(len(chunk.Data))
+	host.transfers.mutex.Unlock()
+	return in, nil
+}
+
+// finishFile verifies received file and moves it to the directory of peer.
+func (host *Host) finishFile(in *incomingFile) (string, error) {
+	host.transfers.remove(transferKey(in.session, in.offer.Id))
+
+	dir, err := host.peerDir(in.peer.Key)
+	if err != nil {
+		return "", err
+	}
+	defer dir.Close()
+
+	name := filepath.Base(in.part)
+	if hex.EncodeToString(in.hash.Sum(nil)) != in.offer.Hash {
+		dir.remove(name)
+		return "", ErrTransferHash
+	}
+	if in.offer.Size == 0 {
+		err := host.appendPart(in, nil)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return linkUnique(dir, name, in.offer.Name)
+}
+
+// appendPart appends data to partial file of in.
+func (host *Host) appendPart(in *incomingFile, data []byte) error {
+	dir, err := host.peerDir(in.peer.Key)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	fd, err := dir.open(filepath.Base(in.part), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return host.Vault.AppendTo(fd, data)
+}
+
+// receivedFile reports result of verification to peer and managers.
+func (host *Host) receivedFile(in *incomingFile) error {
+	name, err := host.finishFile(in)
+	status := fileStatus{Id: in.offer.Id, Offset: in.offset}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	js, _ := json.Marshal(status)
+	sendCommand(in.peer, fend, js)
+	if err != nil {
+		return err
+	}
+
+	msg := host.fileEvent("File", in, name)
+	host.Record(&msg)
+
+	js, _ = json.Marshal(msg)
+	host.Events.Publish(string(js))
+	return nil
+}
+
+// canceledFile drops file id which peer of session stopped sending.
+func (host *Host) canceledFile(session, id string) error {
+	key := transferKey(session, id)
+	host.transfers.mutex.Lock()
+	in, ok := host.transfers.incoming[key]
+	delete(host.transfers.incoming, key)
+	host.transfers.mutex.Unlock()
+	if !ok {
+		return ErrUnknownTransfer
+	}
+
+	host.removePart(in)
+	msg, _ := json.Marshal(host.fileEvent("FileCanceled", in, in.offer.Name))
+	host.Events.Publish(string(msg))
+	return nil
+}
+
+func (host *Host) fileEvent(kind string, in *incomingFile, data string) Message {
+	msg := Message{
+		Type: kind,
+		Id:   in.offer.Id,
+		Peer: in.session,
+		Data: data,
+	}
+	if known, ok := host.Peers.Get(in.session); ok {
+		msg.Login = known.Login
+		msg.Addr = known.Addr
+	}
+	return msg
+}
+
+func (t *transfers) accepted(key string) (*incomingFile, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	in, ok := t.incoming[key]
+	return in, ok && in.accepted
+}
+
+func (t *transfers) remove(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.incoming, key)
+}
+
+func (t *transfers) wait(key string) (chan *fileStatus, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.outgoing == nil {
+		t.outgoing = make(map[string]chan *fileStatus)
+	}
+	if _, ok := t.outgoing[key]; ok {
+		return nil, ErrTransferExists
+	}
+	status := make(chan *fileStatus, 2)
+	t.outgoing[key] = status
+	return status, nil
+}
+
+func (t *transfers) done(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.outgoing, key)
+}
+
+// notify passes status from peer to SendFile waiting for it.
+func (t *transfers) notify(key string, status *fileStatus) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	ch, ok := t.outgoing[key]
+	if !ok {
+		return ErrUnknownTransfer
+	}
+	select {
+	case ch <- status:
+	default:
+	}
+	return nil
+}
+
+// waitStatus waits for FEND if end is set or for FACK otherwise, unless
+// transfer is canceled.
+func waitStatus(status <-chan *fileStatus, end bool, timeout time.Duration, cancel <-chan struct{}) (*fileStatus, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case st := <-status:
+			if st.end == end {
+				return st, nil
+			}
+		case <-timer.C:
+			return nil, ErrTransferTimeout
+		case <-cancel:
+			return nil, ErrTransferCanceled
+		}
+	}
+}
+
+// statusError returns error reported by peer, so callers can check for
+// rejection.
+func statusError(status string) error {
+	for _, err := range []error{ErrFileRejected, ErrFileQuota, ErrTransferHash} {
+		if status == err.Error() {
+			return err
+		}
+	}
+	return errors.New(status)
+}
+
+func createFileOffer(fd *os.File, name string) (*fileOffer, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, fd)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fd.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	id := sha256.Sum256([]byte(name + "\x00" + sum))
+	return &fileOffer{
+		Id:   hex.EncodeToString(id[:]),
+		Name: name,
+		Size: size,
+		Hash: sum,
+	}, nil
+}
+
+func sendChunk(peer *Peer, chunk *fileChunk, raw bool) error {
+	if !raw {
+		js, _ := json.Marshal(chunk)
+		return sendCommand(peer, fchk, js)
+	}
+
+	data, err := chunk.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return sendCommand(peer, fdat, data)
+}
+
+// fileChunkSize is size of file data fitting in one command to peer. JSON
+// encoding inflates data by base64.
+func fileChunkSize(peer *Peer, raw bool) int64 {
+	limit := int64(peer.Conn.maxWrite()) - CommandLength
+	if raw {
+		return limit - chunkHeaderSize - packageReserved
+	}
+	return ((limit - fileBufReserved) * 3) / 4
+}
+
+func (chunk *fileChunk) MarshalBinary() ([]byte, error) {
+	id, err := hex.DecodeString(chunk.Id)
+	if err != nil || len(id) != sha256.Size {
+		return nil, ErrTransferId
+	}
+
+	buf := make([]byte, chunkHeaderSize, chunkHeaderSize+len(chunk.Data))
+	copy(buf, id)
+	binary.LittleEndian.PutUint64(buf[sha256.Size:], uint64(chunk.Offset))
+	binary.LittleEndian.PutUint32(buf[sha256.Size+8:], uint32(len(chunk.Data)))
+	return append(buf, chunk.Data...), nil
+}
+
+func (chunk *fileChunk) UnmarshalBinary(data []byte) error {
+	if len(data) < chunkHeaderSize {
+		return ErrChunkLength
+	}
+
+	offset := binary.LittleEndian.Uint64(data[sha256.Size:])
+	length := binary.LittleEndian.Uint32(data[sha256.Size+8:])
+	if uint64(length) != uint64(len(data)-chunkHeaderSize) || offset > math.MaxInt64 {
+		return ErrChunkLength
+	}
+
+	chunk.Id = hex.EncodeToString(data[:sha256.Size])
+	chunk.Offset = int64(offset)
+	chunk.Data = data[chunkHeaderSize:]
+	return nil
+}
+
+func transferKey(session, id string) string {
+	return session + " " + id
+}
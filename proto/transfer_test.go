@@ -0,0 +1,223 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// chdirTemp changes working directory, where files are received, to the
+// temporary one.
+func chdirTemp(t *testing.T) string {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func TestFileTransfer(t *testing.T) {
+	dir := chdirTemp(t)
+	network := CreateMemoryNetwork()
+	a, b := testHost(t, "a", network.Transport("10.0.0.1")), testHost(t, "b", network.Transport("10.0.0.2"))
+	subA, subB := a.Events.Subscribe(), b.Events.Subscribe()
+	pa, pb := connectHosts(t, a, b, "10.0.0.1:7000")
+	defer pa.Close()
+	defer pb.Close()
+	waitFeature(t, pb, featureTransfer)
+	a.Files.AutoAccept = []string{Fingerprint(b.Identity.Public)}
+
+	data := make([]byte, 3*fileChunkSize(pb, true)+100)
+	rand.Read(data)
+	src := filepath.Join(dir, "src", "file")
+	os.Mkdir(filepath.Dir(src), 0700)
+	os.WriteFile(src, data, 0600)
+
+	if err := b.SendFile(pb, src); err != nil {
+		t.Fatal(err)
+	}
+	received := Fingerprint(b.Identity.Public)
+	if msg := expectEvent(t, subA, "File"); msg.Data != filepath.Join(received, "file") || msg.Login != "b" {
+		t.Fatalf("wrong event %+v", msg)
+	}
+	if msg := expectEvent(t, subB, "FileSent"); msg.Data != "file" || msg.Peer != "10.0.0.1" {
+		t.Fatalf("wrong event %+v", msg)
+	}
+	if got, _ := os.ReadFile(filepath.Join(received, "file")); !bytes.Equal(got, data) {
+		t.Fatal("received file differs")
+	}
+
+	// File with the same name doesn't overwrite the first one
+	os.WriteFile(src, []byte("second"), 0600)
+	if err := b.SendFile(pb, src); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(received, "file-1")); string(got) != "second" {
+		t.Fatalf("wrong second file %q", got)
+	}
+
+	os.WriteFile(src, nil, 0600)
+	if err := b.SendFile(pb, src); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(filepath.Join(received, "file-2")); err != nil || stat.Size() != 0 {
+		t.Fatal("empty file isn't received")
+	}
+}
+
+func TestFileTransferResume(t *testing.T) {
+	dir := chdirTemp(t)
+	network := CreateMemoryNetwork()
+	a, b := testHost(t, "a", network.Transport("10.0.0.1")), testHost(t, "b", network.Transport("10.0.0.2"))
+	pa, pb := connectHosts(t, a, b, "10.0.0.1:7000")
+	defer pa.Close()
+	defer pb.Close()
+	waitFeature(t, pa, featureTransfer)
+	waitFeature(t, pb, featureTransfer)
+	a.Files.AutoAccept = []string{Fingerprint(b.Identity.Public)}
+
+	data := make([]byte, 2*fileChunkSize(pb, true))
+	rand.Read(data)
+	src := filepath.Join(dir, "file")
+	os.WriteFile(src, data, 0600)
+
+	fd, _ := os.Open(src)
+	offer, err := createFileOffer(fd, "file")
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Part received before reconnect
+	received := Fingerprint(b.Identity.Public)
+	os.Mkdir(received, 0700)
+	part := filepath.Join(received, "."+offer.Id+transferPartSuffix)
+	os.WriteFile(part, data[:1000], 0600)
+
+	// Another identity with the same login doesn't resume the part
+	other := &Peer{Login: "b", Key: testIdentity(t).Public, Conn: pa.Conn}
+	if in, err := a.offerFile(other, offer); err != nil || in.offset != 0 {
+		t.Fatalf("foreign part is resumed: %v", err)
+	}
+	a.transfers.remove(transferKey(sessionID(other), offer.Id))
+
+	in, err := a.offerFile(pa, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.offset != 1000 {
+		t.Fatalf("expected offset 1000, got %d", in.offset)
+	}
+	if _, err := a.receiveChunk(pa, &fileChunk{Id: offer.Id, Offset: 1000, Data: data[1000:1010]}); err != ErrUnknownTransfer {
+		t.Fatalf("expected %v, got %v", ErrUnknownTransfer, err)
+	}
+	if err := a.AcceptFile("10.0.0.2", offer.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.receiveChunk(pa, &fileChunk{Id: offer.Id, Offset: 10, Data: data[10:20]}); err != ErrTransferOffset {
+		t.Fatalf("expected %v, got %v", ErrTransferOffset, err)
+	}
+
+	if err := b.SendFile(pb, src); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(received, "file")); !bytes.Equal(got, data) {
+		t.Fatal("resumed file differs")
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Fatal("partial file isn't removed")
+	}
+
+	// Corrupted part fails verification and is received again
+	corrupted := append([]byte{data[0] ^ 1}, data[1:1000]...)
+	os.WriteFile(part, corrupted, 0600)
+	if err := b.SendFile(pb, src); err == nil || err.Error() != ErrTransferHash.Error() {
+		t.Fatalf("expected %v, got %v", ErrTransferHash, err)
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Fatal("corrupted file isn't removed")
+	}
+	if err := b.SendFile(pb, src); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(received, "file-1")); !bytes.Equal(got, data) {
+		t.Fatal("file received again differs")
+	}
+
+	if _, err := a.offerFile(pa, &fileOffer{Id: "../id", Name: "file"}); err != ErrTransferId {
+		t.Fatalf("expected %v, got %v", ErrTransferId, err)
+	}
+}
+
+func TestFileChunkBinary(t *testing.T) {
+	chunk := fileChunk{Id: strings.Repeat("0f", 32), Offset: 1 << 40, Data: []byte("chunk data")}
+	data, err := chunk.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != chunkHeaderSize+len(chunk.Data) {
+		t.Fatalf("wrong length %d", len(data))
+	}
+
+	got := fileChunk{}
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != chunk.Id || got.Offset != chunk.Offset || !bytes.Equal(got.Data, chunk.Data) {
+		t.Fatalf("wrong chunk %+v", got)
+	}
+
+	for _, broken := range [][]byte{data[:chunkHeaderSize-1], data[:len(data)-1], append(data, 0)} {
+		if err := got.UnmarshalBinary(broken); err != ErrChunkLength {
+			t.Fatalf("expected %v, got %v", ErrChunkLength, err)
+		}
+	}
+	if _, err := (&fileChunk{Id: "short"}).MarshalBinary(); err != ErrTransferId {
+		t.Fatalf("expected %v, got %v", ErrTransferId, err)
+	}
+}
+
+func TestNegotiatedPacketSize(t *testing.T) {
+	dir := chdirTemp(t)
+	network := CreateMemoryNetwork()
+	a, b := testHost(t, "a", network.Transport("10.0.0.1")), testHost(t, "b", network.Transport("10.0.0.2"))
+	a.MaxPacket, b.MaxPacket = 64<<10, 32<<10
+	pa, pb := connectHosts(t, a, b, "10.0.0.1:7000")
+	defer pa.Close()
+	defer pb.Close()
+	waitFeature(t, pa, featureBinaryChunks)
+	waitFeature(t, pb, featureBinaryChunks)
+	a.Files.AutoAccept = []string{Fingerprint(b.Identity.Public)}
+
+	// Sides may send packages up to the smaller limit
+	for _, peer := range []*Peer{pa, pb} {
+		if peer.Conn.maxWrite() != 32<<10 {
+			t.Fatalf("expected limit %d, got %d", 32<<10, peer.Conn.maxWrite())
+		}
+	}
+	if pa.Conn.maxRead() != 64<<10 {
+		t.Fatalf("expected read limit %d, got %d", 64<<10, pa.Conn.maxRead())
+	}
+	if size := fileChunkSize(pb, true); size < 31<<10 || size <= fileChunkSize(pb, false) {
+		t.Fatalf("wrong chunk size %d", size)
+	}
+
+	data := make([]byte, 200<<10)
+	rand.Read(data)
+	src := filepath.Join(dir, "big")
+	os.WriteFile(src, data, 0600)
+	if err := b.SendFile(pb, src); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(Fingerprint(b.Identity.Public), "big")); !bytes.Equal(got, data) {
+		t.Fatal("received file differs")
+	}
+}
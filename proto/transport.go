@@ -0,0 +1,291 @@
+package proto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const memoryBufferSize = 1 << 16
+
+// Transport dials and listens connections of one kind. Connections of every
+// transport are used by DialPeer, AcceptPeer and CommandLoop the same way.
+type Transport interface {
+	Dial(address string) (*Conn, error)
+	Listen(address string) (*Listener, error)
+}
+
+type TCPTransport struct{}
+
+type UnixTransport struct{}
+
+// MemoryNetwork connects in-memory transports with each other.
+type MemoryNetwork struct {
+	mutex     sync.Mutex
+	listeners map[string]*memoryListener
+}
+
+// MemoryTransport is an endpoint of MemoryNetwork with its own address, which
+// is seen by listeners as remote address.
+type MemoryTransport struct {
+	network *MemoryNetwork
+	addr    string
+}
+
+type memoryAddr string
+
+// memoryConn is buffered like a socket, writes block only when the buffer of
+// second user is full.
+type memoryConn struct {
+	local, remote memoryAddr
+	rbuf, wbuf    *memoryBuffer
+}
+
+type memoryBuffer struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	data     []byte
+	closed   bool
+	deadline [2]time.Time
+}
+
+type memoryListener struct {
+	network *MemoryNetwork
+	addr    memoryAddr
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+var (
+	ErrUnknownTransport = errors.New("unknown transport")
+	ErrConnRefused      = errors.New("connection refused")
+	ErrAddrInUse        = errors.New("address already in use")
+)
+
+func TransportByName(name string) (Transport, error) {
+	switch name {
+	case "", "tcp":
+		return TCPTransport{}, nil
+	case "udp":
+		return UDPTransport{}, nil
+	case "unix":
+		return UnixTransport{}, nil
+	}
+	return nil, ErrUnknownTransport
+}
+
+func (TCPTransport) Dial(address string) (*Conn, error) {
+	return Dial("tcp", address)
+}
+
+func (TCPTransport) Listen(address string) (*Listener, error) {
+	return Listen("tcp", address)
+}
+
+func (UnixTransport) Dial(address string) (*Conn, error) {
+	return Dial("unix", address)
+}
+
+// Listen removes stale socket file left by previous run.
+func (UnixTransport) Listen(address string) (*Listener, error) {
+	if stat, err := os.Stat(address); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		os.Remove(address)
+	}
+	return Listen("unix", address)
+}
+
+func CreateMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		listeners: make(map[string]*memoryListener),
+	}
+}
+
+func (network *MemoryNetwork) Transport(addr string) *MemoryTransport {
+	return &MemoryTransport{
+		network: network,
+		addr:    addr,
+	}
+}
+
+func (t *MemoryTransport) Dial(address string) (*Conn, error) {
+	t.network.mutex.Lock()
+	ln, ok := t.network.listeners[address]
+	t.network.mutex.Unlock()
+	if !ok {
+		return nil, ErrConnRefused
+	}
+
+	local, remote := memoryAddr(t.addr), memoryAddr(address)
+	ab, ba := newMemoryBuffer(), newMemoryBuffer()
+	select {
+	case ln.conns <- &memoryConn{local: remote, remote: local, rbuf: ab, wbuf: ba}:
+	case <-ln.done:
+		return nil, ErrConnRefused
+	}
+	return CreateConn(&memoryConn{local: local, remote: remote, rbuf: ba, wbuf: ab}), nil
+}
+
+func (t *MemoryTransport) Listen(address string) (*Listener, error) {
+	t.network.mutex.Lock()
+	defer t.network.mutex.Unlock()
+
+	if _, ok := t.network.listeners[address]; ok {
+		return nil, ErrAddrInUse
+	}
+
+	ln := &memoryListener{
+		network: t.network,
+		addr:    memoryAddr(address),
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	t.network.listeners[address] = ln
+	return CreateListener(ln), nil
+}
+
+func (addr memoryAddr) Network() string {
+	return "memory"
+}
+
+func (addr memoryAddr) String() string {
+	return string(addr)
+}
+
+func (c *memoryConn) Read(buf []byte) (int, error) {
+	return c.rbuf.read(buf)
+}
+
+func (c *memoryConn) Write(buf []byte) (int, error) {
+	return c.wbuf.write(buf)
+}
+
+func (c *memoryConn) Close() error {
+	c.rbuf.close()
+	c.wbuf.close()
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.rbuf.setDeadline(0, t)
+	return nil
+}
+
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	c.wbuf.setDeadline(1, t)
+	return nil
+}
+
+func newMemoryBuffer() *memoryBuffer {
+	b := &memoryBuffer{}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+func (b *memoryBuffer) read(buf []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for len(b.data) == 0 {
+		if b.closed {
+			return 0, io.EOF
+		}
+		if deadlineExceeded(b.deadline[0]) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.cond.Wait()
+	}
+
+	n := copy(buf, b.data)
+	b.data = b.data[n:]
+	b.cond.Broadcast()
+	return n, nil
+}
+
+func (b *memoryBuffer) write(buf []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	written := 0
+	for len(buf) > 0 {
+		for len(b.data) >= memoryBufferSize && !b.closed {
+			if deadlineExceeded(b.deadline[1]) {
+				return written, os.ErrDeadlineExceeded
+			}
+			b.cond.Wait()
+		}
+		if b.closed {
+			return written, net.ErrClosed
+		}
+
+		n := memoryBufferSize - len(b.data)
+		if n > len(buf) {
+			n = len(buf)
+		}
+		b.data = append(b.data, buf[:n]...)
+		buf = buf[n:]
+		written += n
+		b.cond.Broadcast()
+	}
+	return written, nil
+}
+
+func (b *memoryBuffer) close() {
+	b.mutex.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mutex.Unlock()
+}
+
+func (b *memoryBuffer) setDeadline(i int, t time.Time) {
+	b.mutex.Lock()
+	b.deadline[i] = t
+	b.mutex.Unlock()
+
+	if !t.IsZero() {
+		time.AfterFunc(time.Until(t), func() {
+			b.mutex.Lock()
+			b.cond.Broadcast()
+			b.mutex.Unlock()
+		})
+	}
+}
+
+func (ln *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *memoryListener) Close() error {
+	ln.once.Do(func() {
+		close(ln.done)
+		ln.network.mutex.Lock()
+		delete(ln.network.listeners, string(ln.addr))
+		ln.network.mutex.Unlock()
+	})
+	return nil
+}
+
+func (ln *memoryListener) Addr() net.Addr {
+	return ln.addr
+}
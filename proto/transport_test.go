@@ -0,0 +1,321 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn drops and duplicates outgoing datagrams.
+type lossyPacketConn struct {
+	net.PacketConn
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+func (c *lossyPacketConn) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	r := c.rand.Intn(10)
+	c.mutex.Unlock()
+
+	switch r {
+	case 0, 1:
+		return len(buf), nil
+	case 2:
+		c.PacketConn.WriteTo(buf, addr)
+	}
+	return c.PacketConn.WriteTo(buf, addr)
+}
+
+type lossyUDPTransport struct {
+	seed int64
+}
+
+func (t lossyUDPTransport) lossy(pc net.PacketConn) net.PacketConn {
+	return &lossyPacketConn{PacketConn: pc, rand: rand.New(rand.NewSource(t.seed))}
+}
+
+func (t lossyUDPTransport) Dial(address string) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return dialUDP(t.lossy(pc), raddr)
+}
+
+func (t lossyUDPTransport) Listen(address string) (*Listener, error) {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return CreateListener(createUDPListener(t.lossy(pc))), nil
+}
+
+func testHost(t testing.TB, login string, transport Transport) *Host {
+	return &Host{
+		Login:     login,
+		Identity:  testIdentity(t),
+		Suites:    DefaultSuites,
+		Transport: transport,
+		Peers:     CreatePeerRegistry(nil),
+		Groups:    CreateGroupStore(nil),
+		Outbox:    CreateOutbox(nil, DefaultOutboxLimits),
+		Commands:  PeerCommands,
+		Events:    CreateEventBus(DefaultEventQueue, DefaultOfflineEvents),
+	}
+}
+
+func runPeer(host *Host, peer *Peer) {
+	host.Commands.CommandLoop(peer, func(handler interface{}, arg []byte) error {
+		return handler.(PeerHandler)(host, peer, arg)
+	})
+}
+
+// connectHosts connects host b to host a listening on address.
+func connectHosts(t *testing.T, a, b *Host, address string) (*Peer, *Peer) {
+	ln, err := a.Transport.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan *Peer)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			close(accepted)
+			return
+		}
+		peer, err := a.AcceptPeer(conn)
+		if err != nil {
+			t.Error(err)
+			conn.Close()
+		}
+		accepted <- peer
+	}()
+
+	conn, err := b.Transport.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, err := b.DialPeer(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pa := <-accepted
+	if pa == nil {
+		t.FailNow()
+	}
+
+	go runPeer(a, pa)
+	go runPeer(b, pb)
+	return pa, pb
+}
+
+// expectMessages waits for count messages sent by SEND.
+func expectMessages(t *testing.T, sub *Subscription, data string, count int) {
+	for count > 0 {
+		select {
+		case js := <-sub.Events:
+			msg := Message{}
+			json.Unmarshal([]byte(js), &msg)
+			if msg.Type != "Message" {
+				continue
+			}
+			if msg.Data != data {
+				t.Fatalf("expected %q, got %q", data, msg.Data)
+			}
+			count--
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d messages are lost", count)
+		}
+	}
+}
+
+func TestTransports(t *testing.T) {
+	network := CreateMemoryNetwork()
+	unixSocket := filepath.Join(t.TempDir(), "sechan.sock")
+
+	tests := []struct {
+		name    string
+		a, b    Transport
+		address string
+	}{
+		{"tcp", TCPTransport{}, TCPTransport{}, "127.0.0.1:0"},
+		{"unix", UnixTransport{}, UnixTransport{}, unixSocket},
+		{"memory", network.Transport("10.0.0.1"), network.Transport("10.0.0.2"), "10.0.0.1:7000"},
+		{"udp", UDPTransport{}, UDPTransport{}, "127.0.0.1:0"},
+		{"lossy udp", lossyUDPTransport{1}, lossyUDPTransport{2}, "127.0.0.1:0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := testHost(t, "a", test.a), testHost(t, "b", test.b)
+			subA, subB := a.Events.Subscribe(), b.Events.Subscribe()
+			pa, pb := connectHosts(t, a, b, test.address)
+			defer pa.Close()
+			defer pb.Close()
+
+			// Big messages are split into several segments by udp
+			long := string(make([]byte, 6000))
+			for i := 0; i < 20; i++ {
+				go sendCommand(pa, send, []byte("from a"))
+				if err := sendCommand(pb, send, []byte(long)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expectMessages(t, subA, long, 20)
+			expectMessages(t, subB, "from a", 20)
+		})
+	}
+}
+
+func TestMemoryTransportAddr(t *testing.T) {
+	network := CreateMemoryNetwork()
+	ln, err := network.Transport("server").Listen("server:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if _, err := network.Transport("other").Listen("server:1"); err != ErrAddrInUse {
+		t.Fatalf("expected %v, got %v", ErrAddrInUse, err)
+	}
+	if _, err := network.Transport("client").Dial("nowhere:1"); err != ErrConnRefused {
+		t.Fatalf("expected %v, got %v", ErrConnRefused, err)
+	}
+
+	go func() {
+		conn, err := network.Transport("client").Dial("server:1")
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != "client" || conn.LocalAddr().String() != "server:1" {
+		t.Fatalf("wrong addresses %s -> %s", conn.RemoteAddr(), conn.LocalAddr())
+	}
+}
+
+func TestUnixSessionIDs(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "sechan.sock")
+	a := testHost(t, "a", UnixTransport{})
+	serveHost(t, a, socket)
+	defer a.Disconnect()
+
+	// Every unix peer has the same remote address
+	for _, login := range []string{"b", "c"} {
+		host := testHost(t, login, UnixTransport{})
+		dialSession(t, host, socket)
+		defer host.Disconnect()
+
+		// Login comes with REFO after the session is started
+		id := Fingerprint(host.Identity.Public)
+		for i := 0; ; i++ {
+			if known, ok := a.Peers.Get(id); ok && known.Login == login && a.hasSession(id) {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("session of %s isn't found by its fingerprint", login)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if sessions := a.Sessions(); len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", sessions)
+	}
+}
+
+func TestUDPSlowReader(t *testing.T) {
+	ln, err := UDPTransport{}.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := UDPTransport{}.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data := make([]byte, 8*udpReadBuffer)
+	rand.New(rand.NewSource(1)).Read(data)
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.conn.Write(data)
+		written <- err
+	}()
+
+	accepted, err := ln.listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := accepted.(*udpConn)
+
+	// Sender waits for the reader instead of filling its memory
+	time.Sleep(udpMaxTimeout)
+	c.mutex.Lock()
+	buffered := len(c.readBuf)
+	c.mutex.Unlock()
+	if buffered > udpReadBuffer+udpSegmentSize {
+		t.Fatalf("%d bytes are buffered, limit is %d", buffered, udpReadBuffer)
+	}
+
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(c, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received data differs")
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPTransportClose(t *testing.T) {
+	ln, err := UDPTransport{}.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.WritePackage([]byte("bye"))
+		conn.Close()
+	}()
+
+	conn, err := UDPTransport{}.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf, err := conn.ReadPackage()
+	if err != nil || string(buf) != "bye" {
+		t.Fatalf("expected bye, got %q: %v", buf, err)
+	}
+	if _, err := conn.ReadPackage(); err == nil {
+		t.Fatal("expected end of stream")
+	}
+}
@@ -0,0 +1,552 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+
+Reliable UDP turns datagrams into ordered byte stream:
+
+segment: type (1 byte) | seq (4 bytes, LE) | payload
+
+SYN    - request for connection, answered by SYNACK
+DATA   - part of the stream, seq is the number of segment
+FIN    - end of the stream, it has seq and is delivered after all data
+ACK    - seq is the number of the next expected segment
+
+Sender keeps up to udpWindow unacknowledged segments and resends all of them
+when the oldest one isn't acknowledged in time.
+
+Receiver takes segments while its read buffer is shorter than udpReadBuffer,
+the rest aren't acknowledged until the buffer is read, so a slow reader holds
+sender back. ACK without progress shows that second user is alive, so sender
+waits for such reader instead of breaking connection.
+
+*/
+
+const (
+	udpSyn = iota + 1
+	udpSynAck
+	udpData
+	udpFin
+	udpAck
+
+	udpHeaderSize  = 5
+	udpSegmentSize = 1200
+	udpWindow      = 64
+	udpReadBuffer  = 4 * udpWindow * udpSegmentSize
+	udpTimeout     = 200 * time.Millisecond
+	udpMaxTimeout  = 3 * time.Second
+	udpMaxRetries  = 8
+	udpBacklog     = 16
+)
+
+var ErrUDPTimeout = errors.New("reliable udp: second user doesn't respond")
+
+type UDPTransport struct{}
+
+type udpConn struct {
+	pc       net.PacketConn
+	remote   net.Addr
+	release  func()
+	acked    chan struct{}
+	ackOnce  sync.Once
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	err      error
+	closed   bool
+	released bool
+
+	sendNext uint32
+	sendUna  uint32
+	unacked  map[uint32][]byte
+	retries  int
+	backoff  int
+	timer    *time.Timer
+
+	recNext uint32
+	pending map[uint32][]byte
+	readBuf []byte
+	eof     bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+type udpListener struct {
+	pc      net.PacketConn
+	mutex   sync.Mutex
+	conns   map[string]*udpConn
+	backlog chan net.Conn
+	done    chan struct{}
+	closed  bool
+}
+
+func (UDPTransport) Dial(address string) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	return dialUDP(pc, raddr)
+}
+
+// dialUDP establishes connection over socket pc, which is owned by connection.
+func dialUDP(pc net.PacketConn, raddr net.Addr) (*Conn, error) {
+	c := newUDPConn(pc, raddr, func() { pc.Close() })
+	go c.readLoop()
+
+	var err error
+	syn := udpSegment(udpSyn, 0, nil)
+	timeout := udpTimeout
+	for i := 0; i < udpMaxRetries; i++ {
+		_, err = pc.WriteTo(syn, raddr)
+		if err != nil {
+			break
+		}
+
+		select {
+		case <-c.acked:
+			return CreateConn(c), nil
+		case <-time.After(timeout):
+		}
+		timeout = nextTimeout(timeout)
+	}
+
+	c.fail(ErrUDPTimeout)
+	if err == nil {
+		err = ErrUDPTimeout
+	}
+	return nil, err
+}
+
+func (UDPTransport) Listen(address string) (*Listener, error) {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return CreateListener(createUDPListener(pc)), nil
+}
+
+func createUDPListener(pc net.PacketConn) *udpListener {
+	ln := &udpListener{
+		pc:      pc,
+		conns:   make(map[string]*udpConn),
+		backlog: make(chan net.Conn, udpBacklog),
+		done:    make(chan struct{}),
+	}
+	go ln.readLoop()
+	return ln
+}
+
+func (ln *udpListener) readLoop() {
+	buf := make([]byte, udpHeaderSize+udpSegmentSize)
+	for {
+		n, addr, err := ln.pc.ReadFrom(buf)
+		if err != nil {
+			ln.shutdown()
+			return
+		}
+		if n < udpHeaderSize {
+			continue
+		}
+
+		key := addr.String()
+		ln.mutex.Lock()
+		c, ok := ln.conns[key]
+		if !ok && buf[0] == udpSyn && !ln.closed {
+			c = newUDPConn(ln.pc, addr, func() { ln.remove(key) })
+			select {
+			case ln.backlog <- c:
+				ln.conns[key] = c
+				ok = true
+			default:
+				// Backlog is full, second user will retry
+			}
+		}
+		ln.mutex.Unlock()
+
+		if ok {
+			c.handle(buf[:n])
+		}
+	}
+}
+
+func (ln *udpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.backlog:
+		return c, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections, socket is closed when the last accepted
+// connection is closed.
+func (ln *udpListener) Close() error {
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+
+	if ln.closed {
+		return nil
+	}
+	ln.closed = true
+	close(ln.done)
+	if len(ln.conns) == 0 {
+		ln.pc.Close()
+	}
+	return nil
+}
+
+func (ln *udpListener) Addr() net.Addr {
+	return ln.pc.LocalAddr()
+}
+
+func (ln *udpListener) remove(key string) {
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+
+	delete(ln.conns, key)
+	if ln.closed && len(ln.conns) == 0 {
+		ln.pc.Close()
+	}
+}
+
+// shutdown breaks all connections when socket is closed.
+func (ln *udpListener) shutdown() {
+	ln.mutex.Lock()
+	conns := make([]*udpConn, 0, len(ln.conns))
+	for _, c := range ln.conns {
+		conns = append(conns, c)
+	}
+	if !ln.closed {
+		ln.closed = true
+		close(ln.done)
+	}
+	ln.mutex.Unlock()
+
+	for _, c := range conns {
+		c.fail(net.ErrClosed)
+	}
+}
+
+func newUDPConn(pc net.PacketConn, remote net.Addr, release func()) *udpConn {
+	c := &udpConn{
+		pc:      pc,
+		remote:  remote,
+		release: release,
+		acked:   make(chan struct{}),
+		unacked: make(map[uint32][]byte),
+		pending: make(map[uint32][]byte),
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+// readLoop reads segments of dialed connection, which owns the socket.
+func (c *udpConn) readLoop() {
+	buf := make([]byte, udpHeaderSize+udpSegmentSize)
+	for {
+		n, addr, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			c.fail(net.ErrClosed)
+			return
+		}
+		if n >= udpHeaderSize && addr.String() == c.remote.String() {
+			c.handle(buf[:n])
+		}
+	}
+}
+
+func (c *udpConn) handle(seg []byte) {
+	kind, seq := seg[0], binary.LittleEndian.Uint32(seg[1:])
+
+	// Any answer means that connection is established
+	if kind != udpSyn {
+		c.ackOnce.Do(func() { close(c.acked) })
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch kind {
+	case udpSyn:
+		c.pc.WriteTo(udpSegment(udpSynAck, 0, nil), c.remote)
+	case udpAck:
+		c.handleAck(seq)
+	case udpData, udpFin:
+		c.handleData(kind, seq, seg[udpHeaderSize:])
+	}
+}
+
+func (c *udpConn) handleAck(ack uint32) {
+	if ack-c.sendUna > c.sendNext-c.sendUna {
+		return
+	}
+	c.retries = 0
+	if ack == c.sendUna {
+		return
+	}
+
+	for seq := c.sendUna; seq != ack; seq++ {
+		delete(c.unacked, seq)
+	}
+	c.sendUna = ack
+	c.backoff = 0
+
+	if len(c.unacked) == 0 {
+		c.timer.Stop()
+		c.tryRelease()
+	} else {
+		c.timer.Reset(udpTimeout)
+	}
+	c.cond.Broadcast()
+}
+
+func (c *udpConn) handleData(kind byte, seq uint32, payload []byte) {
+	// Segments which are too far ahead are dropped and resent later
+	if seq-c.recNext < udpWindow {
+		if _, ok := c.pending[seq]; !ok {
+			c.pending[seq] = udpSegment(kind, seq, payload)
+		}
+	}
+
+	c.deliver()
+
+	// Duplicates are acknowledged too, previous ACK could be lost
+	c.pc.WriteTo(udpSegment(udpAck, c.recNext, nil), c.remote)
+}
+
+// deliver moves received segments to read buffer while it has room.
+func (c *udpConn) deliver() {
+	for len(c.readBuf) < udpReadBuffer {
+		seg, ok := c.pending[c.recNext]
+		if !ok {
+			break
+		}
+		delete(c.pending, c.recNext)
+		c.recNext++
+
+		if seg[0] == udpFin {
+			c.eof = true
+		} else {
+			c.readBuf = append(c.readBuf, seg[udpHeaderSize:]...)
+		}
+	}
+	c.cond.Broadcast()
+}
+
+func (c *udpConn) Read(buf []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(c.readBuf) == 0 {
+		switch {
+		case c.err != nil:
+			return 0, c.err
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.eof:
+			return 0, io.EOF
+		case deadlineExceeded(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+
+	n := copy(buf, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+
+	// Segments which were left while the buffer was full are acknowledged now
+	if next := c.recNext; len(c.pending) > 0 {
+		c.deliver()
+		if c.recNext != next {
+			c.pc.WriteTo(udpSegment(udpAck, c.recNext, nil), c.remote)
+		}
+	}
+	return n, nil
+}
+
+func (c *udpConn) Write(buf []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	written := 0
+	for len(buf) > 0 {
+		for len(c.unacked) >= udpWindow && c.err == nil && !c.closed {
+			if deadlineExceeded(c.writeDeadline) {
+				return written, os.ErrDeadlineExceeded
+			}
+			c.cond.Wait()
+		}
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.closed {
+			return written, net.ErrClosed
+		}
+
+		n := len(buf)
+		if n > udpSegmentSize {
+			n = udpSegmentSize
+		}
+		c.send(udpData, buf[:n])
+		buf = buf[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// send sends sequenced segment and keeps it until it's acknowledged.
+func (c *udpConn) send(kind byte, payload []byte) {
+	seg := udpSegment(kind, c.sendNext, payload)
+	c.unacked[c.sendNext] = seg
+	c.sendNext++
+	c.pc.WriteTo(seg, c.remote)
+
+	if c.timer == nil {
+		c.timer = time.AfterFunc(udpTimeout, c.resend)
+	} else if len(c.unacked) == 1 {
+		c.timer.Reset(udpTimeout)
+	}
+}
+
+func (c *udpConn) resend() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.unacked) == 0 || c.err != nil {
+		return
+	}
+
+	c.retries++
+	c.backoff++
+	if c.retries > udpMaxRetries {
+		c.err = ErrUDPTimeout
+		c.cond.Broadcast()
+		c.tryRelease()
+		return
+	}
+
+	for seq := c.sendUna; seq != c.sendNext; seq++ {
+		c.pc.WriteTo(c.unacked[seq], c.remote)
+	}
+
+	timeout := udpTimeout
+	for i := 0; i < c.backoff; i++ {
+		timeout = nextTimeout(timeout)
+	}
+	c.timer.Reset(timeout)
+}
+
+// Close sends FIN, socket is released when all sent data is acknowledged.
+func (c *udpConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.err == nil {
+		c.send(udpFin, nil)
+	}
+	c.cond.Broadcast()
+	c.tryRelease()
+	return nil
+}
+
+func (c *udpConn) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+	c.closed = true
+	c.cond.Broadcast()
+	c.tryRelease()
+}
+
+func (c *udpConn) tryRelease() {
+	if c.released || !c.closed || (len(c.unacked) != 0 && c.err == nil) {
+		return
+	}
+	c.released = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	go c.release()
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.readDeadline = t
+	c.mutex.Unlock()
+	c.wakeAt(t)
+	return nil
+}
+
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.writeDeadline = t
+	c.mutex.Unlock()
+	c.wakeAt(t)
+	return nil
+}
+
+// wakeAt wakes up waiting Read and Write, so they can check the deadline.
+func (c *udpConn) wakeAt(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(t), func() {
+		c.mutex.Lock()
+		c.cond.Broadcast()
+		c.mutex.Unlock()
+	})
+}
+
+func udpSegment(kind byte, seq uint32, payload []byte) []byte {
+	seg := make([]byte, udpHeaderSize+len(payload))
+	seg[0] = kind
+	binary.LittleEndian.PutUint32(seg[1:], seq)
+	copy(seg[udpHeaderSize:], payload)
+	return seg
+}
+
+func nextTimeout(timeout time.Duration) time.Duration {
+	timeout *= 2
+	if timeout > udpMaxTimeout {
+		timeout = udpMaxTimeout
+	}
+	return timeout
+}
+
+func deadlineExceeded(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
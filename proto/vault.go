@@ -0,0 +1,454 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+)
+
+/*
+
+Encrypted file format:
+
+magic "SECV" | version | kind | name length | name | record | record | ...
+
+record: length (4 bytes, LE) | nonce | ciphertext | tag
+
+Written file is a single record, appended files get a record per write. The
+header and the offset of record (8 bytes, LE) are associated data of every
+record, so records can't be moved to another file, reordered or dropped, and
+a written file can't be cut off. An appended file cut off on a record boundary
+reads as its earlier version: received files are checked by their hash and
+history loses its tail.
+
+*/
+
+const (
+	vaultCheck   = "sechan keystore"
+	vaultVersion = 1
+	vaultWhole   = 0
+	vaultAppend  = 1
+
+	keystoreMaxTime   = 64
+	keystoreMaxMemory = 4 << 20
+)
+
+var vaultMagic = []byte("SECV")
+
+var (
+	ErrPassphrase     = errors.New("wrong passphrase")
+	ErrVaultRecord    = errors.New("broken encrypted record")
+	ErrVaultFile      = errors.New("encrypted file belongs to another file")
+	ErrKeystoreKind   = errors.New("unknown keystore key derivation function")
+	ErrKeystoreParams = errors.New("invalid keystore key derivation parameters")
+	ErrPlainFile      = errors.New("file isn't encrypted")
+	ErrLockedFile     = errors.New("file is encrypted, keystore is required")
+)
+
+// Keystore keeps parameters of key derivation from passphrase. It's stored in
+// plain text, passphrase is checked with the sealed Check value.
+type Keystore struct {
+	KDF     string
+	Salt    []byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	Check   []byte
+}
+
+// Vault encrypts local files. Methods of nil Vault work with plain files.
+type Vault struct {
+	aead cipher.AEAD
+}
+
+// vaultReader decrypts file record by record.
+type vaultReader struct {
+	vault  *Vault
+	r      *bufio.Reader
+	header []byte
+	name   string
+	kind   byte
+	offset int64
+	count  int
+}
+
+func CreateKeystore(passphrase []byte) (*Keystore, *Vault, error) {
+	return createKeystore(passphrase, &Keystore{
+		KDF:     "argon2id",
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+	})
+}
+
+func createKeystore(passphrase []byte, ks *Keystore) (*Keystore, *Vault, error) {
+	ks.Salt = make([]byte, 16)
+	_, err := rand.Read(ks.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vault, err := ks.vault(passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ks.Check, err = vault.Seal([]byte(vaultCheck), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ks, vault, nil
+}
+
+func (ks *Keystore) Unlock(passphrase []byte) (*Vault, error) {
+	vault, err := ks.vault(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	check, err := vault.Open(ks.Check, nil)
+	if err != nil || string(check) != vaultCheck {
+		return nil, ErrPassphrase
+	}
+	return vault, nil
+}
+
+func (ks *Keystore) vault(passphrase []byte) (*Vault, error) {
+	if ks.KDF != "argon2id" {
+		return nil, ErrKeystoreKind
+	}
+
+	// Keystore is read from disk, argon2 panics or takes forever on broken
+	// parameters
+	if len(ks.Salt) < 16 || ks.Time == 0 || ks.Time > keystoreMaxTime || ks.Threads == 0 ||
+		ks.Memory < 8*uint32(ks.Threads) || ks.Memory > keystoreMaxMemory {
+		return nil, ErrKeystoreParams
+	}
+
+	key := argon2.IDKey(passphrase, ks.Salt, ks.Time, ks.Memory, ks.Threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Vault{aead: aead}, nil
+}
+
+func (v *Vault) Seal(data, ad []byte) ([]byte, error) {
+	nonce := make([]byte, v.aead.NonceSize(), v.aead.NonceSize()+len(data)+v.aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return v.aead.Seal(nonce, nonce, data, ad), nil
+}
+
+func (v *Vault) Open(data, ad []byte) ([]byte, error) {
+	if len(data) < v.aead.NonceSize() {
+		return nil, ErrVaultRecord
+	}
+
+	nonce := data[:v.aead.NonceSize()]
+	plain, err := v.aead.Open(nil, nonce, data[len(nonce):], ad)
+	if err != nil {
+		return nil, ErrVaultRecord
+	}
+	return plain, nil
+}
+
+// ReadFile reads and decrypts file. Files without magic are refused once the
+// vault is unlocked, they're encrypted with Migrate.
+func (v *Vault) ReadFile(name string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := v.copyFile(name, &buf, true)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CopyFrom writes plain text of opened file to w record by record, so large
+// files aren't loaded in memory.
+func (v *Vault) CopyFrom(fd *os.File, w io.Writer) error {
+	return v.copyFrom(fd, w, true)
+}
+
+// Export writes plain text of file to w record by record. Received files keep
+// the name of their partial file, so the name isn't checked.
+func (v *Vault) Export(name string, w io.Writer) error {
+	return v.copyFile(name, w, false)
+}
+
+func (v *Vault) copyFile(name string, w io.Writer, checkName bool) error {
+	fd, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return v.copyFrom(fd, w, checkName)
+}
+
+func (v *Vault) copyFrom(fd *os.File, w io.Writer, checkName bool) error {
+	if v == nil {
+		r := bufio.NewReader(fd)
+		magic, _ := r.Peek(len(vaultMagic))
+		if bytes.Equal(magic, vaultMagic) {
+			return ErrLockedFile
+		}
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	vr, err := v.newReader(fd)
+	if err != nil {
+		return err
+	}
+	if checkName && vr.name != filepath.Base(fd.Name()) {
+		return ErrVaultFile
+	}
+
+	for {
+		data, err := vr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (v *Vault) newReader(r io.Reader) (*vaultReader, error) {
+	vr := &vaultReader{vault: v, r: bufio.NewReader(r)}
+	magic, _ := vr.r.Peek(len(vaultMagic))
+	if !bytes.Equal(magic, vaultMagic) {
+		return nil, ErrPlainFile
+	}
+
+	vr.header = make([]byte, len(vaultMagic)+3)
+	_, err := io.ReadFull(vr.r, vr.header)
+	if err != nil {
+		return nil, ErrVaultRecord
+	}
+	version, kind, length := vr.header[4], vr.header[5], vr.header[6]
+	if version != vaultVersion || kind > vaultAppend {
+		return nil, ErrVaultFile
+	}
+
+	name := make([]byte, length)
+	_, err = io.ReadFull(vr.r, name)
+	if err != nil {
+		return nil, ErrVaultRecord
+	}
+	vr.header = append(vr.header, name...)
+	vr.name = string(name)
+	vr.kind = kind
+	vr.offset = int64(len(vr.header))
+	return vr, nil
+}
+
+// next returns plain text of the next record or io.EOF after the last one.
+func (vr *vaultReader) next() ([]byte, error) {
+	var length [4]byte
+	_, err := io.ReadFull(vr.r, length[:])
+	if err == io.EOF {
+		if vr.kind == vaultWhole && vr.count != 1 {
+			return nil, ErrVaultRecord
+		}
+		return nil, io.EOF
+	}
+	if err != nil || vr.kind == vaultWhole && vr.count != 0 {
+		return nil, ErrVaultRecord
+	}
+
+	// Buffer grows with read data only, length isn't trusted
+	var sealed bytes.Buffer
+	size := int64(binary.LittleEndian.Uint32(length[:]))
+	n, err := io.CopyN(&sealed, vr.r, size)
+	if n != size {
+		return nil, ErrVaultRecord
+	}
+
+	plain, err := vr.vault.Open(sealed.Bytes(), vaultAD(vr.header, vr.offset))
+	if err != nil {
+		return nil, err
+	}
+	vr.offset += 4 + size
+	vr.count++
+	return plain, nil
+}
+
+// WriteFile encrypts data and replaces file with it. Data is written to a
+// temporary file which is renamed over name, so readers never see a torn
+// file.
+func (v *Vault) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if v != nil {
+		var err error
+		data, err = v.encode(name, vaultWhole, data)
+		if err != nil {
+			return err
+		}
+	}
+	return replaceFile(name, data, perm)
+}
+
+func (v *Vault) AppendFile(name string, data []byte, perm os.FileMode) error {
+	fd, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_RDWR, perm)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return v.AppendTo(fd, data)
+}
+
+// AppendTo is AppendFile for file opened by caller for reading and appending.
+func (v *Vault) AppendTo(fd *os.File, data []byte) error {
+	stat, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	if v == nil {
+		magic := make([]byte, len(vaultMagic))
+		fd.ReadAt(magic, 0)
+		if stat.Size() > 0 && bytes.Equal(magic, vaultMagic) {
+			return ErrLockedFile
+		}
+		_, err = fd.Write(data)
+		return err
+	}
+
+	if stat.Size() == 0 {
+		data, err = v.encode(fd.Name(), vaultAppend, data)
+		if err != nil {
+			return err
+		}
+		_, err = fd.Write(data)
+		return err
+	}
+
+	header, err := vaultHeader(fd.Name(), vaultAppend)
+	if err != nil {
+		return err
+	}
+	existing := make([]byte, len(header))
+	fd.ReadAt(existing, 0)
+	if !bytes.HasPrefix(existing, vaultMagic) {
+		return ErrPlainFile
+	}
+	if !bytes.Equal(existing, header) {
+		return ErrVaultFile
+	}
+
+	record, err := v.record(header, stat.Size(), data)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(record)
+	return err
+}
+
+// Migrate encrypts file written in plain text before encryption was enabled.
+// Missing and encrypted files are left as is.
+func (v *Vault) Migrate(name string, appended bool) error {
+	buf, err := os.ReadFile(name)
+	if os.IsNotExist(err) || err == nil && bytes.HasPrefix(buf, vaultMagic) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	kind := byte(vaultWhole)
+	if appended {
+		kind = vaultAppend
+	}
+	buf, err = v.encode(name, kind, buf)
+	if err != nil {
+		return err
+	}
+	return replaceFile(name, buf, 0600)
+}
+
+// encode returns header of file and its first record.
+func (v *Vault) encode(name string, kind byte, data []byte) ([]byte, error) {
+	header, err := vaultHeader(name, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := v.record(header, int64(len(header)), data)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, record...), nil
+}
+
+func (v *Vault) record(header []byte, offset int64, data []byte) ([]byte, error) {
+	sealed, err := v.Seal(data, vaultAD(header, offset))
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, 4, 4+len(sealed))
+	binary.LittleEndian.PutUint32(record, uint32(len(sealed)))
+	return append(record, sealed...), nil
+}
+
+func vaultHeader(name string, kind byte) ([]byte, error) {
+	base := filepath.Base(name)
+	if len(base) > 255 {
+		return nil, ErrVaultFile
+	}
+
+	header := append([]byte{}, vaultMagic...)
+	header = append(header, vaultVersion, kind, byte(len(base)))
+	return append(header, base...), nil
+}
+
+func vaultAD(header []byte, offset int64) []byte {
+	return binary.LittleEndian.AppendUint64(append([]byte{}, header...), uint64(offset))
+}
+
+func replaceFile(name string, data []byte, perm os.FileMode) error {
+	fd, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := fd.Name()
+
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Chmod(perm)
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testKeystore is cheap to unlock.
+func testKeystore(t *testing.T) (*Keystore, *Vault) {
+	ks, vault, err := createKeystore([]byte("secret"), &Keystore{
+		KDF:     "argon2id",
+		Time:    1,
+		Memory:  64,
+		Threads: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks, vault
+}
+
+func TestKeystore(t *testing.T) {
+	ks, _ := testKeystore(t)
+	js, _ := json.Marshal(ks)
+
+	loaded := &Keystore{}
+	json.Unmarshal(js, loaded)
+	if _, err := loaded.Unlock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.Unlock([]byte("wrong")); err != ErrPassphrase {
+		t.Fatalf("expected %v, got %v", ErrPassphrase, err)
+	}
+
+	broken := []func(*Keystore){
+		func(ks *Keystore) { ks.Threads = 0 },
+		func(ks *Keystore) { ks.Time = 0 },
+		func(ks *Keystore) { ks.Memory = 0 },
+		func(ks *Keystore) { ks.Memory = keystoreMaxMemory + 1 },
+		func(ks *Keystore) { ks.Salt = nil },
+	}
+	for i, change := range broken {
+		ks := *loaded
+		change(&ks)
+		if _, err := ks.Unlock([]byte("secret")); err != ErrKeystoreParams {
+			t.Fatalf("%d: expected %v, got %v", i, ErrKeystoreParams, err)
+		}
+	}
+}
+
+func TestVaultFiles(t *testing.T) {
+	_, vault := testKeystore(t)
+	dir := t.TempDir()
+	whole, appended := filepath.Join(dir, "peers"), filepath.Join(dir, "history")
+
+	if err := vault.WriteFile(whole, []byte("peers"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"a\n", "b\n", "c\n"} {
+		if err := vault.AppendFile(appended, []byte(line), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	raw, _ := os.ReadFile(whole)
+	if !bytes.HasPrefix(raw, vaultMagic) || bytes.HasSuffix(raw, []byte("peers")) {
+		t.Fatalf("file isn't encrypted: %q", raw)
+	}
+	if data, err := vault.ReadFile(whole); err != nil || string(data) != "peers" {
+		t.Fatalf("wrong file %q: %v", data, err)
+	}
+	var exported bytes.Buffer
+	if err := vault.Export(appended, &exported); err != nil || exported.String() != "a\nb\nc\n" {
+		t.Fatalf("wrong export %q: %v", exported.String(), err)
+	}
+
+	_, other := testKeystore(t)
+	if _, err := other.ReadFile(whole); err != ErrVaultRecord {
+		t.Fatalf("expected %v, got %v", ErrVaultRecord, err)
+	}
+	if _, err := (*Vault)(nil).ReadFile(whole); err != ErrLockedFile {
+		t.Fatalf("expected %v, got %v", ErrLockedFile, err)
+	}
+}
+
+func TestVaultTampering(t *testing.T) {
+	_, vault := testKeystore(t)
+	dir := t.TempDir()
+	name := filepath.Join(dir, "history")
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		vault.AppendFile(name, []byte(line), 0600)
+	}
+	raw, _ := os.ReadFile(name)
+	header, _ := vaultHeader(name, vaultAppend)
+	records := splitRecords(t, raw[len(header):])
+
+	tests := map[string][]byte{
+		"flipped bit": func() []byte {
+			buf := append([]byte{}, raw...)
+			buf[len(buf)-1] ^= 1
+			return buf
+		}(),
+		"reordered": bytes.Join([][]byte{header, records[1], records[0], records[2]}, nil),
+		"dropped":   bytes.Join([][]byte{header, records[0], records[2]}, nil),
+		"cut":       raw[:len(raw)-1],
+		"renamed": func() []byte {
+			other, _ := vaultHeader("pins", vaultAppend)
+			return bytes.Join([][]byte{other, records[0]}, nil)
+		}(),
+	}
+	// Export doesn't check the name, so records are checked by themselves
+	for test, buf := range tests {
+		os.WriteFile(name, buf, 0600)
+		if err := vault.Export(name, &bytes.Buffer{}); err != ErrVaultRecord {
+			t.Fatalf("%s: expected %v, got %v", test, ErrVaultRecord, err)
+		}
+	}
+
+	// Record of another file isn't accepted
+	whole := filepath.Join(dir, "pins")
+	vault.WriteFile(whole, []byte("pins"), 0600)
+	vault.WriteFile(filepath.Join(dir, "peers"), []byte("peers"), 0600)
+	os.Rename(filepath.Join(dir, "peers"), whole)
+	if _, err := vault.ReadFile(whole); err != ErrVaultFile {
+		t.Fatalf("expected %v, got %v", ErrVaultFile, err)
+	}
+
+	// Written file without its record
+	header, _ = vaultHeader(whole, vaultWhole)
+	os.WriteFile(whole, header, 0600)
+	if _, err := vault.ReadFile(whole); err != ErrVaultRecord {
+		t.Fatalf("expected %v, got %v", ErrVaultRecord, err)
+	}
+}
+
+func TestVaultMigrate(t *testing.T) {
+	_, vault := testKeystore(t)
+	dir := t.TempDir()
+	whole, appended := filepath.Join(dir, "peers"), filepath.Join(dir, "history")
+	os.WriteFile(whole, []byte("peers"), 0600)
+	os.WriteFile(appended, []byte("a\n"), 0600)
+
+	if _, err := vault.ReadFile(whole); err != ErrPlainFile {
+		t.Fatalf("expected %v, got %v", ErrPlainFile, err)
+	}
+	if err := vault.AppendFile(appended, []byte("b\n"), 0600); err != ErrPlainFile {
+		t.Fatalf("expected %v, got %v", ErrPlainFile, err)
+	}
+
+	for _, name := range []string{whole, appended, filepath.Join(dir, "missing")} {
+		if err := vault.Migrate(name, name == appended); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Encrypted file is left as is
+	if err := vault.Migrate(whole, false); err != nil {
+		t.Fatal(err)
+	}
+	vault.AppendFile(appended, []byte("b\n"), 0600)
+
+	if data, err := vault.ReadFile(whole); err != nil || string(data) != "peers" {
+		t.Fatalf("wrong file %q: %v", data, err)
+	}
+	if data, err := vault.ReadFile(appended); err != nil || string(data) != "a\nb\n" {
+		t.Fatalf("wrong file %q: %v", data, err)
+	}
+}
+
+func splitRecords(t *testing.T, buf []byte) [][]byte {
+	var records [][]byte
+	for len(buf) > 0 {
+		length := 4 + int(binary.LittleEndian.Uint32(buf))
+		if length > len(buf) {
+			t.Fatal("broken record")
+		}
+		records = append(records, buf[:length])
+		buf = buf[length:]
+	}
+	return records
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"log"
 	"net"
-	"strings"
 	"time"
 )
 
@@ -56,15 +55,33 @@ func ReceiveInfo(host *proto.Host, addr string) {
 		if peer.Addr == host.Addr {
 			continue
 		}
+		// Identity key and verification are trusted only when they come from
+		// handshake and the local user
+		peer.Key = nil
+		peer.Verified = false
 
-		ip := strings.Split(peer.Addr, ":")[0]
-		_, ok := host.Peers[ip]
+		ip, _, err := net.SplitHostPort(peer.Addr)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		known, ok := host.Peers.Get(ip)
 		if !ok {
-			host.Peers[ip] = peer
-			SavePeers(host.Peers)
-		} else {
-			host.Peers[ip].Login = peer.Login
-			host.Peers[ip].Addr = peer.Addr
+			host.Peers.Add(ip, peer)
+		} else if known.Login != peer.Login || known.Addr != peer.Addr {
+			host.Peers.Update(ip, func(known *proto.Peer) {
+				known.Login = peer.Login
+				known.Addr = peer.Addr
+			})
+		}
+
+		if host.Outbox.Len(ip) > 0 {
+			go func(ip, addr string) {
+				err := host.DeliverOutbox(ip, addr)
+				if err != nil {
+					log.Println(err)
+				}
+			}(ip, peer.Addr)
 		}
 	}
 }